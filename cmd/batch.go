@@ -0,0 +1,511 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// the most pdfs a single batch may ask for
+const maxBatchItems = 1000
+
+// how many batch members are set up at once (each one looks up its pid in tracksys and solr)
+const batchStartWorkers = 4
+
+var batchIDPattern = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// one pdf requested as part of a batch
+type batchItem struct {
+	Pid     string `json:"pid"`
+	Unit    string `json:"unit,omitempty"`
+	Pages   string `json:"pages,omitempty"`
+	Token   string `json:"token,omitempty"`
+	Waiting bool   `json:"waiting,omitempty"` // generation has not been set up yet
+	Error   string `json:"error,omitempty"`   // why generation could not be started, if it could not
+}
+
+// a batch of pdfs, persisted under the storage directory so its status survives a restart
+type pdfBatch struct {
+	ID      string      `json:"id"`
+	Created time.Time   `json:"created"`
+	Cover   string      `json:"cover"`
+	Format  string      `json:"format"`
+	Ocr     string      `json:"ocr,omitempty"`
+	Items   []batchItem `json:"items"`
+
+	mu sync.Mutex // guards items and saving while the batch is being started
+}
+
+// the body of a batch request; the output options apply to every item
+type batchRequest struct {
+	Items  []batchItem `json:"items"`
+	Cover  string      `json:"cover"`
+	Format string      `json:"format"`
+	Ocr    string      `json:"ocr"`
+}
+
+type batchItemStatus struct {
+	pdfStatus
+	Unit  string `json:"unit,omitempty"`
+	Pages string `json:"pages,omitempty"`
+	Token string `json:"token,omitempty"`
+}
+
+// the json batch status representation
+type batchStatus struct {
+	ID          string            `json:"batch_id"`
+	State       string            `json:"state"` // processing, ready, partial (some failed), or failed
+	Created     time.Time         `json:"created"`
+	Total       int               `json:"total"`
+	Ready       int               `json:"ready"`
+	Failed      int               `json:"failed"`
+	Pending     int               `json:"pending"`
+	DownloadURL string            `json:"download_url,omitempty"`
+	Items       []batchItemStatus `json:"items"`
+}
+
+func batchDir() string {
+	return fmt.Sprintf("%s/.batches", config.storageDir.value)
+}
+
+func batchFile(id string) string {
+	return fmt.Sprintf("%s/%s.json", batchDir(), id)
+}
+
+/**
+ * Handle a request to generate pdfs for a list of pids
+ */
+func batchHandler(ctx *gin.Context) {
+	c := newClientContext(ctx)
+
+	var req batchRequest
+	if err := json.NewDecoder(c.ctx.Request.Body).Decode(&req); err != nil {
+		c.err("unable to parse batch request: %s", err.Error())
+		c.respondString(http.StatusBadRequest, "Invalid batch request")
+		return
+	}
+
+	if len(req.Items) == 0 {
+		c.err("batch request has no items")
+		c.respondString(http.StatusBadRequest, "No PIDs given")
+		return
+	}
+
+	if len(req.Items) > maxBatchItems {
+		c.err("batch request has %d items", len(req.Items))
+		c.respondString(http.StatusBadRequest, fmt.Sprintf("Too many PIDs (at most %d per batch)", maxBatchItems))
+		return
+	}
+
+	// options in the body take precedence over the query string
+	if req.Cover != "" {
+		c.req.cover = req.Cover
+	}
+
+	if req.Format != "" {
+		c.req.format = req.Format
+	}
+
+	if req.Ocr != "" {
+		c.req.ocr = req.Ocr
+	}
+
+	if msg := c.checkOptions(); msg != "" {
+		c.respondString(http.StatusBadRequest, msg)
+		return
+	}
+
+	b := &pdfBatch{
+		ID:      randomHex(8),
+		Created: time.Now(),
+		Cover:   c.req.cover,
+		Format:  c.req.format,
+		Ocr:     c.req.ocr,
+		Items:   req.Items,
+	}
+
+	for i := range b.Items {
+		item := &b.Items[i]
+		item.Waiting = true
+		item.Error = ""
+
+		if isValidPathSegment(item.Pid) == false || (item.Token != "" && isValidPathSegment(item.Token) == false) {
+			c.err("invalid batch item %d: pid [%s] token [%s]", i, item.Pid, item.Token)
+			c.respondString(http.StatusBadRequest, fmt.Sprintf("Invalid PID or token in item %d", i+1))
+			return
+		}
+
+		// partial pdfs need their own work directory
+		if item.Pages != "" && item.Token == "" {
+			item.Token = fmt.Sprintf("%s-%d", b.ID, i+1)
+		}
+	}
+
+	if err := os.MkdirAll(batchDir(), 0755); err != nil {
+		c.err("unable to create batch directory: %s", err.Error())
+		c.respondString(http.StatusInternalServerError, "ERROR: failed to initialize batch")
+		return
+	}
+
+	if err := b.save(); err != nil {
+		c.err("unable to save batch %s: %s", b.ID, err.Error())
+		c.respondString(http.StatusInternalServerError, "ERROR: failed to initialize batch")
+		return
+	}
+
+	c.info("starting batch %s with %d items", b.ID, len(b.Items))
+
+	status := c.getBatchStatus(b)
+
+	// looking up and queueing every item can take minutes, so it is done in the background
+	go c.startBatch(b)
+
+	c.ctx.Header("Location", fmt.Sprintf("/batch/%s", url.PathEscape(b.ID)))
+	c.respondJSON(http.StatusAccepted, status)
+}
+
+// picks up batches whose items were still being started when the service stopped
+func initBatches() {
+	files, _ := filepath.Glob(fmt.Sprintf("%s/*.json", batchDir()))
+
+	for _, fileName := range files {
+		b, err := loadBatch(strings.TrimSuffix(filepath.Base(fileName), ".json"))
+		if err != nil {
+			log.Printf("WARNING: unable to load batch [%s]: %s", fileName, err.Error())
+			continue
+		}
+
+		pending := 0
+		for _, item := range b.Items {
+			if item.Waiting == true {
+				pending++
+			}
+		}
+
+		if pending == 0 {
+			continue
+		}
+
+		log.Printf("INFO: resuming batch %s with %d of %d items still to start", b.ID, pending, len(b.Items))
+
+		c := clientContext{reqID: fmt.Sprintf("batch-%s", b.ID)}
+		go c.startBatch(b)
+	}
+}
+
+// sets up generation for every item in the batch not yet started, recording any
+// that could not be.  the batch is saved as each item is started, so that its
+// status shows progress, and a restart picks up where this left off.
+func (c *clientContext) startBatch(b *pdfBatch) {
+	b.mu.Lock()
+	var pending []int
+	contexts := make([]*clientContext, len(b.Items))
+	for i := range b.Items {
+		contexts[i] = c.batchItemContext(b, i)
+		if b.Items[i].Waiting == true {
+			pending = append(pending, i)
+		}
+	}
+	b.mu.Unlock()
+
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < batchStartWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				ic := contexts[i]
+				ic.info("batch %s item %d: starting generation for [%s]", b.ID, i+1, ic.pdf.workSubDir)
+
+				res := claims.do(ic, ic.startGeneration)
+
+				b.mu.Lock()
+				b.Items[i].Waiting = false
+				if res.err != nil {
+					b.Items[i].Error = strings.TrimSpace(res.msg)
+				}
+				if err := b.save(); err != nil {
+					ic.err("unable to save batch %s: %s", b.ID, err.Error())
+				}
+				b.mu.Unlock()
+			}
+		}()
+	}
+
+	for _, i := range pending {
+		indexes <- i
+	}
+	close(indexes)
+
+	wg.Wait()
+
+	c.info("batch %s: all items started", b.ID)
+}
+
+// creates a context for one member of a batch, as if it had been requested on its own
+func (c *clientContext) batchItemContext(b *pdfBatch, i int) *clientContext {
+	item := b.Items[i]
+
+	ic := clientContext{}
+
+	ic.reqID = randomHex(4)
+	ic.ip = c.ip
+
+	ic.req.pid = item.Pid
+	ic.req.unit = item.Unit
+	ic.req.pages = item.Pages
+	ic.req.token = item.Token
+	ic.req.cover = b.Cover
+	ic.req.format = b.Format
+	ic.req.ocr = b.Ocr
+
+	ic.initPdfInfo()
+
+	return &ic
+}
+
+func (b *pdfBatch) save() error {
+	buf, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(batchFile(b.ID), buf)
+}
+
+func loadBatch(id string) (*pdfBatch, error) {
+	if batchIDPattern.MatchString(id) == false {
+		return nil, os.ErrNotExist
+	}
+
+	buf, err := os.ReadFile(batchFile(id))
+	if err != nil {
+		return nil, err
+	}
+
+	var b pdfBatch
+	if err := json.Unmarshal(buf, &b); err != nil {
+		return nil, err
+	}
+
+	return &b, nil
+}
+
+// gathers the status of every item in the batch
+func (c *clientContext) getBatchStatus(b *pdfBatch) batchStatus {
+	status := batchStatus{ID: b.ID, Created: b.Created, Total: len(b.Items)}
+
+	for i, item := range b.Items {
+		ic := c.batchItemContext(b, i)
+
+		var itemStatus pdfStatus
+
+		switch {
+		case item.Error != "":
+			itemStatus = pdfStatus{Pid: item.Pid, State: "failed", FailureReason: item.Error}
+
+		case item.Waiting == true:
+			itemStatus = pdfStatus{Pid: item.Pid, State: "queued"}
+
+		case ic.progressInValidState() == false:
+			itemStatus = pdfStatus{Pid: item.Pid, State: "not_found"}
+
+		default:
+			itemStatus = ic.getStatus()
+		}
+
+		switch itemStatus.State {
+		case "ready":
+			status.Ready++
+		case "failed", "not_found":
+			// e.g. deleted since the batch was started
+			status.Failed++
+		default:
+			status.Pending++
+		}
+
+		status.Items = append(status.Items, batchItemStatus{pdfStatus: itemStatus, Unit: item.Unit, Pages: item.Pages, Token: item.Token})
+	}
+
+	switch {
+	case status.Pending > 0:
+		status.State = "processing"
+	case status.Failed == 0:
+		status.State = "ready"
+	case status.Ready > 0:
+		status.State = "partial"
+	default:
+		status.State = "failed"
+	}
+
+	if status.Pending == 0 && status.Ready > 0 {
+		status.DownloadURL = fmt.Sprintf("/batch/%s/download", url.PathEscape(b.ID))
+	}
+
+	return status
+}
+
+// looks up the batch named in the request, responding with an error if it does not exist
+func (c *clientContext) getRequestedBatch() *pdfBatch {
+	id := c.ctx.Param("id")
+
+	b, err := loadBatch(id)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) == true {
+			c.respondString(http.StatusNotFound, "Not found")
+			return nil
+		}
+
+		c.err("unable to load batch [%s]: %s", id, err.Error())
+		c.respondString(http.StatusInternalServerError, "Unable to read batch")
+		return nil
+	}
+
+	return b
+}
+
+func batchStatusHandler(ctx *gin.Context) {
+	c := newClientContext(ctx)
+
+	b := c.getRequestedBatch()
+	if b == nil {
+		return
+	}
+
+	c.respondJSON(http.StatusOK, c.getBatchStatus(b))
+}
+
+/**
+ * Download every pdf in a finished batch as a single zip file.  Failed items are
+ * left out, and listed along with their failure reasons in failures.txt
+ */
+func batchDownloadHandler(ctx *gin.Context) {
+	c := newClientContext(ctx)
+
+	b := c.getRequestedBatch()
+	if b == nil {
+		return
+	}
+
+	status := c.getBatchStatus(b)
+
+	if status.Pending > 0 {
+		c.respondString(http.StatusConflict, fmt.Sprintf("Batch is not complete (%d of %d PDFs pending)", status.Pending, status.Total))
+		return
+	}
+
+	if status.Ready == 0 {
+		c.respondString(http.StatusNotFound, "No PDFs available for this batch")
+		return
+	}
+
+	c.logResponse(http.StatusOK, "application/zip")
+	c.ctx.Header("Content-Type", "application/zip")
+	c.ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="batch-%s.zip"`, b.ID))
+	c.ctx.Status(http.StatusOK)
+
+	c.info("batch %s download started: %d PDFs", b.ID, status.Ready)
+
+	if err := c.writeBatchZip(c.ctx.Writer, b, status); err != nil {
+		// too late to change the response; the client will see a truncated zip
+		c.err("batch %s download failed: %s", b.ID, err.Error())
+	}
+}
+
+func (c *clientContext) writeBatchZip(w io.Writer, b *pdfBatch, status batchStatus) error {
+	zw := zip.NewWriter(w)
+
+	names := make(map[string]bool)
+	failures := ""
+
+	for i, itemStatus := range status.Items {
+		if itemStatus.State != "ready" {
+			reason := strings.Join(strings.Fields(itemStatus.FailureReason), " ")
+			failures += fmt.Sprintf("%s: %s\n", itemStatus.Pid, strings.TrimSpace(fmt.Sprintf("%s %s", itemStatus.State, reason)))
+			continue
+		}
+
+		// the same pid may appear more than once, e.g. for different units or pages
+		name := itemStatus.Pid
+		if itemStatus.Unit != "" {
+			name = fmt.Sprintf("%s-unit-%s", name, itemStatus.Unit)
+		}
+
+		name = uniqueName(names, name)
+
+		location, backend, err := c.batchItemContext(b, i).storedPdf()
+		if err != nil {
+			return err
+		}
+
+		if err := addPdfToZip(c.ctx.Request.Context(), zw, backend, location, fmt.Sprintf("%s.pdf", name)); err != nil {
+			return err
+		}
+	}
+
+	if failures != "" {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: "failures.txt", Method: zip.Deflate, Modified: time.Now()})
+		if err != nil {
+			return err
+		}
+
+		if _, err := f.Write([]byte(failures)); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+// returns the name, or the first of name-2, name-3, etc. that has not been used yet,
+// and marks it as used.  any of these could be a pid in its own right, so each
+// is checked against every name used so far.
+func uniqueName(used map[string]bool, name string) string {
+	unique := name
+	for n := 2; used[unique] == true; n++ {
+		unique = fmt.Sprintf("%s-%d", name, n)
+	}
+
+	used[unique] = true
+
+	return unique
+}
+
+func addPdfToZip(ctx context.Context, zw *zip.Writer, backend pdfStorage, location, name string) error {
+	pdf, err := backend.stat(ctx, location)
+	if err != nil {
+		return err
+	}
+
+	in, err := backend.open(ctx, location)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// pdfs are already compressed
+	out, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: pdf.modified})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+
+	return err
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUniqueName(t *testing.T) {
+	tests := []struct {
+		names []string
+		want  []string
+	}{
+		{[]string{"a", "b", "c"}, []string{"a", "b", "c"}},
+		{[]string{"a", "a", "a"}, []string{"a", "a-2", "a-3"}},
+		// a pid that looks like a generated name, before or after the duplicate
+		{[]string{"a", "a", "a-2"}, []string{"a", "a-2", "a-2-2"}},
+		{[]string{"a-2", "a", "a"}, []string{"a-2", "a", "a-3"}},
+		{[]string{"a-unit-1", "a-unit-1", "a-unit-1-2"}, []string{"a-unit-1", "a-unit-1-2", "a-unit-1-2-2"}},
+	}
+
+	for _, test := range tests {
+		used := make(map[string]bool)
+
+		var got []string
+		for _, name := range test.names {
+			got = append(got, uniqueName(used, name))
+		}
+
+		if reflect.DeepEqual(got, test.want) == false {
+			t.Errorf("%v: got %v, want %v", test.names, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// how often a running job checks whether it has been cancelled or deleted elsewhere
+const cancelCheckInterval = 2 * time.Second
+
+// reason recorded for jobs stopped by a cancel request
+const cancelledReason = "Cancelled by request"
+
+func cancelFile(workDir string) string {
+	return fmt.Sprintf("%s/cancel.txt", workDir)
+}
+
+// the context governing this job's downloads and child processes
+func (c *clientContext) context() context.Context {
+	if c.jobCtx == nil {
+		return context.Background()
+	}
+
+	return c.jobCtx
+}
+
+// returns true once the job this context is running has been cancelled or deleted
+func (c *clientContext) cancelled() bool {
+	return c.jobCtx != nil && c.jobCtx.Err() != nil
+}
+
+// creates a command that is killed, along with every process it starts, when the job
+// is cancelled.  the helper script runs imagemagick and ghostscript as children of its
+// own, so the whole process group has to go.
+func (c *clientContext) command(name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(c.context(), name, args...)
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = 5 * time.Second
+
+	return cmd
+}
+
+// cancels a running job once its work directory is removed, or a cancel marker
+// appears in it, which may be done by any instance sharing the storage directory
+func (q *jobQueue) watchForCancel(job *pdfJob, workDir string) {
+	ticker := time.NewTicker(cancelCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-job.ctx.Done():
+			return
+
+		case <-ticker.C:
+			reason := ""
+
+			if _, err := os.Stat(workDir); err != nil {
+				reason = "working directory vanished"
+			} else if _, err := os.Stat(cancelFile(workDir)); err == nil {
+				reason = "cancel requested"
+			}
+
+			if reason != "" {
+				newJobContext(job).info("%s; cancelling job %s", reason, job.ID)
+				job.cancel()
+				return
+			}
+		}
+	}
+}
+
+// wraps up a job whose generation was stopped part way through.  a deleted job
+// leaves nothing behind; a cancelled one is recorded as failed.
+func (c *clientContext) finishCancelled() {
+	if _, err := os.Stat(cancelFile(c.pdf.workDir)); err != nil {
+		c.info("job for [%s] was deleted while running", c.pdf.workSubDir)
+		return
+	}
+
+	c.info("job for [%s] was cancelled while running", c.pdf.workSubDir)
+	c.recordFailure(cancelledReason)
+}
+
+// stops the job for this pdf, wherever it is queued or running, and records it
+// as failed so that a later request starts over.  returns false if the job had
+// already finished.
+func (c *clientContext) cancelJob() bool {
+	if c.isDone() == true || c.isFailed() == true {
+		return false
+	}
+
+	// the marker lets an instance running the job notice the request
+	if err := os.WriteFile(cancelFile(c.pdf.workDir), []byte(c.reqID), 0644); err != nil {
+		c.warn("unable to write cancel marker: %s", err.Error())
+	}
+
+	if jobs.cancel(c.pdf.workSubDir) == true {
+		c.info("cancelled job for [%s]", c.pdf.workSubDir)
+	}
+
+	// a job running here records its own failure once it has stopped, as does one held
+	// by another live instance once that notices the marker.  until then it is still in
+	// progress, so nothing can clear the marker by retrying it.
+	if jobs.isRunning(c.pdf.workSubDir) == false && ownedElsewhere(c.pdf.workSubDir) == false {
+		c.recordFailure(cancelledReason)
+	}
+
+	return true
+}
+
+/**
+ * Handle a request to cancel a job: POST /jobs/:id/cancel
+ */
+func cancelJobHandler(ctx *gin.Context) {
+	c := newJobIDContext(ctx)
+	if c == nil {
+		return
+	}
+
+	if c.progressInValidState() == false {
+		c.respondJobNotFound()
+		return
+	}
+
+	if c.cancelJob() == false {
+		c.respondJSON(http.StatusConflict, c.getJobStatus())
+		return
+	}
+
+	c.respondJSON(http.StatusAccepted, c.getJobStatus())
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how long a claim lock may be held before it is assumed to belong to a crashed process
+const claimLockTimeout = 60 * time.Second
+
+// how long to wait for another process to release a claim lock
+const claimLockWait = 30 * time.Second
+
+// the outcome of an attempt to start generating a PDF, shared by all concurrent callers
+type claimResult struct {
+	status int    // http status code
+	msg    string // response for the client
+	err    error  // error, if any
+}
+
+type claimCall struct {
+	done   chan struct{}
+	leader string // request id of the caller doing the work
+	res    claimResult
+}
+
+// collapses concurrent claims for the same work directory into a single call
+type claimGroup struct {
+	mu    sync.Mutex
+	calls map[string]*claimCall
+}
+
+var claims = claimGroup{calls: make(map[string]*claimCall)}
+
+// runs fn for the given work directory, unless a call for it is already in flight,
+// in which case this waits for that call and returns its result instead
+func (g *claimGroup) do(c *clientContext, fn func() claimResult) claimResult {
+	key := c.pdf.workSubDir
+
+	g.mu.Lock()
+	if call, ok := g.calls[key]; ok == true {
+		g.mu.Unlock()
+		c.info("attaching to in-flight request %s for [%s]", call.leader, key)
+		<-call.done
+		return call.res
+	}
+
+	call := &claimCall{done: make(chan struct{}), leader: c.reqID}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(call.done)
+	}()
+
+	unlock, err := lockWorkSubDir(key)
+	if err != nil {
+		c.err("unable to claim [%s]: %s", key, err.Error())
+		call.res = claimResult{status: http.StatusServiceUnavailable, msg: "ERROR: PDF is busy; please try again", err: err}
+		return call.res
+	}
+	defer unlock()
+
+	c.claimed = true
+	call.res = fn()
+	c.claimed = false
+
+	return call.res
+}
+
+func claimLockFile(workSubDir string) string {
+	return fmt.Sprintf("%s/.locks/%s.lock", config.storageDir.value, url.PathEscape(workSubDir))
+}
+
+// how often a held claim lock is touched, so that it is never mistaken for an abandoned one
+const claimLockRefresh = claimLockTimeout / 4
+
+// distinguishes the locks taken by this instance
+var claimLockCount atomic.Uint64
+
+// takes an exclusive lock on a work directory that is honored by every instance
+// sharing the storage directory.  the lock lives outside the work directory so
+// that it survives the directory being cleared out while it is held.  each lock
+// holds a token unique to its holder, and is kept fresh for as long as it is held.
+func lockWorkSubDir(workSubDir string) (func(), error) {
+	lockFile := claimLockFile(workSubDir)
+
+	if err := os.MkdirAll(fmt.Sprintf("%s/.locks", config.storageDir.value), 0755); err != nil {
+		return nil, err
+	}
+
+	token := fmt.Sprintf("%s %d", instanceID, claimLockCount.Add(1))
+	deadline := time.Now().Add(claimLockWait)
+
+	for {
+		f, err := os.OpenFile(lockFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+		if err == nil {
+			_, err = f.WriteString(token)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(lockFile)
+				return nil, err
+			}
+
+			stop := make(chan struct{})
+			go refreshClaimLock(lockFile, token, claimLockRefresh, stop)
+
+			return func() {
+				close(stop)
+				removeClaimLock(lockFile, token)
+			}, nil
+		}
+
+		if os.IsExist(err) == false {
+			return nil, err
+		}
+
+		// break locks left behind by a process that died while holding one
+		if holder, err := os.ReadFile(lockFile); err == nil {
+			if fi, err := os.Stat(lockFile); err == nil && time.Since(fi.ModTime()) > claimLockTimeout {
+				if removeClaimLock(lockFile, string(holder)) == true {
+					log.Printf("WARNING: broke abandoned lock on [%s] held by [%s]", workSubDir, holder)
+				}
+				continue
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return nil, errors.New("timed out waiting for lock")
+		}
+
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// touches a held lock every interval until it is released, as long as it is still ours
+func refreshClaimLock(lockFile, token string, interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+
+		case <-ticker.C:
+			if holder, err := os.ReadFile(lockFile); err != nil || string(holder) != token {
+				log.Printf("WARNING: lost lock [%s] while holding it", lockFile)
+				return
+			}
+
+			now := time.Now()
+			os.Chtimes(lockFile, now, now)
+		}
+	}
+}
+
+// removes a lock, but only if it still holds the given token.  the lock is first
+// renamed aside, which only one process can do, so that a lock taken by someone else
+// in the meantime is never removed by mistake; one that turns out not to be the
+// expected lock is put back.  returns true if the lock was removed.
+func removeClaimLock(lockFile, token string) bool {
+	aside := fmt.Sprintf("%s.%s-%d", lockFile, instanceID, claimLockCount.Add(1))
+
+	if err := os.Rename(lockFile, aside); err != nil {
+		return false
+	}
+	defer os.Remove(aside)
+
+	if holder, err := os.ReadFile(aside); err == nil && string(holder) == token {
+		return true
+	}
+
+	// linking fails rather than replace a lock taken since it was moved aside
+	if err := os.Link(aside, lockFile); err != nil {
+		log.Printf("WARNING: unable to restore lock [%s]: %s", lockFile, err.Error())
+	}
+
+	return false
+}
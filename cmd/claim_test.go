@@ -0,0 +1,327 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// points the service at a fresh storage directory for claim locks
+func setupClaimTest(t *testing.T) {
+	config.storageDir.value = t.TempDir()
+	initInstanceID()
+
+	if err := os.MkdirAll(config.storageDir.value+"/.locks", 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// returns the contents of a lock file, or "" if there is none
+func lockHolder(lockFile string) string {
+	holder, _ := os.ReadFile(lockFile)
+	return string(holder)
+}
+
+// waits for a lock in a goroutine, returning a channel that yields its unlock function
+func lockInBackground(t *testing.T, workSubDir string) chan func() {
+	acquired := make(chan func(), 1)
+
+	go func() {
+		unlock, err := lockWorkSubDir(workSubDir)
+		if err != nil {
+			t.Error(err)
+			close(acquired)
+			return
+		}
+		acquired <- unlock
+	}()
+
+	return acquired
+}
+
+// only one holder at a time, whether the lock is held by this instance or another one
+func TestClaimLockContention(t *testing.T) {
+	setupClaimTest(t)
+
+	unlock, err := lockWorkSubDir("book1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lockFile := claimLockFile("book1")
+	ours := lockHolder(lockFile)
+
+	acquired := lockInBackground(t, "book1")
+
+	select {
+	case <-acquired:
+		t.Fatalf("lock taken while held")
+	case <-time.After(600 * time.Millisecond):
+	}
+
+	// other work directories are unaffected
+	other, err := lockWorkSubDir("book1/unit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other()
+
+	unlock()
+
+	select {
+	case unlock := <-acquired:
+		if holder := lockHolder(lockFile); holder == "" || holder == ours {
+			t.Errorf("released lock taken with holder [%s]", holder)
+		}
+		unlock()
+	case <-time.After(5 * time.Second):
+		t.Fatalf("lock not taken after release")
+	}
+
+	// a fresh lock held by another instance is waited on, not broken
+	os.WriteFile(lockFile, []byte("elsewhere:1-abc 1"), 0644)
+
+	acquired = lockInBackground(t, "book1")
+
+	select {
+	case <-acquired:
+		t.Fatalf("lock held by another instance taken")
+	case <-time.After(600 * time.Millisecond):
+	}
+
+	os.Remove(lockFile)
+
+	select {
+	case unlock := <-acquired:
+		unlock()
+	case <-time.After(5 * time.Second):
+		t.Fatalf("lock not taken after release by another instance")
+	}
+
+	if _, err := os.Stat(lockFile); os.IsNotExist(err) == false {
+		t.Errorf("lock file left behind after release")
+	}
+}
+
+func TestClaimLockConcurrentHolders(t *testing.T) {
+	setupClaimTest(t)
+
+	var wg sync.WaitGroup
+	var holders, most atomic.Int32
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			unlock, err := lockWorkSubDir("book1")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			n := holders.Add(1)
+			if n > most.Load() {
+				most.Store(n)
+			}
+			time.Sleep(20 * time.Millisecond)
+			holders.Add(-1)
+
+			unlock()
+		}()
+	}
+
+	wg.Wait()
+
+	if n := most.Load(); n != 1 {
+		t.Errorf("lock held by %d callers at once", n)
+	}
+}
+
+// a lock that has not been touched for too long was left by a process that died
+func TestClaimLockStaleTakeover(t *testing.T) {
+	setupClaimTest(t)
+
+	lockFile := claimLockFile("book1")
+	os.WriteFile(lockFile, []byte("elsewhere:1-abc 1"), 0644)
+
+	old := time.Now().Add(-2 * claimLockTimeout)
+	os.Chtimes(lockFile, old, old)
+
+	acquired := lockInBackground(t, "book1")
+
+	select {
+	case unlock := <-acquired:
+		if holder := lockHolder(lockFile); holder == "elsewhere:1-abc 1" {
+			t.Errorf("stale lock still in place after takeover")
+		}
+		unlock()
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stale lock not taken over")
+	}
+}
+
+// a held lock is kept fresh, but only for as long as it is still ours
+func TestClaimLockRefresh(t *testing.T) {
+	setupClaimTest(t)
+
+	lockFile := claimLockFile("book1")
+	os.WriteFile(lockFile, []byte("ours 1"), 0644)
+
+	old := time.Now().Add(-2 * claimLockTimeout)
+	os.Chtimes(lockFile, old, old)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		refreshClaimLock(lockFile, "ours 1", 20*time.Millisecond, stop)
+		close(done)
+	}()
+	defer close(stop)
+
+	time.Sleep(200 * time.Millisecond)
+
+	if fi, err := os.Stat(lockFile); err != nil || time.Since(fi.ModTime()) > claimLockTimeout {
+		t.Fatalf("held lock not refreshed")
+	}
+
+	// once taken over, the lock is left for its new holder to refresh
+	os.WriteFile(lockFile, []byte("elsewhere:1-abc 1"), 0644)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("still refreshing a lock that was lost")
+	}
+}
+
+func TestRemoveClaimLockByNonOwner(t *testing.T) {
+	setupClaimTest(t)
+
+	lockFile := claimLockFile("book1")
+	os.WriteFile(lockFile, []byte("elsewhere:1-abc 1"), 0644)
+
+	if removeClaimLock(lockFile, "elsewhere:1-abc 2") == true {
+		t.Errorf("lock removed with the wrong token")
+	}
+
+	if holder := lockHolder(lockFile); holder != "elsewhere:1-abc 1" {
+		t.Errorf("lock holder is [%s] after removal by a non-owner", holder)
+	}
+
+	if matches, _ := filepath.Glob(lockFile + ".*"); len(matches) > 0 {
+		t.Errorf("lock left aside: %v", matches)
+	}
+
+	if removeClaimLock(lockFile, "elsewhere:1-abc 1") == false {
+		t.Errorf("lock not removed by its owner")
+	}
+
+	if _, err := os.Stat(lockFile); os.IsNotExist(err) == false {
+		t.Errorf("lock still present after removal by its owner")
+	}
+
+	if removeClaimLock(lockFile, "elsewhere:1-abc 1") == true {
+		t.Errorf("missing lock reported as removed")
+	}
+}
+
+// a holder whose lock was broken and taken by someone else must not release the new one
+func TestClaimLockReleaseAfterTakeover(t *testing.T) {
+	setupClaimTest(t)
+
+	unlock, err := lockWorkSubDir("book1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lockFile := claimLockFile("book1")
+	os.Remove(lockFile)
+	os.WriteFile(lockFile, []byte("elsewhere:1-abc 1"), 0644)
+
+	unlock()
+
+	if holder := lockHolder(lockFile); holder != "elsewhere:1-abc 1" {
+		t.Errorf("lock holder is [%s] after release by its previous holder", holder)
+	}
+}
+
+// concurrent claims for the same work directory share a single call and its result
+func TestClaimsDoSharesCall(t *testing.T) {
+	setupClaimTest(t)
+
+	var calls atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	claim := func(reqID string) claimResult {
+		c := &clientContext{reqID: reqID, ip: "-"}
+		c.pdf.workSubDir = "book1"
+
+		return claims.do(c, func() claimResult {
+			if c.claimed == false {
+				t.Errorf("%s: call made without the claim", reqID)
+			}
+
+			if lockHolder(claimLockFile("book1")) == "" {
+				t.Errorf("%s: call made without the lock", reqID)
+			}
+
+			if calls.Add(1) == 1 {
+				close(started)
+			}
+			<-release
+
+			return claimResult{status: 200, msg: reqID}
+		})
+	}
+
+	results := make([]claimResult, 4)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[0] = claim("leader")
+	}()
+
+	<-started
+
+	for i := 1; i < len(results); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = claim("follower")
+		}(i)
+	}
+
+	// give the followers time to attach before the call finishes
+	time.Sleep(200 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("made %d calls, want 1", n)
+	}
+
+	for i, res := range results {
+		if res.status != 200 || res.msg != "leader" {
+			t.Errorf("caller %d: got %+v, want the leader's result", i, res)
+		}
+	}
+
+	if _, err := os.Stat(claimLockFile("book1")); os.IsNotExist(err) == false {
+		t.Errorf("lock still held after the call")
+	}
+
+	// the result is not kept once the call is over
+	release = make(chan struct{})
+	close(release)
+
+	if res := claim("later"); res.msg != "later" || calls.Load() != 2 {
+		t.Errorf("later claim got %+v after %d calls, want its own result", res, calls.Load())
+	}
+}
@@ -1,20 +1,27 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 type pdfRequest struct {
-	pid   string
-	unit  string
-	pages string
-	token string
-	embed string
+	pid      string
+	unit     string
+	pages    string
+	token    string
+	embed    string
+	cover    string // cover page position: front, back, or none
+	format   string // output format: pdf or pdfa
+	ocr      string // add a text layer: "1" or "0"; if blank, depends on the collection
+	callback string // url to notify when the pdf is ready or has failed
 }
 
 type pdfInfo struct {
@@ -24,6 +31,10 @@ type pdfInfo struct {
 	workSubDir string
 	workDir    string
 	embed      bool
+	progress   jobProgress // current stage of generation
+	merge      *mergeInfo  // per-pid lookups, when combining several pids into one pdf
+	saved      jobProgress // progress as last written to the job state
+	savedAt    time.Time   // when it was written
 }
 
 type clientContext struct {
@@ -32,6 +43,9 @@ type clientContext struct {
 	ip    string     // client ip address
 	req   pdfRequest // values from original request
 	pdf   pdfInfo    // values derived while processing request
+
+	claimed bool            // true while holding the claim lock on the work directory
+	jobCtx  context.Context // cancelled when the running job is cancelled or deleted
 }
 
 func newClientContext(ctx *gin.Context) *clientContext {
@@ -42,7 +56,7 @@ func newClientContext(ctx *gin.Context) *clientContext {
 
 func (c *clientContext) init(ctx *gin.Context) {
 	c.ctx = ctx
-	c.reqID = fmt.Sprintf("%08x", randomSource.Uint32())
+	c.reqID = randomHex(4)
 	c.ip = c.ctx.ClientIP()
 
 	c.req.pid = c.ctx.Param("pid")
@@ -50,10 +64,12 @@ func (c *clientContext) init(ctx *gin.Context) {
 	c.req.pages = c.ctx.Query("pages")
 	c.req.token = c.ctx.Query("token")
 	c.req.embed = c.ctx.Query("embed")
+	c.req.cover = c.ctx.DefaultQuery("cover", config.coverPosition.value)
+	c.req.format = c.ctx.DefaultQuery("format", config.pdfFormat.value)
+	c.req.ocr = c.ctx.Query("ocr")
+	c.req.callback = c.ctx.Query("callback")
 
-	c.pdf.subDir = c.req.pid
-	c.pdf.workSubDir = getWorkSubDir(c.pdf.subDir, c.req.unit, c.req.token)
-	c.pdf.workDir = fmt.Sprintf("%s/%s", config.storageDir.value, c.pdf.workSubDir)
+	c.initPdfInfo()
 
 	c.pdf.embed = true
 	if len(c.req.embed) == 0 || c.req.embed == "0" {
@@ -63,6 +79,79 @@ func (c *clientContext) init(ctx *gin.Context) {
 	c.logRequest()
 }
 
+// creates a context for running a queued job outside of any http request
+func newJobContext(job *pdfJob) *clientContext {
+	c := clientContext{}
+
+	c.reqID = job.ReqID
+	c.ip = job.IP
+
+	c.req.pid = job.Pid
+	c.req.unit = job.Unit
+	c.req.pages = job.Pages
+	c.req.token = job.Token
+	c.req.cover = job.Cover
+	c.req.format = job.Format
+	c.req.ocr = job.Ocr
+
+	// jobs queued by older versions did not record these options
+	if c.req.cover == "" {
+		c.req.cover = config.coverPosition.value
+	}
+
+	if c.req.format == "" {
+		c.req.format = config.pdfFormat.value
+	}
+
+	c.pdf.subDir = c.req.pid
+	c.pdf.workSubDir = job.WorkSubDir
+	c.pdf.workDir = getWorkDir(c.pdf.workSubDir)
+
+	c.pdf.ts = job.ts
+	c.pdf.solr = job.solr
+	c.pdf.merge = job.merge
+
+	c.jobCtx = job.ctx
+
+	return &c
+}
+
+func (c *clientContext) initPdfInfo() {
+	c.pdf.subDir = c.req.pid
+	c.pdf.workSubDir = getWorkSubDir(c.pdf.subDir, c.req.unit, c.req.token)
+
+	// requests for non-default output get their own work directory, unless
+	// the caller is already keeping them apart with a token
+	if variant := c.req.variant(); variant != "" && c.req.token == "" {
+		c.pdf.workSubDir = fmt.Sprintf("%s-%s", c.pdf.workSubDir, variant)
+	}
+
+	c.pdf.workDir = getWorkDir(c.pdf.workSubDir)
+}
+
+// describes any requested options that differ from the configured defaults
+func (r *pdfRequest) variant() string {
+	var parts []string
+
+	if r.cover != config.coverPosition.value {
+		parts = append(parts, fmt.Sprintf("cover-%s", r.cover))
+	}
+
+	if r.format != config.pdfFormat.value {
+		parts = append(parts, fmt.Sprintf("format-%s", r.format))
+	}
+
+	// pdfs generated without an explicit choice depend on the collection
+	switch r.ocr {
+	case "1":
+		parts = append(parts, "ocr")
+	case "0":
+		parts = append(parts, "noocr")
+	}
+
+	return strings.Join(parts, "-")
+}
+
 func (c *clientContext) log(format string, args ...interface{}) {
 	parts := []string{
 		fmt.Sprintf("[ip:%s]", c.ip),
@@ -112,7 +201,9 @@ func (c *clientContext) respondData(code int, contentType string, data []byte) {
 	c.ctx.Data(code, contentType, data)
 }
 
-func (c *clientContext) respondDataFromReader(code int, contentLength int64, contentType string, reader io.Reader, extraHeaders map[string]string) {
-	c.logResponse(code, contentType)
-	c.ctx.DataFromReader(code, contentLength, contentType, reader, extraHeaders)
+// serves content with support for range, conditional and HEAD requests.  any
+// validators (ETag, etc.) and content headers should be set beforehand.
+func (c *clientContext) respondContent(name string, modified time.Time, content io.ReadSeeker) {
+	http.ServeContent(c.ctx.Writer, c.ctx.Request, name, modified, content)
+	c.logResponse(c.ctx.Writer.Status(), c.ctx.Writer.Header().Get("Content-Type"))
 }
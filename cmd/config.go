@@ -4,6 +4,7 @@ import (
 	"flag"
 	"log"
 	"os"
+	"strconv"
 )
 
 type configItem struct {
@@ -17,6 +18,11 @@ type configStringItem struct {
 	configItem
 }
 
+type configIntItem struct {
+	value int
+	configItem
+}
+
 type configData struct {
 	listenPort       configStringItem
 	tsAPIHost        configStringItem
@@ -28,6 +34,37 @@ type configData struct {
 	solrURLTemplate  configStringItem
 	virgoURLTemplate configStringItem
 	pdfChunkSize     configStringItem
+	pdfGenerator     configStringItem
+	coverPosition    configStringItem
+	workerCount      configIntItem
+	staleJobSeconds  configIntItem
+	maxJobAttempts   configIntItem
+	downloadWorkers  configIntItem
+	hostConcurrency  configStringItem
+	pdfFormat        configStringItem
+	pdfaFont         configStringItem
+	pdfaValidator    configStringItem
+	ocrCommand       configStringItem
+	ocrLanguage      configStringItem
+	ocrCollections   configStringItem
+	ocrField         configStringItem
+	ocrWorkers       configIntItem
+	webhookSecret    configStringItem
+	webhookAttempts  configIntItem
+	webhookAllow     configStringItem
+	storageBackend   configStringItem
+	s3Endpoint       configStringItem
+	s3Region         configStringItem
+	s3Bucket         configStringItem
+	s3Prefix         configStringItem
+	s3AccessKey      configStringItem
+	s3SecretKey      configStringItem
+	s3Downloads      configStringItem
+	s3URLExpiry      configIntItem
+	cacheMaxAge      configIntItem
+	cacheQuota       configIntItem
+	janitorInterval  configIntItem
+	contentCheck     configIntItem
 }
 
 var config configData
@@ -43,6 +80,37 @@ func init() {
 	config.solrURLTemplate = configStringItem{value: "", configItem: configItem{flag: "s", env: "PDFWS_SOLR_URL_TEMPLATE", desc: "solr url template"}}
 	config.virgoURLTemplate = configStringItem{value: "", configItem: configItem{flag: "v", env: "PDFWS_VIRGO_URL_TEMPLATE", desc: "virgo url template"}}
 	config.pdfChunkSize = configStringItem{value: "", configItem: configItem{flag: "c", env: "PDFWS_PDF_CHUNK_SIZE", desc: "pdf chunk size"}}
+	config.pdfGenerator = configStringItem{value: "", configItem: configItem{flag: "g", env: "PDFWS_PDF_GENERATOR", desc: "pdf generator (native or script)"}}
+	config.coverPosition = configStringItem{value: "", configItem: configItem{flag: "p", env: "PDFWS_COVER_POSITION", desc: "default cover page position (front, back, or none)"}}
+	config.workerCount = configIntItem{value: 2, configItem: configItem{flag: "workers", env: "PDFWS_WORKER_COUNT", desc: "number of concurrent pdf generation workers"}}
+	config.staleJobSeconds = configIntItem{value: 300, configItem: configItem{flag: "stale", env: "PDFWS_STALE_JOB_SECONDS", desc: "seconds without a heartbeat before a job is considered abandoned"}}
+	config.maxJobAttempts = configIntItem{value: 3, configItem: configItem{flag: "attempts", env: "PDFWS_MAX_JOB_ATTEMPTS", desc: "number of times an abandoned job is requeued before it is failed"}}
+	config.downloadWorkers = configIntItem{value: 4, configItem: configItem{flag: "downloads", env: "PDFWS_DOWNLOAD_WORKERS", desc: "number of concurrent page downloads per job"}}
+	config.hostConcurrency = configStringItem{value: "", configItem: configItem{flag: "hostlimits", env: "PDFWS_HOST_CONCURRENCY", desc: "max concurrent downloads per host across all jobs (host=n,...)"}}
+	config.pdfFormat = configStringItem{value: "", configItem: configItem{flag: "f", env: "PDFWS_PDF_FORMAT", desc: "default pdf format (pdf or pdfa)"}}
+	config.pdfaFont = configStringItem{value: "", configItem: configItem{flag: "font", env: "PDFWS_PDFA_FONT", desc: "truetype font embedded in PDF/A cover pages"}}
+	config.pdfaValidator = configStringItem{value: "", configItem: configItem{flag: "validator", env: "PDFWS_PDFA_VALIDATOR", desc: "external PDF/A validation command (e.g. verapdf); without one, PDF/A output is only sanity checked"}}
+	config.ocrCommand = configStringItem{value: "", configItem: configItem{flag: "ocr", env: "PDFWS_OCR_COMMAND", desc: "ocr command (tesseract or compatible)"}}
+	config.ocrLanguage = configStringItem{value: "", configItem: configItem{flag: "ocrlang", env: "PDFWS_OCR_LANGUAGE", desc: "ocr language(s), e.g. eng or eng+fra"}}
+	config.ocrCollections = configStringItem{value: "", configItem: configItem{flag: "ocrcollections", env: "PDFWS_OCR_COLLECTIONS", desc: "collections to ocr by default (name,...)"}}
+	config.ocrField = configStringItem{value: "", configItem: configItem{flag: "ocrfield", env: "PDFWS_OCR_COLLECTION_FIELD", desc: "solr field holding the collections matched against the ocr collections"}}
+	config.ocrWorkers = configIntItem{value: 2, configItem: configItem{flag: "ocrworkers", env: "PDFWS_OCR_WORKERS", desc: "number of pages to ocr at once per job"}}
+	config.webhookSecret = configStringItem{value: "", configItem: configItem{flag: "webhooksecret", env: "PDFWS_WEBHOOK_SECRET", desc: "shared secret used to sign completion callbacks (callbacks are disabled if unset)"}}
+	config.webhookAttempts = configIntItem{value: 8, configItem: configItem{flag: "webhookattempts", env: "PDFWS_WEBHOOK_ATTEMPTS", desc: "number of times a completion callback is attempted before giving up"}}
+	config.webhookAllow = configStringItem{value: "", configItem: configItem{flag: "webhookallow", env: "PDFWS_WEBHOOK_ALLOW", desc: "hosts or url prefixes completion callbacks may be sent to (host,https://host/path,...); if unset, any public host"}}
+	config.storageBackend = configStringItem{value: "", configItem: configItem{flag: "storage", env: "PDFWS_STORAGE_BACKEND", desc: "where finished pdfs are stored (local or s3)"}}
+	config.s3Endpoint = configStringItem{value: "", configItem: configItem{flag: "s3endpoint", env: "PDFWS_S3_ENDPOINT", desc: "s3-compatible endpoint url (blank for AWS)"}}
+	config.s3Region = configStringItem{value: "", configItem: configItem{flag: "s3region", env: "PDFWS_S3_REGION", desc: "s3 region"}}
+	config.s3Bucket = configStringItem{value: "", configItem: configItem{flag: "s3bucket", env: "PDFWS_S3_BUCKET", desc: "s3 bucket for finished pdfs"}}
+	config.s3Prefix = configStringItem{value: "", configItem: configItem{flag: "s3prefix", env: "PDFWS_S3_PREFIX", desc: "s3 key prefix for finished pdfs"}}
+	config.s3AccessKey = configStringItem{value: "", configItem: configItem{flag: "s3accesskey", env: "PDFWS_S3_ACCESS_KEY", desc: "s3 access key id"}}
+	config.s3SecretKey = configStringItem{value: "", configItem: configItem{flag: "s3secretkey", env: "PDFWS_S3_SECRET_KEY", desc: "s3 secret access key"}}
+	config.s3Downloads = configStringItem{value: "", configItem: configItem{flag: "s3downloads", env: "PDFWS_S3_DOWNLOADS", desc: "how pdfs in s3 are downloaded (redirect to a presigned url, or stream)"}}
+	config.s3URLExpiry = configIntItem{value: 900, configItem: configItem{flag: "s3urlexpiry", env: "PDFWS_S3_URL_EXPIRY", desc: "lifetime of presigned s3 download urls, in seconds"}}
+	config.cacheMaxAge = configIntItem{value: 0, configItem: configItem{flag: "cachemaxage", env: "PDFWS_CACHE_MAX_AGE", desc: "hours a finished pdf is kept after it was last used (0 to keep indefinitely)"}}
+	config.cacheQuota = configIntItem{value: 0, configItem: configItem{flag: "cachequota", env: "PDFWS_CACHE_QUOTA_MB", desc: "storage directory size limit in megabytes, enforced by removing the least recently used pdfs (0 for no limit)"}}
+	config.janitorInterval = configIntItem{value: 900, configItem: configItem{flag: "janitorinterval", env: "PDFWS_JANITOR_INTERVAL", desc: "seconds between cache cleanup runs"}}
+	config.contentCheck = configIntItem{value: 300, configItem: configItem{flag: "contentcheck", env: "PDFWS_CONTENT_CHECK_INTERVAL", desc: "seconds between checks of a finished pdf's tracksys and solr content for changes (0 to check on every request)"}}
 }
 
 func ensureConfigStringSet(item *configStringItem) bool {
@@ -56,10 +124,46 @@ func ensureConfigStringSet(item *configStringItem) bool {
 	return isSet
 }
 
+func ensureConfigIntPositive(item *configIntItem) bool {
+	isSet := true
+
+	if item.value < 1 {
+		isSet = false
+		log.Printf("[ERROR] %s must be at least 1, use %s variable or -%s flag", item.desc, item.env, item.flag)
+	}
+
+	return isSet
+}
+
+func ensureConfigIntNotNegative(item *configIntItem) bool {
+	isSet := true
+
+	if item.value < 0 {
+		isSet = false
+		log.Printf("[ERROR] %s must not be negative, use %s variable or -%s flag", item.desc, item.env, item.flag)
+	}
+
+	return isSet
+}
+
 func flagStringVar(item *configStringItem) {
 	flag.StringVar(&item.value, item.flag, os.Getenv(item.env), item.desc)
 }
 
+func flagIntVar(item *configIntItem) {
+	// the initial value acts as the default when neither flag nor environment variable is set
+	def := item.value
+	if env := os.Getenv(item.env); env != "" {
+		if val, err := strconv.Atoi(env); err == nil {
+			def = val
+		} else {
+			log.Printf("[WARNING] ignoring invalid %s value: [%s]", item.env, env)
+		}
+	}
+
+	flag.IntVar(&item.value, item.flag, def, item.desc)
+}
+
 func getConfigValues() {
 	// get values from the command line first, falling back to environment variables
 	flagStringVar(&config.listenPort)
@@ -72,6 +176,37 @@ func getConfigValues() {
 	flagStringVar(&config.solrURLTemplate)
 	flagStringVar(&config.virgoURLTemplate)
 	flagStringVar(&config.pdfChunkSize)
+	flagStringVar(&config.pdfGenerator)
+	flagStringVar(&config.coverPosition)
+	flagIntVar(&config.workerCount)
+	flagIntVar(&config.staleJobSeconds)
+	flagIntVar(&config.maxJobAttempts)
+	flagIntVar(&config.downloadWorkers)
+	flagStringVar(&config.hostConcurrency)
+	flagStringVar(&config.pdfFormat)
+	flagStringVar(&config.pdfaFont)
+	flagStringVar(&config.pdfaValidator)
+	flagStringVar(&config.ocrCommand)
+	flagStringVar(&config.ocrLanguage)
+	flagStringVar(&config.ocrCollections)
+	flagStringVar(&config.ocrField)
+	flagIntVar(&config.ocrWorkers)
+	flagStringVar(&config.webhookSecret)
+	flagIntVar(&config.webhookAttempts)
+	flagStringVar(&config.webhookAllow)
+	flagStringVar(&config.storageBackend)
+	flagStringVar(&config.s3Endpoint)
+	flagStringVar(&config.s3Region)
+	flagStringVar(&config.s3Bucket)
+	flagStringVar(&config.s3Prefix)
+	flagStringVar(&config.s3AccessKey)
+	flagStringVar(&config.s3SecretKey)
+	flagStringVar(&config.s3Downloads)
+	flagIntVar(&config.s3URLExpiry)
+	flagIntVar(&config.cacheMaxAge)
+	flagIntVar(&config.cacheQuota)
+	flagIntVar(&config.janitorInterval)
+	flagIntVar(&config.contentCheck)
 
 	flag.Parse()
 
@@ -80,13 +215,117 @@ func getConfigValues() {
 	configOK := true
 	configOK = ensureConfigStringSet(&config.listenPort) && configOK
 	configOK = ensureConfigStringSet(&config.storageDir) && configOK
-	configOK = ensureConfigStringSet(&config.scriptDir) && configOK
 	configOK = ensureConfigStringSet(&config.assetsDir) && configOK
 	configOK = ensureConfigStringSet(&config.templateDir) && configOK
 	configOK = ensureConfigStringSet(&config.iiifURLTemplate) && configOK
 	configOK = ensureConfigStringSet(&config.solrURLTemplate) && configOK
 	configOK = ensureConfigStringSet(&config.virgoURLTemplate) && configOK
-	configOK = ensureConfigStringSet(&config.pdfChunkSize) && configOK
+
+	// the helper script settings only matter when using it to build the pdf
+	if config.pdfGenerator.value == "" {
+		config.pdfGenerator.value = "native"
+	}
+
+	switch config.pdfGenerator.value {
+	case "native":
+		// everything is handled in-process
+
+	case "script":
+		configOK = ensureConfigStringSet(&config.scriptDir) && configOK
+		configOK = ensureConfigStringSet(&config.pdfChunkSize) && configOK
+
+	default:
+		log.Printf("[ERROR] unknown %s: [%s], use %s variable or -%s flag", config.pdfGenerator.desc, config.pdfGenerator.value, config.pdfGenerator.env, config.pdfGenerator.flag)
+		configOK = false
+	}
+
+	if config.coverPosition.value == "" {
+		config.coverPosition.value = "front"
+	}
+
+	if isValidCoverPosition(config.coverPosition.value) == false {
+		log.Printf("[ERROR] unknown %s: [%s], use %s variable or -%s flag", config.coverPosition.desc, config.coverPosition.value, config.coverPosition.env, config.coverPosition.flag)
+		configOK = false
+	}
+
+	if config.pdfFormat.value == "" {
+		config.pdfFormat.value = "pdf"
+	}
+
+	if isValidPdfFormat(config.pdfFormat.value) == false {
+		log.Printf("[ERROR] unknown %s: [%s], use %s variable or -%s flag", config.pdfFormat.desc, config.pdfFormat.value, config.pdfFormat.env, config.pdfFormat.flag)
+		configOK = false
+	}
+
+	// PDF/A output is only produced by the native generator
+	if config.pdfFormat.value == "pdfa" && config.pdfGenerator.value != "native" {
+		log.Printf("[ERROR] %s [pdfa] requires the native pdf generator", config.pdfFormat.desc)
+		configOK = false
+	}
+
+	if config.pdfaFont.value == "" {
+		config.pdfaFont.value = "/usr/share/fonts/dejavu/DejaVuSans.ttf"
+	}
+
+	if config.ocrCommand.value == "" {
+		config.ocrCommand.value = "tesseract"
+	}
+
+	if config.ocrLanguage.value == "" {
+		config.ocrLanguage.value = "eng"
+	}
+
+	if config.ocrField.value == "" {
+		config.ocrField.value = "collection_a"
+	}
+
+	configOK = ensureConfigIntPositive(&config.workerCount) && configOK
+	configOK = ensureConfigIntPositive(&config.staleJobSeconds) && configOK
+	configOK = ensureConfigIntPositive(&config.maxJobAttempts) && configOK
+	configOK = ensureConfigIntPositive(&config.downloadWorkers) && configOK
+	configOK = ensureConfigIntPositive(&config.ocrWorkers) && configOK
+	configOK = ensureConfigIntPositive(&config.webhookAttempts) && configOK
+
+	if config.storageBackend.value == "" {
+		config.storageBackend.value = "local"
+	}
+
+	switch config.storageBackend.value {
+	case "local":
+		// pdfs stay in their work directories
+
+	case "s3":
+		configOK = ensureConfigStringSet(&config.s3Bucket) && configOK
+
+	default:
+		log.Printf("[ERROR] unknown %s: [%s], use %s variable or -%s flag", config.storageBackend.desc, config.storageBackend.value, config.storageBackend.env, config.storageBackend.flag)
+		configOK = false
+	}
+
+	// s3 settings are also needed to serve pdfs stored there before switching back to local storage
+	if config.s3Bucket.value != "" {
+		configOK = ensureConfigStringSet(&config.s3AccessKey) && configOK
+		configOK = ensureConfigStringSet(&config.s3SecretKey) && configOK
+		configOK = ensureConfigIntPositive(&config.s3URLExpiry) && configOK
+	}
+
+	configOK = ensureConfigIntNotNegative(&config.cacheMaxAge) && configOK
+	configOK = ensureConfigIntNotNegative(&config.cacheQuota) && configOK
+	configOK = ensureConfigIntPositive(&config.janitorInterval) && configOK
+	configOK = ensureConfigIntNotNegative(&config.contentCheck) && configOK
+
+	if config.s3Region.value == "" {
+		config.s3Region.value = "us-east-1"
+	}
+
+	if config.s3Downloads.value == "" {
+		config.s3Downloads.value = "redirect"
+	}
+
+	if config.s3Downloads.value != "redirect" && config.s3Downloads.value != "stream" {
+		log.Printf("[ERROR] unknown %s: [%s], use %s variable or -%s flag", config.s3Downloads.desc, config.s3Downloads.value, config.s3Downloads.env, config.s3Downloads.flag)
+		configOK = false
+	}
 
 	if configOK == false {
 		flag.Usage()
@@ -103,4 +342,48 @@ func getConfigValues() {
 	log.Printf("[CONFIG] solrURLTemplate  = [%s]", config.solrURLTemplate.value)
 	log.Printf("[CONFIG] virgoURLTemplate = [%s]", config.virgoURLTemplate.value)
 	log.Printf("[CONFIG] pdfChunkSize     = [%s]", config.pdfChunkSize.value)
+	log.Printf("[CONFIG] pdfGenerator     = [%s]", config.pdfGenerator.value)
+	log.Printf("[CONFIG] coverPosition    = [%s]", config.coverPosition.value)
+	log.Printf("[CONFIG] workerCount      = [%d]", config.workerCount.value)
+	log.Printf("[CONFIG] staleJobSeconds  = [%d]", config.staleJobSeconds.value)
+	log.Printf("[CONFIG] maxJobAttempts   = [%d]", config.maxJobAttempts.value)
+	log.Printf("[CONFIG] downloadWorkers  = [%d]", config.downloadWorkers.value)
+	log.Printf("[CONFIG] hostConcurrency  = [%s]", config.hostConcurrency.value)
+	log.Printf("[CONFIG] pdfFormat        = [%s]", config.pdfFormat.value)
+	log.Printf("[CONFIG] pdfaFont         = [%s]", config.pdfaFont.value)
+	log.Printf("[CONFIG] pdfaValidator    = [%s]", config.pdfaValidator.value)
+
+	if config.pdfaValidator.value == "" {
+		log.Printf("[CONFIG] no PDF/A validator configured; PDF/A output is only sanity checked, not validated")
+	}
+	log.Printf("[CONFIG] ocrCommand       = [%s]", config.ocrCommand.value)
+	log.Printf("[CONFIG] ocrLanguage      = [%s]", config.ocrLanguage.value)
+	log.Printf("[CONFIG] ocrCollections   = [%s]", config.ocrCollections.value)
+	log.Printf("[CONFIG] ocrField         = [%s]", config.ocrField.value)
+	log.Printf("[CONFIG] ocrWorkers       = [%d]", config.ocrWorkers.value)
+	log.Printf("[CONFIG] webhookSecret    = [%s]", maskSecret(config.webhookSecret.value))
+	log.Printf("[CONFIG] webhookAttempts  = [%d]", config.webhookAttempts.value)
+	log.Printf("[CONFIG] webhookAllow     = [%s]", config.webhookAllow.value)
+	log.Printf("[CONFIG] storageBackend   = [%s]", config.storageBackend.value)
+	log.Printf("[CONFIG] s3Endpoint       = [%s]", config.s3Endpoint.value)
+	log.Printf("[CONFIG] s3Region         = [%s]", config.s3Region.value)
+	log.Printf("[CONFIG] s3Bucket         = [%s]", config.s3Bucket.value)
+	log.Printf("[CONFIG] s3Prefix         = [%s]", config.s3Prefix.value)
+	log.Printf("[CONFIG] s3AccessKey      = [%s]", config.s3AccessKey.value)
+	log.Printf("[CONFIG] s3SecretKey      = [%s]", maskSecret(config.s3SecretKey.value))
+	log.Printf("[CONFIG] s3Downloads      = [%s]", config.s3Downloads.value)
+	log.Printf("[CONFIG] s3URLExpiry      = [%d]", config.s3URLExpiry.value)
+	log.Printf("[CONFIG] cacheMaxAge      = [%d]", config.cacheMaxAge.value)
+	log.Printf("[CONFIG] cacheQuota       = [%d]", config.cacheQuota.value)
+	log.Printf("[CONFIG] janitorInterval  = [%d]", config.janitorInterval.value)
+	log.Printf("[CONFIG] contentCheck     = [%d]", config.contentCheck.value)
+}
+
+// avoids logging secrets, while still showing whether they are set
+func maskSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+
+	return "********"
 }
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image/png"
+	"os"
+	"strings"
+	"time"
+)
+
+// the content of the copyright/citation cover page
+type coverPage struct {
+	header string
+	logo   string // path to logo image file
+	title  string
+	author string
+	footer string
+}
+
+// cover page layout, in points; these mirror the 300 DPI pixel measurements
+// used by the helper script (e.g. 250 pixel margins = 60 points)
+const (
+	coverWidth        = 612.0 // 8.5"
+	coverHeight       = 792.0 // 11"
+	coverMargin       = 60.0
+	coverTopMargin    = 90.0
+	coverBottomMargin = 30.0
+	coverGap          = 60.0
+	coverFontSize     = 12.0
+	coverTitleSize    = 18.0
+	coverLineSpacing  = 1.2
+	coverPixelScale   = 72.0 / 300.0 // logo images are placed at 300 DPI
+)
+
+func isValidCoverPosition(pos string) bool {
+	switch pos {
+	case "front", "back", "none":
+		return true
+	}
+
+	return false
+}
+
+// values made available to cover page templates
+type coverData struct {
+	Pid       string
+	ID        string // catalog id
+	Title     string
+	Author    string
+	Year      string
+	Rights    string // rights statement, cleaned up for display
+	VirgoURL  string
+	Citation  string
+	Generated string // generation date
+	doc       *solrDoc
+}
+
+// returns the first value of any solr field, e.g. {{ .Field "location_a" }}
+func (d coverData) Field(name string) string {
+	return firstElementOf(d.doc.fieldValues(name))
+}
+
+// chooses which template to use for a record, based on the first matching rule
+func (c *clientContext) selectCoverTemplate(cfg *coverConfig, doc *solrDoc) string {
+	for _, rule := range cfg.Rules {
+		for _, value := range doc.fieldValues(rule.Field) {
+			// a rule without a value uses the field value itself as the template name
+			if rule.Value == "" {
+				if name := coverTemplateName(value); coverTemplateExists(name) == true {
+					c.info("cover template [%s] selected by %s = [%s]", name, rule.Field, value)
+					return name
+				}
+				continue
+			}
+
+			if strings.EqualFold(value, rule.Value) == true {
+				c.info("cover template [%s] selected by %s = [%s]", rule.Template, rule.Field, value)
+				return rule.Template
+			}
+		}
+	}
+
+	return cfg.Default
+}
+
+func (c *clientContext) getCoverPage() *coverPage {
+	if c.pdf.merge != nil {
+		return c.getMergedCoverPage()
+	}
+
+	if c.pdf.solr == nil || c.req.cover == "none" {
+		return nil
+	}
+
+	doc := c.pdf.solr.Response.Docs[0]
+
+	return c.renderCoverPage(&doc, c.getCoverData(&doc))
+}
+
+// renders the cover page template selected for a record, returning nil if that is not possible
+func (c *clientContext) renderCoverPage(doc *solrDoc, data coverData) *coverPage {
+	cfg, err := loadCoverConfig()
+	if err != nil {
+		c.err("unable to load cover page configuration: %s", err.Error())
+		c.warn("generating PDF without a cover page in directory: %s", c.pdf.workDir)
+		return nil
+	}
+
+	name := c.selectCoverTemplate(cfg, doc)
+
+	cover, err := renderCoverTemplate(name, data)
+	if err != nil {
+		c.err("unable to render cover page template [%s]: %s", name, err.Error())
+		c.warn("generating PDF without a cover page in directory: %s", c.pdf.workDir)
+		return nil
+	}
+
+	return cover
+}
+
+func (c *clientContext) getCoverData(doc *solrDoc) coverData {
+	// use first entry for these fields, if available
+	title := firstElementOf(doc.Title)
+	author := firstElementOf(doc.AuthorFacet)
+	year := firstElementOf(doc.PublishedDaterange)
+	rights := formatRights(firstElementOf(doc.RightsWrapper))
+	url := getVirgoURL(doc.ID)
+
+	citation := ""
+	if author != "" {
+		citation = fmt.Sprintf("%s%s. ", citation, strings.TrimRight(author, "."))
+	}
+	if year != "" {
+		citation = fmt.Sprintf("%s(%s). ", citation, year)
+	}
+	citation = fmt.Sprintf("%s\"%s\" [PDF document]. Available from %s", citation, title, url)
+
+	c.debug("title  : [%s]", title)
+	c.debug("author : [%s]", author)
+	c.debug("year   : [%s]", year)
+	c.debug("verify : [%s] (%s)", c.pdf.workDir, url)
+
+	return coverData{
+		Pid:       c.req.pid,
+		ID:        doc.ID,
+		Title:     title,
+		Author:    author,
+		Year:      year,
+		Rights:    rights,
+		VirgoURL:  url,
+		Citation:  citation,
+		Generated: time.Now().Format("2006-01-02"),
+		doc:       doc,
+	}
+}
+
+// filters out the catalog link, converts http: to https:, removes the period
+// from the terms link, and drops any trailing newline
+func formatRights(rightswrapper string) string {
+	rights := ""
+	for _, line := range strings.Split(rightswrapper, "\n") {
+		if strings.Contains(line, "/catalog/") {
+			continue
+		}
+
+		rights = fmt.Sprintf("%s%s\n", rights, line)
+	}
+	rights = strings.Replace(rights, "http:", "https:", -1)
+	rights = strings.Replace(rights, ".html.", ".html", -1)
+	rights = strings.TrimRight(rights, "\n")
+
+	return rights
+}
+
+func getVirgoURL(id string) string {
+	return strings.Replace(config.virgoURLTemplate.value, "{ID}", id, -1)
+}
+
+// returns the helper script arguments for a cover page, if any
+func (c *clientContext) getCoverPageArgs(cover *coverPage) []string {
+	args := []string{}
+
+	if cover == nil {
+		return args
+	}
+
+	// the script hands these to imagemagick, which expects escaped newlines
+	header := strings.Replace(cover.header, "\n", `\n`, -1)
+
+	args = []string{"-c", "-p", c.req.cover, "-h", header, "-l", cover.logo, "-t", cover.title, "-a", cover.author, "-f", cover.footer}
+
+	return args
+}
+
+// lays out the cover page and adds it to the pdf
+func (p *pdfWriter) addCoverPage(cover *coverPage, font *pdfFont) error {
+	// the logo is optional
+	logoObj := 0
+	logoWidth, logoHeight := 0.0, 0.0
+
+	if cover.logo != "" {
+		var err error
+		if logoObj, logoWidth, logoHeight, err = p.pngImage(cover.logo); err != nil {
+			return fmt.Errorf("unable to embed cover logo: %s", err.Error())
+		}
+	}
+
+	fontObj := p.addFont(font)
+
+	var content bytes.Buffer
+
+	// sections are stacked from the top down; track the offset from the top of the page
+	// and convert to pdf coordinates once the final page height is known
+	type textLine struct {
+		text string
+		size float64
+		top  float64
+	}
+
+	var lines []textLine
+
+	// adds the wrapped lines of a text section starting at the given offset, returning its height
+	textSection := func(text string, size float64, top float64) float64 {
+		if text == "" {
+			return 0
+		}
+
+		wrapped := font.wrapText(text, size, coverWidth-2*coverMargin)
+		lineHeight := size * coverLineSpacing
+
+		for i, line := range wrapped {
+			lines = append(lines, textLine{text: line, size: size, top: top + float64(i)*lineHeight})
+		}
+
+		return float64(len(wrapped)) * lineHeight
+	}
+
+	y := coverTopMargin
+
+	y += coverGap + textSection(cover.header, coverFontSize, y)
+
+	logoTop := y
+	if logoObj != 0 {
+		y += coverGap + logoHeight
+	}
+
+	y += textSection(cover.title, coverTitleSize, y)
+
+	y += coverGap + textSection(cover.author, coverFontSize, y)
+
+	y += coverBottomMargin + textSection(cover.footer, coverFontSize, y)
+
+	// grow the page if necessary
+	height := coverHeight
+	if y > height {
+		height = y
+	}
+
+	if logoObj != 0 {
+		fmt.Fprintf(&content, "q %s 0 0 %s %s %s cm /Logo Do Q\n", pdfNumber(logoWidth), pdfNumber(logoHeight),
+			pdfNumber((coverWidth-logoWidth)/2), pdfNumber(height-logoTop-logoHeight))
+	}
+
+	content.WriteString("BT\n")
+	for _, line := range lines {
+		if line.text == "" {
+			continue
+		}
+
+		// center each line, placing the baseline one font size below the top of the line
+		x := coverMargin + (coverWidth-2*coverMargin-font.textWidth(line.text, line.size))/2
+		fmt.Fprintf(&content, "/F1 %s Tf 1 0 0 1 %s %s Tm %s Tj\n", pdfNumber(line.size), pdfNumber(x),
+			pdfNumber(height-line.top-line.size), pdfLiteral(font.encode(line.text)))
+	}
+	content.WriteString("ET\n")
+
+	resources := fmt.Sprintf("/Font << /F1 %d 0 R >>", fontObj)
+	if logoObj != 0 {
+		resources += fmt.Sprintf(" /XObject << /Logo %d 0 R >>", logoObj)
+	}
+
+	p.addPage(coverWidth, height, resources, content.Bytes())
+
+	return p.err
+}
+
+// embeds a PNG image, returning its object number and
+// its size in points when placed at 300 DPI
+func (p *pdfWriter) pngImage(fileName string) (int, float64, float64, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer f.Close()
+
+	img, err := png.Decode(f)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	rgb := make([]byte, 0, w*h*3)
+	alpha := make([]byte, 0, w*h)
+	opaque := true
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+
+			// un-premultiply so that the soft mask is applied to the true colors
+			if a > 0 && a < 0xffff {
+				r = r * 0xffff / a
+				g = g * 0xffff / a
+				b = b * 0xffff / a
+			}
+
+			rgb = append(rgb, byte(r>>8), byte(g>>8), byte(b>>8))
+			alpha = append(alpha, byte(a>>8))
+
+			if a != 0xffff {
+				opaque = false
+			}
+		}
+	}
+
+	dict := fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /BitsPerComponent 8 /ColorSpace /DeviceRGB /Filter /FlateDecode", w, h)
+
+	if opaque == false {
+		maskObj := p.stream(0, fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /BitsPerComponent 8 /ColorSpace /DeviceGray /Filter /FlateDecode", w, h), deflate(alpha))
+		dict += fmt.Sprintf(" /SMask %d 0 R", maskObj)
+	}
+
+	n := p.stream(0, dict, deflate(rgb))
+
+	return n, float64(w) * coverPixelScale, float64(h) * coverPixelScale, p.err
+}
+
+func deflate(data []byte) []byte {
+	var b bytes.Buffer
+
+	z := zlib.NewWriter(&b)
+	z.Write(data)
+	z.Close()
+
+	return b.Bytes()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// selects a cover page template for a record based on its solr fields
+type coverRule struct {
+	Field    string `json:"field"`    // solr field to examine
+	Value    string `json:"value"`    // value to match; if blank, the field value names the template
+	Template string `json:"template"` // template to use when the value matches
+}
+
+// contents of covers.json in the cover template directory
+type coverConfig struct {
+	Default string      `json:"default"`
+	Rules   []coverRule `json:"rules"`
+}
+
+var coverTemplateNameRegex = regexp.MustCompile(`[^a-z0-9_-]+`)
+
+func coverTemplateDir() string {
+	return fmt.Sprintf("%s/covers", config.assetsDir.value)
+}
+
+// templates and rules are read on each use, so they can be changed without a restart
+func loadCoverConfig() (*coverConfig, error) {
+	cfg := coverConfig{Default: "default"}
+
+	buf, err := os.ReadFile(fmt.Sprintf("%s/covers.json", coverTemplateDir()))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &cfg, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(buf, &cfg); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// converts a field value such as "Special Collections" into a safe template name ("special-collections")
+func coverTemplateName(value string) string {
+	return strings.Trim(coverTemplateNameRegex.ReplaceAllString(strings.ToLower(value), "-"), "-")
+}
+
+func coverTemplateFile(name string) string {
+	return fmt.Sprintf("%s/%s.tmpl", coverTemplateDir(), name)
+}
+
+func coverTemplateExists(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	_, err := os.Stat(coverTemplateFile(name))
+	return err == nil
+}
+
+// renders each section of a cover page template.  templates define any of the
+// "header", "logo", "title", "author" and "footer" sections; missing sections are
+// left off the page.  the logo section names an image file in the assets directory.
+func renderCoverTemplate(name string, data coverData) (*coverPage, error) {
+	if coverTemplateName(name) != name {
+		return nil, fmt.Errorf("invalid template name: [%s]", name)
+	}
+
+	tmpl, err := template.ParseFiles(coverTemplateFile(name))
+	if err != nil {
+		return nil, err
+	}
+
+	section := func(section string) (string, error) {
+		if tmpl.Lookup(section) == nil {
+			return "", nil
+		}
+
+		var b bytes.Buffer
+		if err := tmpl.ExecuteTemplate(&b, section, data); err != nil {
+			return "", err
+		}
+
+		return strings.TrimSpace(b.String()), nil
+	}
+
+	var cover coverPage
+	var sectionErr error
+
+	for _, s := range []struct {
+		name string
+		dest *string
+	}{
+		{"header", &cover.header},
+		{"logo", &cover.logo},
+		{"title", &cover.title},
+		{"author", &cover.author},
+		{"footer", &cover.footer},
+	} {
+		if *s.dest, err = section(s.name); err != nil {
+			sectionErr = errors.Join(sectionErr, fmt.Errorf("%s: %s", s.name, err.Error()))
+		}
+	}
+
+	if sectionErr != nil {
+		return nil, sectionErr
+	}
+
+	if cover.logo != "" && filepath.IsAbs(cover.logo) == false {
+		cover.logo = fmt.Sprintf("%s/%s", config.assetsDir.value, cover.logo)
+	}
+
+	return &cover, nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// limits the number of simultaneous downloads from each configured host, across all jobs
+type hostLimiter struct {
+	sems map[string]chan struct{}
+}
+
+var hostLimits hostLimiter
+
+func initHostLimits() {
+	hostLimits.sems = make(map[string]chan struct{})
+
+	for _, entry := range strings.Split(config.hostConcurrency.value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			log.Fatalf("invalid host concurrency entry: [%s]", entry)
+		}
+
+		host := strings.ToLower(strings.TrimSpace(parts[0]))
+		limit, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || limit < 1 {
+			log.Fatalf("invalid host concurrency limit: [%s]", entry)
+		}
+
+		hostLimits.sems[host] = make(chan struct{}, limit)
+
+		log.Printf("INFO: limiting downloads from [%s] to %d at a time", host, limit)
+	}
+}
+
+// waits for a download slot for the host in the given url, returning a function to release it,
+// or an error if the context is done first.  hosts without a configured limit are not restricted.
+func (h *hostLimiter) acquire(ctx context.Context, rawURL string) (func(), error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return func() {}, nil
+	}
+
+	sem, ok := h.sems[strings.ToLower(u.Hostname())]
+	if ok == false {
+		sem, ok = h.sems[strings.ToLower(u.Host)]
+	}
+
+	if ok == false {
+		return func() {}, nil
+	}
+
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// runs a function at most once per key, with concurrent callers for the same key
+// waiting for the first one and sharing its result.  pages can share an image (cloned
+// pages, or a pid repeated in a merged pdf), which must only be written by one of them.
+type onceGroup[T any] struct {
+	mu    sync.Mutex
+	calls map[string]*onceCall[T]
+}
+
+type onceCall[T any] struct {
+	done chan struct{}
+	res  T
+	err  error
+}
+
+func (g *onceGroup[T]) do(key string, fn func() (T, error)) (T, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*onceCall[T])
+	}
+
+	if call, ok := g.calls[key]; ok == true {
+		g.mu.Unlock()
+		<-call.done
+		return call.res, call.err
+	}
+
+	call := &onceCall[T]{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	call.res, call.err = fn()
+	close(call.done)
+
+	return call.res, call.err
+}
+
+// a downloaded page image, along with its tracksys title and text (if any)
+type pageImage struct {
+	file    string
+	title   string
+	text    string // text file with the tracksys transcription of the page
+	ocr     string // tsv file of words recognized on the page
+	section int    // which pid it came from, when merging several
+}
+
+// saves the tracksys text for a page alongside its image, returning the file name,
+// or an empty string if there is no text
+func (c *clientContext) getPageText(pid, jpgFile string) string {
+	text, err := c.tsGetPageText(pid)
+	if err != nil {
+		c.warn("unable to get text for %s: %s", pid, err.Error())
+		return ""
+	}
+
+	if text == "" {
+		return ""
+	}
+
+	textFile := strings.TrimSuffix(jpgFile, ".jpg") + ".txt"
+	if err := os.WriteFile(textFile, []byte(text), 0644); err != nil {
+		c.warn("unable to save text for %s: %s", pid, err.Error())
+		return ""
+	}
+
+	c.info("using tracksys text for %s", pid)
+
+	return textFile
+}
+
+// downloads the image for each page using a bounded number of concurrent
+// requests, returning the successfully downloaded images in page order.
+// progress is reported as each page finishes, in whatever order that happens.
+func (c *clientContext) downloadPages(step *int, steps int) ([]pageImage, error) {
+	pages := c.pdf.ts.Pages
+	results := make([]pageImage, len(pages))
+
+	manifest := c.loadManifest()
+	defer manifest.save(c)
+
+	// each source image is downloaded once, however many pages use it
+	var downloads onceGroup[pageImage]
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	aborted := false
+	indexes := make(chan int)
+
+	for w := 0; w < config.downloadWorkers.value; w++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for i := range indexes {
+				// stop as soon as the job is cancelled or deleted
+				if c.cancelled() == true {
+					mu.Lock()
+					aborted = true
+					mu.Unlock()
+					continue
+				}
+
+				page := pages[i]
+
+				// get image from iiif
+				pid := page.Pid
+				if page.ClonedFrom.Pid != "" {
+					c.info("using original pid %s for cloned pid %s", page.ClonedFrom.Pid, page.Pid)
+					pid = page.ClonedFrom.Pid
+				}
+
+				source, jpgErr := downloads.do(pid, func() (pageImage, error) {
+					jpgFile, err := c.downloadJpgFromIiif(pid, manifest)
+					if err != nil {
+						return pageImage{}, err
+					}
+
+					// existing transcriptions make the best text layer, though only the
+					// native generator can add one
+					if config.pdfGenerator.value != "native" {
+						return pageImage{file: jpgFile}, nil
+					}
+
+					return pageImage{file: jpgFile, text: c.getPageText(pid, jpgFile)}, nil
+				})
+
+				if jpgErr != nil {
+					c.warn("no image for %s found on IIIF server; continuing", page.Pid)
+					continue
+				}
+
+				mu.Lock()
+				results[i] = pageImage{file: source.file, title: strings.TrimSpace(page.Title), text: source.text, section: c.pageSection(i)}
+				c.pdf.progress.PagesDone++
+				*step++
+				c.updateProgress(*step, steps)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for i := range pages {
+		mu.Lock()
+		stop := aborted
+		mu.Unlock()
+
+		if stop == true {
+			break
+		}
+
+		indexes <- i
+	}
+
+	close(indexes)
+	wg.Wait()
+
+	if aborted == true || c.cancelled() == true {
+		c.warn("job cancelled; abandoning downloads")
+		return nil, errors.New("job cancelled")
+	}
+
+	var images []pageImage
+	for _, image := range results {
+		if image.file != "" {
+			images = append(images, image)
+		}
+	}
+
+	return images, nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// a failed attempt is retried on the same connection, which it must have finished with
+func TestOpenURLRetry(t *testing.T) {
+	var requests, conns atomic.Int32
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("image"))
+	}))
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	client = &http.Client{Timeout: 10 * time.Second}
+	c := &clientContext{reqID: "test", ip: "-"}
+
+	body, err := c.openURL(srv.URL + "/page-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+
+	buf, _ := io.ReadAll(body)
+	if string(buf) != "image" {
+		t.Errorf("got body [%s], want [image]", buf)
+	}
+
+	if n := requests.Load(); n != 2 {
+		t.Errorf("made %d requests, want 2", n)
+	}
+
+	if n := conns.Load(); n != 1 {
+		t.Errorf("opened %d connections, want 1", n)
+	}
+}
+
+func TestOpenURLNotFound(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	client = &http.Client{Timeout: 10 * time.Second}
+	c := &clientContext{reqID: "test", ip: "-"}
+
+	if body, err := c.openURL(srv.URL + "/missing"); err == nil {
+		body.Close()
+		t.Errorf("missing image opened without error")
+	}
+}
+
+// transcriptions are only fetched when the generator can use them
+func TestPageTextOnlyForNativeGenerator(t *testing.T) {
+	tests := []struct {
+		generator string
+		requests  int
+	}{
+		{"native", 3},
+		{"script", 0},
+	}
+
+	for _, test := range tests {
+		fake := setupTestService(t)
+		config.pdfGenerator.value = test.generator
+
+		c := &clientContext{reqID: "test", ip: "-"}
+		c.req.pid = "book1"
+		c.pdf.workSubDir = "book1"
+		c.pdf.workDir = getWorkDir(c.pdf.workSubDir)
+
+		if err := os.MkdirAll(c.pdf.workDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if res := c.tsGetPidInfo(); res.err != nil {
+			t.Fatal(res.err)
+		}
+
+		step := 0
+		images, err := c.downloadPages(&step, len(c.pdf.ts.Pages)+1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(images) != 3 {
+			t.Errorf("%s: downloaded %d images, want 3", test.generator, len(images))
+		}
+
+		if n := fake.count("/api/fulltext"); n != test.requests {
+			t.Errorf("%s: made %d fulltext requests, want %d", test.generator, n, test.requests)
+		}
+	}
+}
+
+// returns a context for an existing pdf, for looking at its state
+func testPdfContext(pid string) *clientContext {
+	c := &clientContext{reqID: "test", ip: "-"}
+	c.req.pid = pid
+	c.pdf.workSubDir = pid
+	c.pdf.workDir = getWorkDir(pid)
+
+	return c
+}
+
+// generates a pdf, returning its contents
+func readyTestPdf(t *testing.T, pid string) []byte {
+	go jobs.worker(1)
+
+	if w := serve("GET", fmt.Sprintf("/pdf/%s?embed=1", pid), nil); w.Code != http.StatusOK {
+		t.Fatalf("generate: got %d: %s", w.Code, w.Body.String())
+	}
+
+	if status := waitForStatus(t, pid, 30*time.Second); status != "READY" {
+		t.Fatalf("status: got [%s], want [READY]", status)
+	}
+
+	pdf, err := os.ReadFile(fmt.Sprintf("%s/%s.pdf", getWorkDir(pid), pid))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pdf
+}
+
+// sets or clears the last download time of a pdf
+func setDownloaded(c *clientContext, t *time.Time) {
+	c.updateState(func(state *jobState) {
+		state.Downloaded = t
+	})
+}
+
+func TestDownload(t *testing.T) {
+	setupTestService(t)
+	pdf := readyTestPdf(t, "book1")
+	c := testPdfContext("book1")
+
+	etag := fmt.Sprintf(`"%s"`, c.loadState().Checksum)
+	size := len(pdf)
+
+	tests := []struct {
+		name     string
+		method   string
+		header   http.Header
+		status   int
+		body     []byte // nil if not checked
+		recorded bool
+	}{
+		{"whole", "GET", nil, http.StatusOK, pdf, true},
+		{"head", "HEAD", nil, http.StatusOK, []byte{}, false},
+		{"first range", "GET", http.Header{"Range": {"bytes=0-99"}}, http.StatusPartialContent, pdf[:100], true},
+		{"later range", "GET", http.Header{"Range": {"bytes=100-199"}}, http.StatusPartialContent, pdf[100:200], false},
+		{"suffix range", "GET", http.Header{"Range": {"bytes=-100"}}, http.StatusPartialContent, pdf[size-100:], false},
+		{"ranges from the start", "GET", http.Header{"Range": {"bytes=0-9,100-109"}}, http.StatusPartialContent, nil, true},
+		{"ranges from later on", "GET", http.Header{"Range": {"bytes=100-109,0-9"}}, http.StatusPartialContent, nil, false},
+		{"head of a range", "HEAD", http.Header{"Range": {"bytes=0-99"}}, http.StatusPartialContent, []byte{}, false},
+		{"unsatisfiable range", "GET", http.Header{"Range": {fmt.Sprintf("bytes=%d-", size)}}, http.StatusRequestedRangeNotSatisfiable, nil, false},
+		{"not modified", "GET", http.Header{"If-None-Match": {etag}}, http.StatusNotModified, []byte{}, false},
+		{"modified", "GET", http.Header{"If-None-Match": {`"other"`}}, http.StatusOK, pdf, true},
+		{"range of the same pdf", "GET", http.Header{"Range": {"bytes=0-99"}, "If-Range": {etag}}, http.StatusPartialContent, pdf[:100], true},
+		{"range of an older pdf", "GET", http.Header{"Range": {"bytes=100-199"}, "If-Range": {`"other"`}}, http.StatusOK, pdf, true},
+	}
+
+	for _, test := range tests {
+		setDownloaded(c, nil)
+
+		w := serve(test.method, "/pdf/book1/download", test.header)
+
+		if w.Code != test.status {
+			t.Errorf("%s: got %d, want %d", test.name, w.Code, test.status)
+			continue
+		}
+
+		if test.body != nil && bytes.Equal(w.Body.Bytes(), test.body) == false {
+			t.Errorf("%s: got %d bytes of body, want %d", test.name, w.Body.Len(), len(test.body))
+		}
+
+		if w.Code == http.StatusOK || w.Code == http.StatusPartialContent {
+			if got := w.Header().Get("ETag"); got != etag {
+				t.Errorf("%s: got etag %s, want %s", test.name, got, etag)
+			}
+
+			if got := w.Header().Get("Content-Disposition"); got != `attachment; filename="book1.pdf"` {
+				t.Errorf("%s: got content disposition [%s]", test.name, got)
+			}
+		}
+
+		if test.method == "HEAD" && test.status == http.StatusOK {
+			if got := w.Header().Get("Content-Length"); got != fmt.Sprint(size) {
+				t.Errorf("%s: got content length [%s], want %d", test.name, got, size)
+			}
+		}
+
+		if recorded := c.loadState().Downloaded != nil; recorded != test.recorded {
+			t.Errorf("%s: download recorded is %v, want %v", test.name, recorded, test.recorded)
+		}
+	}
+
+	if w := serve("GET", "/pdf/book2/download", nil); w.Code != http.StatusNotFound {
+		t.Errorf("pdf never generated: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+// downloads are recorded at most once per interval
+func TestDownloadRecordInterval(t *testing.T) {
+	setupTestService(t)
+	readyTestPdf(t, "book1")
+	c := testPdfContext("book1")
+
+	tests := []struct {
+		name     string
+		previous time.Duration // how long ago the last download was recorded
+		recorded bool
+	}{
+		{"just now", time.Second, false},
+		{"within the interval", downloadRecordInterval - 5*time.Second, false},
+		{"after the interval", downloadRecordInterval + time.Second, true},
+		{"long ago", 30 * 24 * time.Hour, true},
+	}
+
+	for _, test := range tests {
+		previous := time.Now().Add(-test.previous).Truncate(time.Second)
+		setDownloaded(c, &previous)
+
+		if w := serve("GET", "/pdf/book1/download", nil); w.Code != http.StatusOK {
+			t.Fatalf("%s: got %d", test.name, w.Code)
+		}
+
+		downloaded := c.loadState().Downloaded
+		if recorded := downloaded.Equal(previous) == false; recorded != test.recorded {
+			t.Errorf("%s: download recorded is %v, want %v", test.name, recorded, test.recorded)
+		}
+
+		if test.recorded == true && time.Since(*downloaded) > time.Minute {
+			t.Errorf("%s: recorded download time %s is not now", test.name, downloaded)
+		}
+	}
+}
+
+func TestIsFirstRange(t *testing.T) {
+	tests := []struct {
+		header string
+		first  bool
+	}{
+		{"", true},
+		{"bytes=0-", true},
+		{"bytes=0-99", true},
+		{"bytes= 0-99, 200-299", true},
+		{"bytes=100-", false},
+		{"bytes=-100", false},
+		{"bytes=100-199,0-99", false},
+	}
+
+	for _, test := range tests {
+		if got := isFirstRange(test.header); got != test.first {
+			t.Errorf("[%s]: got %v, want %v", test.header, got, test.first)
+		}
+	}
+}
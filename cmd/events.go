@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// how often an idle event stream re-checks the status on disk (which also
+// covers jobs running in other instances), and keeps the connection alive
+const eventsRefreshInterval = 15 * time.Second
+
+// fans out progress notifications from running jobs to event stream listeners.
+// a nil notification means "something changed, re-check the status".
+type progressHub struct {
+	mu   sync.Mutex
+	subs map[string]map[chan *jobProgress]bool
+}
+
+var progressEvents = progressHub{subs: make(map[string]map[chan *jobProgress]bool)}
+
+// registers a listener for a work directory, returning its channel and a function to unregister it
+func (h *progressHub) subscribe(workSubDir string) (chan *jobProgress, func()) {
+	ch := make(chan *jobProgress, 1)
+
+	h.mu.Lock()
+	if h.subs[workSubDir] == nil {
+		h.subs[workSubDir] = make(map[chan *jobProgress]bool)
+	}
+	h.subs[workSubDir][ch] = true
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs[workSubDir], ch)
+		if len(h.subs[workSubDir]) == 0 {
+			delete(h.subs, workSubDir)
+		}
+		h.mu.Unlock()
+	}
+}
+
+// notifies all listeners for a work directory.  listeners only care about the
+// latest state, so a notification they have not yet picked up is replaced.
+func (h *progressHub) publish(workSubDir string, progress *jobProgress) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subs[workSubDir] {
+		select {
+		case <-ch:
+		default:
+		}
+
+		ch <- progress
+	}
+}
+
+// builds a status from an in-process notification, without touching the disk.  it
+// goes through the same steps as a status read from disk, so that the two match.
+func (c *clientContext) statusFromProgress(progress *jobProgress) pdfStatus {
+	state := jobState{State: "processing"}
+	state.setProgress(*progress)
+
+	return c.statusFromState(&state)
+}
+
+func isFinalState(state string) bool {
+	return state == "ready" || state == "failed" || state == "not_found"
+}
+
+/**
+ * stream status changes for a PDF as server-sent events, ending once it is ready or has failed
+ */
+func eventsHandler(ctx *gin.Context) {
+	c := newClientContext(ctx)
+
+	if c.validWorkSubDir() == false {
+		c.respondString(http.StatusBadRequest, "Invalid PID or token")
+		return
+	}
+
+	// subscribe before reading the current status, so no change can slip in between
+	ch, unsubscribe := progressEvents.subscribe(c.pdf.workSubDir)
+	defer unsubscribe()
+
+	status := pdfStatus{Pid: c.req.pid, State: "not_found"}
+	if c.progressInValidState() == true {
+		status = c.getStatus()
+	}
+
+	c.logResponse(http.StatusOK, "text/event-stream")
+
+	c.ctx.Header("Cache-Control", "no-cache")
+	c.ctx.Header("X-Accel-Buffering", "no")
+
+	last := ""
+
+	// sends the status if it differs from the last one sent, returning false once it is final
+	send := func(status pdfStatus) bool {
+		output, _ := json.Marshal(status)
+
+		if string(output) != last {
+			c.ctx.SSEvent("status", string(output))
+			last = string(output)
+		}
+
+		return isFinalState(status.State) == false
+	}
+
+	if send(status) == false {
+		return
+	}
+
+	c.ctx.Writer.Flush()
+
+	ticker := time.NewTicker(eventsRefreshInterval)
+	defer ticker.Stop()
+
+	c.ctx.Stream(func(w io.Writer) bool {
+		select {
+		case progress := <-ch:
+			// finishing (or an unknown change) needs the full picture from disk
+			if progress == nil || (progress.Steps > 0 && progress.Step >= progress.Steps) {
+				return send(c.getStatus())
+			}
+			return send(c.statusFromProgress(progress))
+
+		case <-ticker.C:
+			if c.progressInValidState() == false {
+				return send(pdfStatus{Pid: c.req.pid, State: "not_found"})
+			}
+			if send(c.getStatus()) == true {
+				// a comment line keeps proxies from timing out an idle connection
+				io.WriteString(w, ":\n\n")
+				return true
+			}
+			return false
+
+		case <-c.ctx.Request.Context().Done():
+			return false
+		}
+	})
+}
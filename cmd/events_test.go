@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+)
+
+// events built from in-process progress must match the status read back from disk,
+// or the stream sends the same status twice as it switches between them
+func TestStatusFromProgressMatchesDisk(t *testing.T) {
+	setupTestService(t)
+
+	c := &clientContext{reqID: "test", ip: "-"}
+	c.req.pid = "book1"
+	c.pdf.workSubDir = "book1"
+	c.pdf.workDir = getWorkDir(c.pdf.workSubDir)
+
+	if err := os.MkdirAll(c.pdf.workDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []jobProgress{
+		{Stage: "queued", Steps: -1, PagesTotal: 3},
+		{Stage: "downloading", Step: 2, Steps: 7, PagesDone: 2, PagesTotal: 3, Started: time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)},
+		{Stage: "assembling", Step: 6, Steps: 7, PagesTotal: 3, Started: time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)},
+	}
+
+	for _, progress := range tests {
+		c.updateState(func(state *jobState) {
+			state.setProgress(progress)
+		})
+
+		fromDisk, _ := json.Marshal(c.getStatus())
+		fromProgress, _ := json.Marshal(c.statusFromProgress(&progress))
+
+		if string(fromDisk) != string(fromProgress) {
+			t.Errorf("%s:\n from disk:     %s\n from progress: %s", progress.Stage, fromDisk, fromProgress)
+		}
+	}
+}
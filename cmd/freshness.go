@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// the solr fields that appear on cover pages, besides any that covers.json selects templates by
+var coverFingerprintFields = []string{"id", "title_a", "author_facet_a", "published_daterange", "alternate_id_a", "rights_wrapper_a"}
+
+func fingerprint(v interface{}) string {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(buf)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// fingerprints the tracksys page list: which pages, in what order, and the master
+// files behind them, so that rescanned, reordered, added or removed pages all change it
+func (c *clientContext) pagesFingerprint() string {
+	if c.pdf.ts == nil {
+		return ""
+	}
+
+	var pages [][]string
+	for _, page := range c.pdf.ts.Pages {
+		pages = append(pages, []string{page.Pid, page.Filename, page.Title, page.ClonedFrom.Pid, page.ClonedFrom.Filename})
+	}
+
+	return fingerprint(pages)
+}
+
+// fingerprints the solr fields used on the cover page(s), including those that select
+// the cover template.  blank when there is no cover, or no record to build one from.
+func (c *clientContext) coverFingerprint() string {
+	if c.req.cover == "none" {
+		return ""
+	}
+
+	var docs []*solrDoc
+
+	if c.pdf.merge != nil {
+		for _, section := range c.pdf.merge.sections {
+			if section.solr != nil && len(section.solr.Response.Docs) > 0 {
+				docs = append(docs, &section.solr.Response.Docs[0])
+			}
+		}
+	} else if c.pdf.solr != nil && len(c.pdf.solr.Response.Docs) > 0 {
+		docs = append(docs, &c.pdf.solr.Response.Docs[0])
+	}
+
+	if len(docs) == 0 {
+		return ""
+	}
+
+	fields := append([]string{}, coverFingerprintFields...)
+	if cfg, err := loadCoverConfig(); err == nil {
+		for _, rule := range cfg.Rules {
+			fields = append(fields, rule.Field)
+		}
+	}
+
+	var values []map[string][]string
+	for _, doc := range docs {
+		docValues := make(map[string][]string)
+		for _, field := range fields {
+			docValues[field] = doc.fieldValues(field)
+		}
+		values = append(values, docValues)
+	}
+
+	return fingerprint(values)
+}
+
+// looks up the pdf's tracksys pages and solr record again, returning true if either
+// has changed since it was generated.  lookups are limited to one per check interval;
+// pdfs generated before fingerprints were recorded, and any lookup that fails, are
+// treated as unchanged.
+func (c *clientContext) contentChanged() bool {
+	state := c.loadState()
+	if state == nil || state.PagesFingerprint == "" {
+		return false
+	}
+
+	interval := time.Duration(config.contentCheck.value) * time.Second
+	if state.Checked != nil && time.Since(*state.Checked) < interval {
+		return false
+	}
+
+	if res := c.tsGetPidInfo(); res.err != nil {
+		c.warn("unable to check tracksys for changes: %s", res.err.Error())
+		return false
+	}
+
+	solrErr := c.solrGetInfo()
+	if solrErr != nil {
+		c.warn("unable to check solr for changes: %s", solrErr.Error())
+	}
+
+	c.updateState(func(state *jobState) {
+		now := time.Now()
+		state.Checked = &now
+	})
+
+	if c.pagesFingerprint() != state.PagesFingerprint {
+		c.info("tracksys pages have changed since the pdf was generated")
+		return true
+	}
+
+	if solrErr == nil && c.coverFingerprint() != state.CoverFingerprint {
+		c.info("solr cover fields have changed since the pdf was generated")
+		return true
+	}
+
+	return false
+}
+
+// clears out a finished pdf whose content has changed, so it can be generated again.
+// page images are only kept if the pages themselves are unchanged.
+func (c *clientContext) clearStalePdf() error {
+	state := c.loadState()
+
+	c.removeStoredPdf()
+
+	if state != nil && c.pagesFingerprint() != state.PagesFingerprint {
+		if err := os.Remove(fmt.Sprintf("%s/manifest.json", c.pdf.workDir)); err != nil && os.IsNotExist(err) == false {
+			return err
+		}
+	}
+
+	return c.clearFailure()
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func testPages() []tsGenericPidInfo {
+	var pages []tsGenericPidInfo
+	for i := 1; i <= 3; i++ {
+		pages = append(pages, tsGenericPidInfo{ID: i, Pid: fmt.Sprintf("page-%d", i), Title: fmt.Sprintf("Page %d", i), Filename: fmt.Sprintf("p%d.tif", i)})
+	}
+
+	return pages
+}
+
+func TestPagesFingerprint(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func([]tsGenericPidInfo) []tsGenericPidInfo
+		changed bool
+	}{
+		{"unchanged", func(p []tsGenericPidInfo) []tsGenericPidInfo { return p }, false},
+		{"different ids", func(p []tsGenericPidInfo) []tsGenericPidInfo { p[0].ID = 99; return p }, false},
+		{"reordered", func(p []tsGenericPidInfo) []tsGenericPidInfo { p[0], p[1] = p[1], p[0]; return p }, true},
+		{"page removed", func(p []tsGenericPidInfo) []tsGenericPidInfo { return p[:2] }, true},
+		{"page added", func(p []tsGenericPidInfo) []tsGenericPidInfo { return append(p, tsGenericPidInfo{Pid: "page-4"}) }, true},
+		{"page replaced", func(p []tsGenericPidInfo) []tsGenericPidInfo { p[1].Pid = "page-9"; return p }, true},
+		{"rescanned", func(p []tsGenericPidInfo) []tsGenericPidInfo { p[2].Filename = "p3-rescan.tif"; return p }, true},
+		{"retitled", func(p []tsGenericPidInfo) []tsGenericPidInfo { p[2].Title = "Plate 1"; return p }, true},
+		{"cloned", func(p []tsGenericPidInfo) []tsGenericPidInfo {
+			p[1].ClonedFrom = tsCloneInfo{Pid: "other-2", Filename: "o2.tif"}
+			return p
+		}, true},
+	}
+
+	c := &clientContext{reqID: "test", ip: "-"}
+
+	if got := c.pagesFingerprint(); got != "" {
+		t.Errorf("fingerprint without tracksys info: got [%s], want none", got)
+	}
+
+	c.pdf.ts = &tsPidInfo{Pages: testPages()}
+	base := c.pagesFingerprint()
+
+	for _, test := range tests {
+		c.pdf.ts = &tsPidInfo{Pages: test.change(testPages())}
+
+		if got := c.pagesFingerprint(); (got != base) != test.changed {
+			t.Errorf("%s: fingerprint changed is %v, want %v", test.name, got != base, test.changed)
+		}
+	}
+}
+
+func TestCoverFingerprint(t *testing.T) {
+	// a rule selecting templates by collection makes that field part of the cover
+	config.assetsDir.value = t.TempDir()
+	os.MkdirAll(coverTemplateDir(), 0755)
+	os.WriteFile(coverTemplateDir()+"/covers.json", []byte(`{"default":"default","rules":[{"field":"collection_a","template":"default"}]}`), 0644)
+
+	doc := func() map[string]interface{} {
+		return map[string]interface{}{
+			"id":             "u1",
+			"title_a":        []interface{}{"A Book"},
+			"author_facet_a": []interface{}{"Smith, John."},
+			"collection_a":   []interface{}{"Special Stuff"},
+			"subject_a":      []interface{}{"Books"},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		field   string
+		value   interface{}
+		changed bool
+	}{
+		{"unchanged", "title_a", []interface{}{"A Book"}, false},
+		{"field not on the cover", "subject_a", []interface{}{"Pamphlets"}, false},
+		{"title", "title_a", []interface{}{"A Better Book"}, true},
+		{"author added", "author_facet_a", []interface{}{"Smith, John.", "Jones, Jane."}, true},
+		{"rights", "rights_wrapper_a", []interface{}{"Public domain"}, true},
+		{"template selector", "collection_a", []interface{}{"Other Stuff"}, true},
+	}
+
+	c := &clientContext{reqID: "test", ip: "-"}
+	c.req.cover = "front"
+
+	if got := c.coverFingerprint(); got != "" {
+		t.Errorf("fingerprint without a solr record: got [%s], want none", got)
+	}
+
+	c.pdf.solr = &solrInfo{Response: solrResponse{NumFound: 1, Docs: []solrDoc{{fields: doc()}}}}
+	base := c.pdf.solr.Response.Docs[0].fields
+	baseFingerprint := c.coverFingerprint()
+
+	for _, test := range tests {
+		fields := doc()
+		fields[test.field] = test.value
+		c.pdf.solr = &solrInfo{Response: solrResponse{NumFound: 1, Docs: []solrDoc{{fields: fields}}}}
+
+		if got := c.coverFingerprint(); (got != baseFingerprint) != test.changed {
+			t.Errorf("%s: fingerprint changed is %v, want %v", test.name, got != baseFingerprint, test.changed)
+		}
+	}
+
+	c.req.cover = "none"
+	c.pdf.solr = &solrInfo{Response: solrResponse{NumFound: 1, Docs: []solrDoc{{fields: base}}}}
+	if got := c.coverFingerprint(); got != "" {
+		t.Errorf("fingerprint without a cover: got [%s], want none", got)
+	}
+}
+
+// a finished pdf is generated again once its pages change, but tracksys is only asked
+// about them once per check interval
+func TestContentChanged(t *testing.T) {
+	fake := setupTestService(t)
+	go jobs.worker(1)
+
+	generate := func() string {
+		if w := serve("GET", "/pdf/book1?embed=1", nil); w.Code != http.StatusOK {
+			t.Fatalf("generate: got %d: %s", w.Code, w.Body.String())
+		}
+
+		return serve("GET", "/pdf/book1/status", nil).Body.String()
+	}
+
+	generate()
+	if status := waitForStatus(t, "book1", 30*time.Second); status != "READY" {
+		t.Fatalf("status: got [%s], want [READY]", status)
+	}
+
+	lookups := fake.count("/api/pid")
+	images := fake.count("/iiif")
+
+	// unchanged, and then not checked again within the interval
+	config.contentCheck.value = 0
+	if status := generate(); status != "READY" {
+		t.Errorf("unchanged pdf: got [%s], want [READY]", status)
+	}
+
+	if n := fake.count("/api/pid") - lookups; n != 1 {
+		t.Errorf("unchanged pdf: made %d tracksys lookups, want 1", n)
+	}
+
+	config.contentCheck.value = 300
+	fake.setPages(4)
+
+	if status := generate(); status != "READY" {
+		t.Errorf("pdf checked within the interval: got [%s], want [READY]", status)
+	}
+
+	if n := fake.count("/api/pid") - lookups; n != 1 {
+		t.Errorf("pdf checked within the interval: made %d tracksys lookups, want 1", n)
+	}
+
+	// changed once the interval is up
+	config.contentCheck.value = 0
+	if status := generate(); status == "READY" {
+		t.Errorf("changed pdf: still [READY]")
+	}
+
+	if status := waitForStatus(t, "book1", 30*time.Second); status != "READY" {
+		t.Fatalf("regenerated status: got [%s], want [READY]", status)
+	}
+
+	// the page list changed, so every image is downloaded again
+	if n := fake.count("/iiif") - images; n != 4 {
+		t.Errorf("regenerated pdf: downloaded %d images, want 4", n)
+	}
+}
@@ -1,16 +1,15 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"html/template"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"os"
-	"os/exec"
 	"strings"
 	"time"
 
@@ -41,37 +40,144 @@ func generateHandler(ctx *gin.Context) {
 		return
 	}
 
-	// see if a previous attempt failed; if so, transparently try again
+	if res := c.createJob(); res.err != nil {
+		c.respondString(res.status, res.msg)
+		return
+	}
+
+	// Render a simple ok message or kick an ajax polling loop
+	c.inProgress()
+}
+
+// validates the request, then starts generating its pdf unless that is already done or underway
+func (c *clientContext) createJob() claimResult {
+	if c.validWorkSubDir() == false {
+		return claimResult{status: http.StatusBadRequest, msg: "Invalid PID or token", err: errors.New("invalid pid or token")}
+	}
+
+	if msg := c.checkOptions(); msg != "" {
+		return claimResult{status: http.StatusBadRequest, msg: msg, err: errors.New(msg)}
+	}
+
+	if c.req.callback != "" && config.webhookSecret.value == "" {
+		c.err("callback requested, but callbacks are not configured")
+		return claimResult{status: http.StatusBadRequest, msg: "Callbacks are not available", err: errors.New("callbacks are not configured")}
+	}
+
+	if c.req.callback != "" && isValidCallbackURL(c.req.callback) == false {
+		c.err("invalid callback url: [%s]", c.req.callback)
+		return claimResult{status: http.StatusBadRequest, msg: "Invalid callback", err: errors.New("invalid callback url")}
+	}
+
+	// only one caller at a time (across all instances) gets to inspect and set up the
+	// work directory; everyone else asking for the same PDF attaches to that outcome
+	if res := claims.do(c, c.startGeneration); res.err != nil {
+		return res
+	}
+
+	if c.req.callback != "" {
+		if err := c.registerCallback(c.req.callback); err != nil {
+			c.err("unable to register callback: %s", err.Error())
+			return claimResult{status: http.StatusInternalServerError, msg: "ERROR: failed to register callback", err: err}
+		}
+	}
+
+	return claimResult{status: http.StatusOK}
+}
+
+// returns true if the pid and token name a work directory.  they come straight from
+// the request, and must not reach outside the storage directory or into the queue, locks, etc.
+func (c *clientContext) validWorkSubDir() bool {
+	if isValidPathSegment(c.req.pid) == false || isValidWorkSubDir(c.pdf.workSubDir) == false {
+		c.err("invalid pid [%s] or token [%s]", c.req.pid, c.req.token)
+		return false
+	}
+
+	return true
+}
+
+// checks the requested output options, returning a message for the client if any are invalid
+func (c *clientContext) checkOptions() string {
+	if isValidCoverPosition(c.req.cover) == false {
+		c.err("invalid cover position: [%s]", c.req.cover)
+		return "Invalid cover position"
+	}
+
+	if isValidPdfFormat(c.req.format) == false {
+		c.err("invalid format: [%s]", c.req.format)
+		return "Invalid format"
+	}
+
+	if c.req.ocr != "" && c.req.ocr != "0" && c.req.ocr != "1" {
+		c.err("invalid ocr option: [%s]", c.req.ocr)
+		return "Invalid ocr option"
+	}
+
+	if c.req.format == "pdfa" && config.pdfGenerator.value != "native" {
+		c.err("PDF/A output requested, but the %s generator is configured", config.pdfGenerator.value)
+		return "PDF/A output is not available"
+	}
+
+	return ""
+}
+
+/**
+ * Inspect the work directory for this request, and queue a new generation if needed.
+ * Must only be called while holding the claim on the work directory.
+ */
+func (c *clientContext) startGeneration() claimResult {
+	// see if a previous attempt failed; if so, transparently try again,
+	// keeping any page images it managed to download
+	retry := false
 	if c.isFailed() == true {
-		c.info("found pdf in failed state; clearing it out and trying again")
-		if err := c.removeWorkDir(3, 5); err != nil {
-			c.warn("failed to clear out previous failure")
+		c.info("found pdf in failed state; clearing the failure and trying again")
+		if err := c.clearFailure(); err != nil {
+			c.warn("failed to clear out previous failure: %s; starting over", err.Error())
+			if err := c.removeWorkDir(3, 5); err != nil {
+				c.warn("failed to clear out previous failure")
+			}
+		} else {
+			retry = true
+		}
+	}
+
+	// a finished pdf is regenerated if its pages or cover content have changed since
+	if retry == false && c.isDone() == true && c.contentChanged() == true {
+		c.info("found pdf generated from outdated content; generating it again")
+		if err := c.clearStalePdf(); err != nil {
+			c.warn("failed to clear out outdated pdf: %s; starting over", err.Error())
+			if err := c.removeWorkDir(3, 5); err != nil {
+				c.warn("failed to clear out outdated pdf")
+			}
 		}
+		retry = true
 	}
 
 	// See if destination already exists...
-	if c.progressInValidState() == true {
+	if retry == false && c.progressInValidState() == true {
 		// path already exists; don't start another request, just treat this one
 		// as if it was complete (whether successful or not) and render the ajax page
-		c.inProgress()
-		return
+		return claimResult{status: http.StatusOK}
 	}
 
-	if res := c.tsGetPidInfo(); res.err != nil {
+	// checking a finished pdf for changes may already have looked these up
+	if c.pdf.ts != nil {
+		c.info("reusing tracksys info looked up while checking for changes")
+	} else if res := c.tsGetPidInfo(); res.err != nil {
 		switch res.status {
 		case http.StatusNotFound:
 			c.warn("tracksys API: %s", res.err.Error())
-			c.respondString(res.status, fmt.Sprintf("WARNING: Could not retrieve PID info: %s", res.err.Error()))
+			return claimResult{status: res.status, msg: fmt.Sprintf("WARNING: Could not retrieve PID info: %s", res.err.Error()), err: res.err}
 
 		default:
 			c.err("tracksys API: %s", res.err.Error())
-			c.respondString(res.status, fmt.Sprintf("ERROR: Could not retrieve PID info: %s", res.err.Error()))
+			return claimResult{status: res.status, msg: fmt.Sprintf("ERROR: Could not retrieve PID info: %s", res.err.Error()), err: res.err}
 		}
-
-		return
 	}
 
-	if err := c.solrGetInfo(); err != nil {
+	if c.pdf.solr != nil {
+		c.info("reusing solr info looked up while checking for changes")
+	} else if err := c.solrGetInfo(); err != nil {
 		c.warn("solr error: %s", err.Error())
 		c.warn("generating PDF without a cover page in directory: %s", c.pdf.workDir)
 	}
@@ -80,18 +186,23 @@ func generateHandler(ctx *gin.Context) {
 	// in case status endpoint is called before everything is set up and in a good state
 	if err := os.MkdirAll(c.pdf.workDir, 0755); err != nil {
 		c.err("failed to create working directory [%s]: %s", c.pdf.workDir, err.Error())
-		c.respondString(http.StatusInternalServerError, "ERROR: failed to initialize PDF process")
-		return
+		return claimResult{status: http.StatusInternalServerError, msg: "ERROR: failed to initialize PDF process", err: err}
 	}
 
+	c.initState()
+
 	// fudge some numbers for a 0% progress
+	c.pdf.progress = jobProgress{Stage: "queued", PagesTotal: len(c.pdf.ts.Pages)}
 	c.updateProgress(0, -1)
 
-	// kick the lengthy PDF generation off in a go routine
-	go c.generatePdf()
+	// hand the lengthy PDF generation off to the worker pool
+	if err := jobs.enqueue(c); err != nil {
+		c.err("failed to queue job: %s", err.Error())
+		c.setFailed("Unable to queue PDF generation")
+		return claimResult{status: http.StatusInternalServerError, msg: "ERROR: failed to initialize PDF process", err: err}
+	}
 
-	// Render a simple ok message or kick an ajax polling loop
-	c.inProgress()
+	return claimResult{status: http.StatusOK}
 }
 
 /*
@@ -117,7 +228,12 @@ func (c *clientContext) openURL(url string) (io.ReadCloser, error) {
 	backoff := 1
 
 	for i := 1; i <= maxTries; i++ {
-		h, err := http.Get(url)
+		req, err := http.NewRequestWithContext(c.context(), "GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		h, err := client.Do(req)
 
 		if err != nil {
 			return nil, err
@@ -127,6 +243,10 @@ func (c *clientContext) openURL(url string) (io.ReadCloser, error) {
 			return h.Body, nil
 		}
 
+		// finish with the response, so that its connection can be reused
+		io.Copy(io.Discard, io.LimitReader(h.Body, 64*1024))
+		h.Body.Close()
+
 		if h.StatusCode == http.StatusNotFound {
 			return nil, fmt.Errorf("received http status: %s", h.Status)
 		}
@@ -138,19 +258,38 @@ func (c *clientContext) openURL(url string) (io.ReadCloser, error) {
 
 		c.warn("open [%s] (try %d/%d): received status: %s; will try again in %d seconds...", url, i, maxTries, h.Status, backoff)
 
-		time.Sleep(time.Duration(backoff) * time.Second)
+		select {
+		case <-time.After(time.Duration(backoff) * time.Second):
+		case <-c.context().Done():
+			return nil, c.context().Err()
+		}
+
 		backoff *= 2
 	}
 
 	return nil, fmt.Errorf("max tries reached")
 }
 
-func (c *clientContext) downloadJpgFromIiif(pid string) (jpgFileName string, err error) {
+func (c *clientContext) downloadJpgFromIiif(pid string, manifest *pageManifest) (jpgFileName string, err error) {
 	url := config.iiifURLTemplate.value
 	url = strings.Replace(url, "{PID}", pid, -1)
 
 	pfx := fmt.Sprintf("[%s] ", pid)
 
+	// reuse the image from a previous attempt if it is still intact
+	if fileName, ok := manifest.lookup(pid, url); ok == true {
+		c.info(pfx+"reusing previous download: %s", fileName)
+		jpgFileName = fileName
+		return
+	}
+
+	release, err := hostLimits.acquire(c.context(), url)
+	if err != nil {
+		c.err(pfx+"download abandoned: %s", err.Error())
+		return
+	}
+	defer release()
+
 	c.info(pfx+"downloading: %s", url)
 	body, err := c.openURL(url)
 	if err != nil {
@@ -167,93 +306,33 @@ func (c *clientContext) downloadJpgFromIiif(pid string) (jpgFileName string, err
 	}
 	defer destFile.Close()
 
-	s, err := io.Copy(destFile, body)
+	h := sha256.New()
+
+	s, err := io.Copy(io.MultiWriter(destFile, h), body)
 	if err != nil {
 		c.err(pfx+"download failed: %s", err.Error())
 		return
 	}
 
+	manifest.record(manifestPage{Pid: pid, URL: url, File: jpgFileName, Size: s, Checksum: hex.EncodeToString(h.Sum(nil))})
+
 	c.info(pfx+"download succeeded: %d bytes", s)
 	return
 }
 
 func (c *clientContext) updateProgress(step int, steps int) {
-	if steps > 0 {
-		c.info("%d%% (step %d of %d)", (100*step)/steps, step, steps)
-	}
-
-	f, _ := os.OpenFile(fmt.Sprintf("%s/progress.txt", c.pdf.workDir), os.O_CREATE|os.O_RDWR, 0666)
-	defer f.Close()
-
-	w := bufio.NewWriter(f)
-
-	if _, err := fmt.Fprintf(w, "%d%%", (100*step)/steps); err != nil {
-		c.err("unable to write progress file: %s", err.Error())
-	}
-
-	w.Flush()
-}
-
-func (c *clientContext) getCoverPageArgs() []string {
-	args := []string{}
-
-	if c.pdf.solr == nil {
-		return args
-	}
-
-	// set up arguments
-
-	header := `This resource was made available courtesy of the UVA Library.\n\nNOTICE: This material may be protected by copyright law (Title 17, United States Code)`
-
-	logo := fmt.Sprintf("%s/UVALIB_primary_black_print.png", config.assetsDir.value)
-
-	doc := c.pdf.solr.Response.Docs[0]
-
-	// use first entry for these fields, if available
-	title := firstElementOf(doc.Title)
-	author := firstElementOf(doc.AuthorFacet)
-	year := firstElementOf(doc.PublishedDaterange)
-	rightswrapper := firstElementOf(doc.RightsWrapper)
-
-	// filter out catalog link, convert http: to https:, remove period from terms link, and drop any trailing newline
-	rights := ""
-	for _, line := range strings.Split(rightswrapper, "\n") {
-		if strings.Contains(line, "/catalog/") {
-			continue
-		}
-
-		rights = fmt.Sprintf("%s%s\n", rights, line)
+	// a cancelled job may no longer have a work directory to write to
+	if c.cancelled() == true {
+		return
 	}
-	rights = strings.Replace(rights, "http:", "https:", -1)
-	rights = strings.Replace(rights, ".html.", ".html", -1)
-	rights = strings.TrimRight(rights, "\n")
 
-	generated := fmt.Sprintf("Generation date: %s", time.Now().Format("2006-01-02"))
-
-	url := strings.Replace(config.virgoURLTemplate.value, "{ID}", doc.ID, -1)
-
-	citation := ""
-	if author != "" {
-		citation = fmt.Sprintf("%s%s. ", citation, strings.TrimRight(author, "."))
-	}
-	if year != "" {
-		citation = fmt.Sprintf("%s(%s). ", citation, year)
+	if steps > 0 {
+		c.info("%d%% (step %d of %d)", (100*step)/steps, step, steps)
 	}
-	citation = fmt.Sprintf("%s\"%s\" [PDF document]. Available from %s", citation, title, url)
-
-	// FIXME: rights may not always be present, should we get it elsewhere?
-	libraryid := fmt.Sprintf("UVA Library ID Information:\n\n%s", rights)
-
-	footer := fmt.Sprintf("%s\n\n\n%s\n\n\n\n%s", generated, citation, libraryid)
 
-	c.debug("title  : [%s]", title)
-	c.debug("author : [%s]", author)
-	c.debug("year   : [%s]", year)
-	c.debug("verify : [%s] (%s)", c.pdf.workDir, url)
-
-	args = []string{"-c", "-h", header, "-l", logo, "-t", title, "-a", author, "-f", footer}
-
-	return args
+	c.pdf.progress.Step = step
+	c.pdf.progress.Steps = steps
+	c.writeProgress()
 }
 
 /**
@@ -261,53 +340,55 @@ func (c *clientContext) getCoverPageArgs() []string {
  */
 func (c *clientContext) generatePdf() {
 	// initialize progress reporting:
-	// steps include each page download, plus a final conversion step
+	// steps include each page download, each page ocr (if enabled), plus a final conversion step
 	// future enhancement: each page download, plus each page as processed by imagemagick (convert -monitor)
 
+	ocr := c.ocrEnabled()
+
 	var steps = len(c.pdf.ts.Pages) + 1
+	if ocr == true {
+		steps += len(c.pdf.ts.Pages)
+	}
 	var step = 0
-	c.updateProgress(step, steps)
 
 	start := time.Now()
 
-	// iterate over page info and build a list of paths to
-	// the image for that page. Older pages may only be stored on an NFS share
-	// and newer pages will have a jp2k file available on the iiif server
-	var jpgFiles []string
-	for _, page := range c.pdf.ts.Pages {
-		// if working dir has been removed from under us, abort
-		if _, err := os.Stat(c.pdf.workDir); err != nil {
-			c.err("working directory [%s] vanished; aborting", c.pdf.workDir)
-			return
-		}
+	c.pdf.progress = jobProgress{Stage: "downloading", PagesTotal: len(c.pdf.ts.Pages), Started: start}
+	c.updateProgress(step, steps)
 
-		// get image from iiif
-		pid := page.Pid
-		if page.ClonedFrom.Pid != "" {
-			c.info("using original pid %s for cloned pid %s", page.ClonedFrom.Pid, page.Pid)
-			pid = page.ClonedFrom.Pid
-		}
+	// download the image for each page from the iiif server, several at a time.
+	// older pages may only be stored on an NFS share and will be skipped
+	images, dlErr := c.downloadPages(&step, steps)
+	if dlErr != nil {
+		return
+	}
 
-		jpgFile, jpgErr := c.downloadJpgFromIiif(pid)
-		if jpgErr != nil {
-			c.warn("no image for %s found on IIIF server; continuing", page.Pid)
-			continue
+	// pages that could not be downloaded are done with, and have nothing to recognize
+	step = len(c.pdf.ts.Pages)
+	steps = len(c.pdf.ts.Pages) + 1
+	if ocr == true {
+		steps += len(images)
+	}
+	c.updateProgress(step, steps)
+
+	// recognize the text on each page, several at a time
+	if ocr == true {
+		c.setStage("ocr", 0, len(images))
+		if err := c.ocrPages(images, &step, steps); err != nil {
+			return
 		}
-		jpgFiles = append(jpgFiles, jpgFile)
+	}
 
-		step++
-		c.updateProgress(step, steps)
+	var jpgFiles []string
+	for _, image := range images {
+		jpgFiles = append(jpgFiles, image.file)
 	}
 
 	// check if we have any jpg files to process
 
 	if len(jpgFiles) == 0 {
 		c.err("no jpg files to process")
-		ef, _ := os.OpenFile(fmt.Sprintf("%s/fail.txt", c.pdf.workDir), os.O_CREATE|os.O_RDWR, 0666)
-		defer ef.Close()
-		if _, err := ef.WriteString("No jpg files to process"); err != nil {
-			c.err("unable to write error file: %s", err.Error())
-		}
+		c.setFailed("No jpg files to process")
 		return
 	}
 
@@ -315,75 +396,126 @@ func (c *clientContext) generatePdf() {
 	pdfFile := fmt.Sprintf("%s/%s.pdf", c.pdf.workDir, c.req.pid)
 	c.info("merging images into single PDF: %s", pdfFile)
 
-	// generate a cover page only if we have solr info
-	coverPageArgs := c.getCoverPageArgs()
-
-	// finally build helper script command and argument string
-	cmd := fmt.Sprintf("%s/mkpdf.sh", config.scriptDir.value)
-	args := []string{"-o", pdfFile, "-n", config.pdfChunkSize.value}
-	args = append(args, coverPageArgs...)
-	args = append(args, "--")
-	args = append(args, jpgFiles...)
+	c.setStage("assembling", 0, len(jpgFiles))
 
-	out, convErr := exec.Command(cmd, args...).CombinedOutput()
+	// generate a cover page only if we have solr info
+	cover := c.getCoverPage()
 
-	cf, _ := os.OpenFile(fmt.Sprintf("%s/convert.txt", c.pdf.workDir), os.O_CREATE|os.O_RDWR, 0666)
-	defer cf.Close()
-	if _, err := cf.WriteString(string(out)); err != nil {
-		c.err("unable to write conversion log file: %s", err.Error())
+	var convErr error
+	switch config.pdfGenerator.value {
+	case "script":
+		convErr = c.generatePdfWithScript(pdfFile, jpgFiles, cover)
+	default:
+		convErr = c.generatePdfNative(pdfFile, c.documentParts(images), cover)
 	}
 
 	if convErr != nil {
 		c.err("unable to generate merged PDF: %s", convErr.Error())
-		ef, _ := os.OpenFile(fmt.Sprintf("%s/fail.txt", c.pdf.workDir), os.O_CREATE|os.O_RDWR, 0666)
-		defer ef.Close()
-		if _, err := ef.WriteString(convErr.Error()); err != nil {
-			c.err("unable to write error file: %s", err.Error())
-		}
+		c.setFailed(convErr.Error())
 	} else {
 		c.info("generated PDF: %s", pdfFile)
-		df, _ := os.OpenFile(fmt.Sprintf("%s/done.txt", c.pdf.workDir), os.O_CREATE|os.O_RDWR, 0666)
-		defer df.Close()
-		if _, err := df.WriteString(pdfFile); err != nil {
-			c.err("unable to write done file: %s", err.Error())
+		c.setStage("storing", 0, c.pdf.progress.PagesTotal)
+
+		if convErr = c.storePdf(pdfFile); convErr != nil {
+			c.err("unable to store generated PDF: %s", convErr.Error())
+			c.setFailed(fmt.Sprintf("Unable to store PDF: %s", convErr.Error()))
 		}
 	}
 
+	// a failed attempt keeps the stage it failed in
+	if convErr == nil {
+		c.pdf.progress.Stage = "finished"
+	}
+
 	step = steps
 	c.updateProgress(step, steps)
 
+	// failures notify callers as they are recorded
+	if convErr == nil {
+		c.fireCallbacks("ready", "")
+	}
+
 	elapsed := time.Since(start).Seconds()
 
 	c.info("DONE: %d pages processed in %0.2f seconds (%0.2f seconds/page)",
 		len(jpgFiles), elapsed, elapsed/float64(len(jpgFiles)))
 }
 
-func (c *clientContext) isDone() bool {
-	if _, err := os.Stat(fmt.Sprintf("%s/done.txt", c.pdf.workDir)); err == nil {
-		return true
+// hands a generated pdf to the storage backend, and records it as ready
+func (c *clientContext) storePdf(pdfFile string) error {
+	checksum, size, err := fileChecksum(pdfFile)
+	if err != nil {
+		return err
 	}
-	return false
+
+	location, err := storage.store(c.context(), c.pdf.workSubDir, pdfFile)
+	if err != nil {
+		return err
+	}
+
+	c.info("stored PDF: %s", location)
+	c.setReady(location, size, checksum)
+
+	return nil
 }
 
-func (c *clientContext) isFailed() bool {
-	if _, err := os.Stat(fmt.Sprintf("%s/fail.txt", c.pdf.workDir)); err == nil {
-		return true
+// removes the results of a failed attempt, leaving downloaded pages and their manifest in place.
+// the job state itself is replaced when the next attempt is queued.
+func (c *clientContext) clearFailure() error {
+	for _, fileName := range []string{cancelFile(c.pdf.workDir), fmt.Sprintf("%s/%s.pdf", c.pdf.workDir, c.req.pid)} {
+		if err := os.Remove(fileName); err != nil && os.IsNotExist(err) == false {
+			return err
+		}
 	}
-	return false
+
+	return nil
 }
 
-func (c *clientContext) isInProgress() bool {
-	if _, err := os.Stat(fmt.Sprintf("%s/progress.txt", c.pdf.workDir)); err == nil {
-		return true
+// builds the PDF using the imagemagick/ghostscript helper script
+func (c *clientContext) generatePdfWithScript(pdfFile string, jpgFiles []string, cover *coverPage) error {
+	// finally build helper script command and argument string
+	cmd := fmt.Sprintf("%s/mkpdf.sh", config.scriptDir.value)
+	args := []string{"-o", pdfFile, "-n", config.pdfChunkSize.value}
+
+	// document information is handed to ghostscript as a pdfmark file
+	markFile := fmt.Sprintf("%s/metadata.ps", c.pdf.workDir)
+	if err := os.WriteFile(markFile, c.getPdfMetadata().pdfmark(), 0644); err != nil {
+		c.err("unable to write metadata file: %s", err.Error())
+	} else {
+		args = append(args, "-m", markFile)
 	}
-	return false
+
+	args = append(args, c.getCoverPageArgs(cover)...)
+	args = append(args, "--")
+	args = append(args, jpgFiles...)
+
+	out, convErr := c.command(cmd, args...).CombinedOutput()
+
+	c.setConversionLog(out)
+
+	return convErr
+}
+
+func (c *clientContext) isDone() bool {
+	state := c.loadState()
+	return state != nil && state.State == "ready"
+}
+
+func (c *clientContext) isFailed() bool {
+	state := c.loadState()
+	return state != nil && state.State == "failed"
+}
+
+func (c *clientContext) isInProgress() bool {
+	state := c.loadState()
+	return state != nil && state.State == "processing"
 }
 
 func (c *clientContext) progressInValidState() bool {
 	// valid states being: { in progress, done, failed }
 
 	// returns true if the specified directory exists, and contains
-	// at least one of the known progress/completion files.
+	// a job state (or the marker files older versions used instead).
 
 	// this is a helper to work around a race condition in which the
 	// directory exists but is empty, and no pdf is being generated.
@@ -401,9 +533,12 @@ func (c *clientContext) progressInValidState() bool {
 	}
 
 	if ok := c.isInProgress(); ok == true {
-		// at this point, there is the potential for an in-progress generation to
-		// have crashed without creating a done.txt or fail.txt file.  we ignore
-		// this possibility for now, and just assume the process is chugging along.
+		// an in-progress generation may have crashed without recording that it
+		// finished.  if its owner has stopped sending heartbeats, take it
+		// over; either way it ends up queued or failed, both of which are valid.
+		if c.isStale() == true {
+			c.recoverStaleJob()
+		}
 		return true
 	}
 
@@ -420,97 +555,180 @@ func (c *clientContext) progressInValidState() bool {
 func statusHandler(ctx *gin.Context) {
 	c := newClientContext(ctx)
 
+	if c.validWorkSubDir() == false {
+		c.respondString(http.StatusBadRequest, "Invalid PID or token")
+		return
+	}
+
 	if c.progressInValidState() == false {
+		if c.wantsJSON() == true {
+			c.respondStatusJSON(http.StatusNotFound, pdfStatus{Pid: c.req.pid, State: "not_found"})
+			return
+		}
 		c.respondString(http.StatusNotFound, "Not found")
 		return
 	}
 
-	doneFile := fmt.Sprintf("%s/done.txt", c.pdf.workDir)
-	if _, err := os.Stat(doneFile); err == nil {
-		c.respondString(http.StatusOK, "READY")
+	if c.wantsJSON() == true {
+		c.respondStatusJSON(http.StatusOK, c.getStatus())
+		return
+	}
+
+	state := c.loadState()
+	if state == nil {
+		c.respondString(http.StatusOK, "PROCESSING")
 		return
 	}
 
-	errorFile := fmt.Sprintf("%s/fail.txt", c.pdf.workDir)
-	if _, err := os.Stat(errorFile); err == nil {
+	switch state.State {
+	case "ready":
+		c.respondString(http.StatusOK, "READY")
+		return
+
+	case "failed":
 		c.respondString(http.StatusOK, "FAILED")
 		return
 	}
 
-	progressFile := fmt.Sprintf("%s/progress.txt", c.pdf.workDir)
-	prog, err := ioutil.ReadFile(progressFile)
-	if err != nil {
-		c.respondString(http.StatusOK, "PROCESSING")
+	if pos := jobs.position(c.pdf.workSubDir); pos > 0 {
+		c.respondString(http.StatusOK, fmt.Sprintf("QUEUED %d", pos))
 		return
 	}
 
-	c.respondString(http.StatusOK, string(prog))
+	c.respondString(http.StatusOK, fmt.Sprintf("%d%%", state.Percent))
 }
 
 func downloadHandler(ctx *gin.Context) {
 	c := newClientContext(ctx)
 
-	if c.progressInValidState() == false {
-		c.respondString(http.StatusNotFound, "Not found")
+	if c.validWorkSubDir() == false {
+		c.respondString(http.StatusBadRequest, "Invalid PID or token")
 		return
 	}
 
-	/* get path of file to send from the done file */
-	f, err := os.OpenFile(fmt.Sprintf("%s/done.txt", c.pdf.workDir), os.O_RDONLY, 0666)
-	if err != nil {
+	if c.progressInValidState() == false {
 		c.respondString(http.StatusNotFound, "Not found")
 		return
 	}
-	b, err := ioutil.ReadAll(f)
+
+	c.sendPdf()
+}
+
+// sends the finished pdf to the client
+func (c *clientContext) sendPdf() {
+	/* get location of file to send from the done file */
+	location, backend, err := c.storedPdf()
 	if err != nil {
+		if os.IsNotExist(err) == true {
+			c.respondString(http.StatusNotFound, "Not found")
+			return
+		}
+		c.err("failed to locate pdf: %s", err.Error())
 		c.respondString(http.StatusInternalServerError, "Unable to find PDF for this PID")
 		return
 	}
 
-	pdfFile := strings.TrimSpace(string(b))
+	fileName := fmt.Sprintf("%s.pdf", c.req.pid)
+	head := c.ctx.Request.Method == http.MethodHead
+
+	/* pdfs in object storage may be downloaded from there directly.  presigned */
+	/* urls are only good for GET, so HEAD requests are always answered here */
+	redirectURL := ""
+	if head == false {
+		if redirectURL, err = backend.downloadURL(location, fileName); err != nil {
+			c.err("failed to create download url for [%s]: %s", location, err.Error())
+			c.respondString(http.StatusInternalServerError, "Unable to find PDF for this PID")
+			return
+		}
+	}
 
-	/* seamless conversion from old locations */
-	if strings.HasPrefix(pdfFile, "tmp/") {
-		pdfFile = strings.Replace(pdfFile, "tmp", config.storageDir.value, 1)
+	if redirectURL != "" {
+		if isFirstRange(c.ctx.GetHeader("Range")) == true {
+			c.recordDownload()
+		}
+		c.info("PDF download redirected: %s", location)
+		c.ctx.Redirect(http.StatusFound, redirectURL)
+		return
 	}
 
-	/* get file size */
-	in, err := os.Open(pdfFile)
+	/* get file size and modification time */
+	stat, err := backend.stat(c.ctx.Request.Context(), location)
 	if err != nil {
-		c.err("failed to open [%s]: %s", pdfFile, err.Error())
+		c.err("failed to stat [%s]: %s", location, err.Error())
+		c.respondString(http.StatusInternalServerError, "Unable to stat PDF for this PID")
+		return
+	}
+
+	in, err := backend.open(c.ctx.Request.Context(), location)
+	if err != nil {
+		c.err("failed to open [%s]: %s", location, err.Error())
 		c.respondString(http.StatusInternalServerError, "Unable to open PDF for this PID")
 		return
 	}
 	defer in.Close()
 
-	stat, staterr := in.Stat()
-	if staterr != nil {
-		c.err("failed to stat [%s]: %s", pdfFile, staterr.Error())
-		c.respondString(http.StatusInternalServerError, "Unable to stat PDF for this PID")
-		return
+	header := c.ctx.Writer.Header()
+	header.Set("Content-Type", "application/pdf")
+	header.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, fileName))
+
+	/* a pdf may be regenerated at the same url, so caches should check before reusing it */
+	header.Set("Cache-Control", "no-cache")
+
+	/* pdfs generated by older versions have no checksum, and fall back to Last-Modified */
+	if state := c.loadState(); state != nil && state.Checksum != "" {
+		header.Set("ETag", fmt.Sprintf(`"%s"`, state.Checksum))
 	}
 
-	contentLength := stat.Size()
-	contentType := "application/pdf"
-	fileName := fmt.Sprintf("%s.pdf", c.req.pid)
+	c.info("PDF download started: %s (%d bytes; range: [%s])", location, stat.size, c.ctx.GetHeader("Range"))
+	c.respondContent(fileName, stat.modified, in)
 
-	extraHeaders := map[string]string{
-		"Content-Disposition": fmt.Sprintf(`attachment; filename="%s"`, fileName),
+	/* only count actual downloads: not HEAD, not-modified or unsatisfiable range */
+	/* responses, and not the later pieces of a download made in several ranges */
+	status := c.ctx.Writer.Status()
+	if head == false && (status == http.StatusOK || (status == http.StatusPartialContent && isFirstRange(c.ctx.GetHeader("Range")) == true)) {
+		c.recordDownload()
+	}
+}
+
+// returns true if a Range header is absent, or asks for the start of the content
+func isFirstRange(header string) bool {
+	if header == "" {
+		return true
 	}
 
-	c.info("PDF download started: %s (%d bytes)", pdfFile, contentLength)
-	c.respondDataFromReader(http.StatusOK, contentLength, contentType, in, extraHeaders)
+	first := strings.SplitN(strings.TrimPrefix(header, "bytes="), ",", 2)[0]
+
+	return strings.HasPrefix(strings.TrimSpace(first), "0-")
 }
 
 func deleteHandler(ctx *gin.Context) {
 	c := newClientContext(ctx)
 
-	// ten attempts over a max of 825 seconds (13.75 minutes) should about do it
-	go c.removeWorkDir(10, 15)
+	if c.validWorkSubDir() == false {
+		c.respondString(http.StatusBadRequest, "Invalid PID or token")
+		return
+	}
+
+	c.deleteJob()
 
 	c.respondString(http.StatusOK, "DELETED")
 }
 
+// drops the job for this pdf if it is still queued here, or stops it if it is running
+// here, and removes its work directory.  a job running elsewhere is stopped once that
+// instance notices the directory is gone
+func (c *clientContext) deleteJob() {
+	if jobs.cancel(c.pdf.workSubDir) == true {
+		c.info("cancelled job for [%s]", c.pdf.workSubDir)
+	}
+
+	// the done file records where the pdf is, so it has to go first
+	c.removeStoredPdf()
+
+	// ten attempts over a max of 825 seconds (13.75 minutes) should about do it
+	go c.removeWorkDir(10, 15)
+}
+
 func (c *clientContext) removeWorkDir(maxAttempts int, waitBetween int) error {
 	// tries to remove the work directory, with arithmetic backoff retry logic.
 	// total time before giving up in worst case is:
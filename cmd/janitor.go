@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// files whose presence marks a directory as a work directory
+var workDirMarkers = append([]string{"job.json", "owner.json"}, legacyStateFiles...)
+
+// a work directory found while scanning the storage directory
+type cachedWorkDir struct {
+	workSubDir string
+	size       int64     // bytes used by the files in this directory (not its subdirectories)
+	lastUsed   time.Time // last download, or when it finished if never downloaded
+	finished   bool      // done or failed, and so eligible for eviction
+}
+
+// the results of a cleanup run
+type janitorRun struct {
+	Started     time.Time `json:"started"`
+	Finished    time.Time `json:"finished"`
+	Seconds     float64   `json:"seconds"`
+	WorkDirs    int       `json:"work_dirs"`
+	InProgress  int       `json:"in_progress"`
+	BytesBefore int64     `json:"bytes_before"`
+	BytesAfter  int64     `json:"bytes_after"`
+	Expired     int       `json:"expired"`
+	Evicted     int       `json:"evicted"`
+	BytesFreed  int64     `json:"bytes_freed"`
+	Errors      []string  `json:"errors,omitempty"`
+}
+
+type janitorStatus struct {
+	Enabled         bool        `json:"enabled"`
+	MaxAgeHours     int         `json:"max_age_hours"`
+	QuotaMB         int         `json:"quota_mb"`
+	IntervalSeconds int         `json:"interval_seconds"`
+	Running         bool        `json:"running"`
+	NextRun         *time.Time  `json:"next_run,omitempty"`
+	LastRun         *janitorRun `json:"last_run,omitempty"`
+}
+
+type cacheJanitor struct {
+	mu      sync.Mutex
+	running bool
+	nextRun time.Time
+	lastRun *janitorRun
+}
+
+var janitor cacheJanitor
+
+// how long after a recorded download another goes unrecorded
+const downloadRecordInterval = time.Minute
+
+func initJanitor() {
+	if config.cacheMaxAge.value == 0 && config.cacheQuota.value == 0 {
+		log.Printf("INFO: no cache max age or quota set; finished pdfs are kept until deleted")
+		return
+	}
+
+	go janitor.loop()
+}
+
+func (j *cacheJanitor) loop() {
+	interval := time.Duration(config.janitorInterval.value) * time.Second
+
+	for {
+		j.mu.Lock()
+		j.nextRun = time.Now().Add(interval)
+		j.mu.Unlock()
+
+		time.Sleep(interval)
+
+		j.run()
+	}
+}
+
+func (j *cacheJanitor) status() janitorStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	status := janitorStatus{
+		Enabled:         config.cacheMaxAge.value > 0 || config.cacheQuota.value > 0,
+		MaxAgeHours:     config.cacheMaxAge.value,
+		QuotaMB:         config.cacheQuota.value,
+		IntervalSeconds: config.janitorInterval.value,
+		Running:         j.running,
+		LastRun:         j.lastRun,
+	}
+
+	if status.Enabled == true && j.running == false {
+		next := j.nextRun
+		status.NextRun = &next
+	}
+
+	return status
+}
+
+// removes finished pdfs not used within the max age, then the least recently used
+// ones until the storage directory is within its quota
+func (j *cacheJanitor) run() {
+	j.mu.Lock()
+	j.running = true
+	j.mu.Unlock()
+
+	run := janitorRun{Started: time.Now()}
+
+	dirs, err := scanWorkDirs()
+	if err != nil {
+		log.Printf("ERROR: janitor: unable to scan storage directory: %s", err.Error())
+		run.Errors = append(run.Errors, err.Error())
+	}
+
+	var candidates []*cachedWorkDir
+
+	for _, dir := range dirs {
+		run.WorkDirs++
+		run.BytesBefore += dir.size
+
+		if dir.finished == false || jobs.owns(dir.workSubDir) == true {
+			run.InProgress++
+			continue
+		}
+
+		candidates = append(candidates, dir)
+	}
+
+	// least recently used first
+	sort.Slice(candidates, func(a, b int) bool {
+		return candidates[a].lastUsed.Before(candidates[b].lastUsed)
+	})
+
+	total := run.BytesBefore
+	maxAge := time.Duration(config.cacheMaxAge.value) * time.Hour
+	quota := int64(config.cacheQuota.value) * 1024 * 1024
+
+	for _, dir := range candidates {
+		reason := ""
+
+		switch {
+		case maxAge > 0 && time.Since(dir.lastUsed) > maxAge:
+			reason = "expired"
+
+		case quota > 0 && total > quota:
+			reason = "over quota"
+
+		default:
+			continue
+		}
+
+		evicted, err := evictWorkDir(dir, reason)
+		if err != nil {
+			log.Printf("ERROR: janitor: unable to evict [%s]: %s", dir.workSubDir, err.Error())
+			run.Errors = append(run.Errors, fmt.Sprintf("%s: %s", dir.workSubDir, err.Error()))
+			continue
+		}
+
+		if evicted == false {
+			continue
+		}
+
+		if reason == "expired" {
+			run.Expired++
+		} else {
+			run.Evicted++
+		}
+
+		total -= dir.size
+		run.BytesFreed += dir.size
+	}
+
+	run.BytesAfter = total
+	run.Finished = time.Now()
+	run.Seconds = run.Finished.Sub(run.Started).Seconds()
+
+	if quota > 0 && total > quota {
+		log.Printf("WARNING: janitor: storage directory still over quota (%d of %d bytes) with nothing left to evict", total, quota)
+	}
+
+	log.Printf("INFO: janitor: scanned %d work directories (%d in progress); removed %d expired and %d over quota, freeing %d bytes",
+		run.WorkDirs, run.InProgress, run.Expired, run.Evicted, run.BytesFreed)
+
+	j.mu.Lock()
+	j.running = false
+	j.lastRun = &run
+	j.mu.Unlock()
+}
+
+// finds every work directory under the storage directory.  work directories may
+// contain others (a pid's directory holds those for its units), so each one only
+// accounts for its own files.
+func scanWorkDirs() ([]*cachedWorkDir, error) {
+	var dirs []*cachedWorkDir
+
+	root := config.storageDir.value
+
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			// work directories may be removed while we look at them
+			if os.IsNotExist(err) == true {
+				return nil
+			}
+			return err
+		}
+
+		if d.IsDir() == false {
+			return nil
+		}
+
+		// the queue, locks, webhooks, etc. are not work directories
+		if path != root && strings.HasPrefix(d.Name(), ".") == true {
+			return filepath.SkipDir
+		}
+
+		if path == root {
+			return nil
+		}
+
+		if dir := readWorkDir(root, path); dir != nil {
+			dirs = append(dirs, dir)
+		}
+
+		return nil
+	})
+
+	return dirs, err
+}
+
+// returns details of the work directory at this path, or nil if it is not one
+func readWorkDir(root, path string) *cachedWorkDir {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil
+	}
+
+	isWorkDir := false
+	dir := cachedWorkDir{}
+
+	for _, entry := range entries {
+		if entry.IsDir() == true {
+			continue
+		}
+
+		for _, marker := range workDirMarkers {
+			if entry.Name() == marker {
+				isWorkDir = true
+			}
+		}
+
+		if fi, err := entry.Info(); err == nil {
+			dir.size += fi.Size()
+		}
+	}
+
+	if isWorkDir == false {
+		return nil
+	}
+
+	dir.workSubDir, _ = filepath.Rel(root, path)
+	dir.workSubDir = filepath.ToSlash(dir.workSubDir)
+
+	c := clientContext{reqID: "janitor"}
+	c.pdf.workSubDir = dir.workSubDir
+	c.pdf.workDir = path
+
+	state := c.loadState()
+	if state == nil || (state.State != "ready" && state.State != "failed") {
+		return &dir
+	}
+
+	dir.finished = true
+	dir.lastUsed = state.Updated
+
+	if state.Finished != nil {
+		dir.lastUsed = *state.Finished
+	}
+
+	if state.Downloaded != nil && state.Downloaded.After(dir.lastUsed) {
+		dir.lastUsed = *state.Downloaded
+	}
+
+	return &dir
+}
+
+// removes a finished job's pdf and work directory, unless it has been picked up
+// again since the scan.  returns true if it was removed.
+func evictWorkDir(dir *cachedWorkDir, reason string) (bool, error) {
+	unlock, err := lockWorkSubDir(dir.workSubDir)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	c := clientContext{reqID: "janitor"}
+	c.pdf.workSubDir = dir.workSubDir
+	c.pdf.workDir = getWorkDir(dir.workSubDir)
+
+	if (c.isDone() == false && c.isFailed() == false) || jobs.owns(dir.workSubDir) == true {
+		log.Printf("INFO: janitor: [%s] is in progress again; leaving it", dir.workSubDir)
+		return false, nil
+	}
+
+	c.removeStoredPdf()
+
+	// only this directory's own files; any subdirectories are work directories of their own
+	entries, err := os.ReadDir(c.pdf.workDir)
+	if err != nil {
+		return false, err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() == true {
+			continue
+		}
+
+		if err := os.Remove(fmt.Sprintf("%s/%s", c.pdf.workDir, entry.Name())); err != nil && os.IsNotExist(err) == false {
+			return false, err
+		}
+	}
+
+	os.Remove(c.pdf.workDir)
+
+	log.Printf("INFO: janitor: evicted [%s] (%s; %d bytes; last used %s)", dir.workSubDir, reason, dir.size, dir.lastUsed.Format(time.RFC3339))
+
+	return true, nil
+}
+
+// records when the pdf was last downloaded, for least recently used eviction.  the
+// time only needs to be roughly right, so it is not rewritten for every download.
+func (c *clientContext) recordDownload() {
+	if state := c.loadState(); state != nil && state.Downloaded != nil && time.Since(*state.Downloaded) < downloadRecordInterval {
+		return
+	}
+
+	c.updateState(func(state *jobState) {
+		now := time.Now()
+		state.Downloaded = &now
+	})
+}
+
+// Handle a request for /admin/cache: the cache limits and the results of the last cleanup run
+func cacheStatusHandler(c *gin.Context) {
+	output, jsonErr := json.Marshal(janitor.status())
+	if jsonErr != nil {
+		log.Printf("ERROR: failed to serialize output: [%s]", jsonErr.Error())
+		c.String(http.StatusInternalServerError, "")
+		return
+	}
+
+	c.Data(http.StatusOK, gin.MIMEJSON, output)
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a pdf generation request waiting for (or being processed by) a worker.
+// exported fields are persisted to the on-disk queue so that pending
+// jobs survive a restart; lookup results are only kept in memory.
+type pdfJob struct {
+	ID         string    `json:"id"`
+	ReqID      string    `json:"req_id"`
+	IP         string    `json:"ip"`
+	Pid        string    `json:"pid"`
+	Unit       string    `json:"unit,omitempty"`
+	Pages      string    `json:"pages,omitempty"`
+	Token      string    `json:"token,omitempty"`
+	Cover      string    `json:"cover,omitempty"`
+	Format     string    `json:"format,omitempty"`
+	Ocr        string    `json:"ocr,omitempty"`
+	WorkSubDir string    `json:"work_sub_dir"`
+	Queued     time.Time `json:"queued"`
+	Attempts   int       `json:"attempts"`
+
+	ts    *tsPidInfo
+	solr  *solrInfo
+	merge *mergeInfo
+
+	// set while the job is running; cancelling stops its downloads and child processes
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type jobQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	dir     string
+	pending []*pdfJob
+	running map[string]*pdfJob
+}
+
+var jobs *jobQueue
+
+func initJobQueue() {
+	var err error
+	if jobs, err = newJobQueue(fmt.Sprintf("%s/.queue", config.storageDir.value)); err != nil {
+		log.Fatalf("failed to create job queue directory: %s", err.Error())
+	}
+
+	log.Printf("INFO: job owner instance: %s", instanceID)
+
+	jobs.restore()
+
+	go jobs.heartbeat()
+
+	for i := 1; i <= config.workerCount.value; i++ {
+		go jobs.worker(i)
+	}
+
+	log.Printf("INFO: started %d pdf generation workers", config.workerCount.value)
+
+	// look for work abandoned by crashed instances, now and from time to time, as
+	// no one may be polling the status of their jobs
+	go func() {
+		for {
+			recoverStaleJobs()
+			time.Sleep(heartbeatInterval())
+		}
+	}()
+}
+
+func newJobQueue(dir string) (*jobQueue, error) {
+	q := &jobQueue{
+		dir:     dir,
+		running: make(map[string]*pdfJob),
+	}
+	q.cond = sync.NewCond(&q.mu)
+
+	if err := os.MkdirAll(q.dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+func (j *pdfJob) fileName() string {
+	return fmt.Sprintf("%020d-%s.json", j.Queued.UnixNano(), j.ID)
+}
+
+// reloads jobs persisted by a previous run, in the order they were queued
+func (q *jobQueue) restore() {
+	files, err := filepath.Glob(fmt.Sprintf("%s/*.json", q.dir))
+	if err != nil {
+		log.Printf("WARNING: unable to list job queue directory [%s]: %s", q.dir, err.Error())
+		return
+	}
+
+	sort.Strings(files)
+
+	for _, file := range files {
+		buf, err := os.ReadFile(file)
+		if err != nil {
+			log.Printf("WARNING: unable to read queued job [%s]: %s", file, err.Error())
+			continue
+		}
+
+		var job pdfJob
+		if err := json.Unmarshal(buf, &job); err != nil {
+			log.Printf("WARNING: removing unparseable queued job [%s]: %s", file, err.Error())
+			os.Remove(file)
+			continue
+		}
+
+		// jobs queued by older versions did not record their work directory
+		if job.WorkSubDir == "" {
+			job.WorkSubDir = getWorkSubDir(job.Pid, job.Unit, job.Token)
+		}
+
+		// the queue directory may be shared with other instances; leave their jobs alone,
+		// but take back any left by an earlier run on this host, however recent
+		if owner, err := readJobOwner(getWorkDir(job.WorkSubDir)); err == nil && owner.isAlive() == true && owner.isPreviousRun() == false {
+			continue
+		}
+
+		q.pending = append(q.pending, &job)
+
+		writeJobOwner(&job)
+	}
+
+	if len(q.pending) > 0 {
+		log.Printf("INFO: restored %d queued jobs", len(q.pending))
+	}
+}
+
+func (q *jobQueue) enqueue(c *clientContext) error {
+	return q.add(&pdfJob{
+		ID:         c.reqID,
+		ReqID:      c.reqID,
+		IP:         c.ip,
+		Pid:        c.req.pid,
+		Unit:       c.req.unit,
+		Pages:      c.req.pages,
+		Token:      c.req.token,
+		Cover:      c.req.cover,
+		Format:     c.req.format,
+		Ocr:        c.req.ocr,
+		WorkSubDir: c.pdf.workSubDir,
+		Queued:     time.Now(),
+		ts:         c.pdf.ts,
+		solr:       c.pdf.solr,
+		merge:      c.pdf.merge,
+	})
+}
+
+// queues another attempt at a job that was abandoned by its previous owner
+func (q *jobQueue) requeue(job *pdfJob) error {
+	q.complete(job)
+
+	job.Queued = time.Now()
+	job.Attempts++
+
+	return q.add(job)
+}
+
+func (q *jobQueue) add(job *pdfJob) error {
+	buf, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := writeFileAtomic(fmt.Sprintf("%s/%s", q.dir, job.fileName()), buf); err != nil {
+		return err
+	}
+
+	q.pending = append(q.pending, job)
+	q.cond.Signal()
+
+	writeJobOwner(job)
+
+	newJobContext(job).info("queued job %s at position %d", job.ID, len(q.pending))
+
+	return nil
+}
+
+// returns true if this instance has the job for this work directory queued or running
+func (q *jobQueue) owns(workSubDir string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.running[workSubDir] != nil {
+		return true
+	}
+
+	for _, job := range q.pending {
+		if job.WorkSubDir == workSubDir {
+			return true
+		}
+	}
+
+	return false
+}
+
+// returns the 1-based queue position of the job for this work directory, or 0 if not queued
+func (q *jobQueue) position(workSubDir string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, job := range q.pending {
+		if job.WorkSubDir == workSubDir {
+			return i + 1
+		}
+	}
+
+	return 0
+}
+
+// returns true if this instance is currently running the job for this work directory
+func (q *jobQueue) isRunning(workSubDir string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.running[workSubDir] != nil
+}
+
+// removes the pending job for this work directory, or stops it if it is running
+// here, returning true if there was one
+func (q *jobQueue) cancel(workSubDir string) bool {
+	q.mu.Lock()
+
+	if running := q.running[workSubDir]; running != nil {
+		running.cancel()
+		q.mu.Unlock()
+		return true
+	}
+
+	var job *pdfJob
+	for _, pending := range q.pending {
+		if pending.WorkSubDir == workSubDir {
+			job = pending
+			break
+		}
+	}
+
+	q.mu.Unlock()
+
+	if job == nil {
+		return false
+	}
+
+	q.complete(job)
+
+	// everyone still waiting may have moved up a place
+	q.mu.Lock()
+	for _, pending := range q.pending {
+		progressEvents.publish(pending.WorkSubDir, nil)
+	}
+	q.mu.Unlock()
+
+	return true
+}
+
+// blocks until a job is available, then removes it from the pending list
+func (q *jobQueue) next() *pdfJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.pending) == 0 {
+		q.cond.Wait()
+	}
+
+	job := q.pending[0]
+	q.pending = q.pending[1:]
+	q.running[job.WorkSubDir] = job
+
+	job.ctx, job.cancel = context.WithCancel(context.Background())
+
+	// everyone still waiting has moved up a place
+	for _, pending := range q.pending {
+		progressEvents.publish(pending.WorkSubDir, nil)
+	}
+
+	return job
+}
+
+// forgets about a job without touching its persisted copy
+func (q *jobQueue) release(job *pdfJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.running[job.WorkSubDir] == job {
+		delete(q.running, job.WorkSubDir)
+	}
+
+	for i, pending := range q.pending {
+		if pending == job {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			break
+		}
+	}
+}
+
+// removes the persisted copy of a job once it has been processed
+func (q *jobQueue) complete(job *pdfJob) {
+	q.release(job)
+
+	file := fmt.Sprintf("%s/%s", q.dir, job.fileName())
+	if err := os.Remove(file); err != nil && os.IsNotExist(err) == false {
+		log.Printf("WARNING: unable to remove queued job [%s]: %s", file, err.Error())
+	}
+}
+
+func (q *jobQueue) worker(n int) {
+	for {
+		job := q.next()
+
+		c := newJobContext(job)
+
+		if q.claim(job) == false {
+			c.info("worker %d: job %s is held by another instance; skipping", n, job.ID)
+			job.cancel()
+			q.release(job)
+			continue
+		}
+
+		go q.watchForCancel(job, c.pdf.workDir)
+
+		c.info("worker %d: starting job %s (queued %0.2f seconds ago)", n, job.ID, time.Since(job.Queued).Seconds())
+
+		c.runJob()
+
+		job.cancel()
+		q.complete(job)
+	}
+}
+
+// takes ownership of a job before running it, unless another live instance
+// sharing the storage directory has already done so
+func (q *jobQueue) claim(job *pdfJob) bool {
+	unlock, err := lockWorkSubDir(job.WorkSubDir)
+	if err != nil {
+		log.Printf("WARNING: unable to claim job %s for [%s]: %s", job.ID, job.WorkSubDir, err.Error())
+		return false
+	}
+	defer unlock()
+
+	if q.heldElsewhere(job) == true {
+		return false
+	}
+
+	writeJobOwner(job)
+
+	return true
+}
+
+func (q *jobQueue) heldElsewhere(job *pdfJob) bool {
+	return ownedElsewhere(job.WorkSubDir)
+}
+
+// periodically refreshes the owner record of every job held by this instance
+func (q *jobQueue) heartbeat() {
+	for {
+		time.Sleep(heartbeatInterval())
+
+		q.mu.Lock()
+		pending := append([]*pdfJob{}, q.pending...)
+		running := []*pdfJob{}
+		for _, job := range q.running {
+			running = append(running, job)
+		}
+		q.mu.Unlock()
+
+		// another instance restoring the same shared queue may have picked up a
+		// pending job first; if so, it is theirs now
+		for _, job := range pending {
+			if q.heldElsewhere(job) == true {
+				log.Printf("INFO: job %s for [%s] is held by another instance; dropping it", job.ID, job.WorkSubDir)
+				q.release(job)
+				continue
+			}
+
+			writeJobOwner(job)
+		}
+
+		for _, job := range running {
+			writeJobOwner(job)
+		}
+	}
+}
+
+func (c *clientContext) runJob() {
+	// a job restored from a previous run may have already finished, or may
+	// have had its work directory removed while it was waiting
+	if c.isDone() == true || c.isFailed() == true {
+		c.info("job for [%s] already finished; skipping", c.pdf.workSubDir)
+		return
+	}
+
+	if _, err := os.Stat(c.pdf.workDir); err != nil {
+		c.warn("working directory [%s] vanished; skipping job", c.pdf.workDir)
+		return
+	}
+
+	// cancelled while queued, possibly by a request to another instance
+	if _, err := os.Stat(cancelFile(c.pdf.workDir)); err == nil {
+		c.finishCancelled()
+		return
+	}
+
+	// lookups are not persisted, so jobs restored from disk need to redo them
+	if c.pdf.ts == nil {
+		if res := c.tsGetPidInfo(); res.err != nil {
+			c.err("tracksys API: %s", res.err.Error())
+			c.setFailed(fmt.Sprintf("Could not retrieve PID info: %s", res.err.Error()))
+			return
+		}
+
+		if err := c.solrGetInfo(); err != nil {
+			c.warn("solr error: %s", err.Error())
+			c.warn("generating PDF without a cover page in directory: %s", c.pdf.workDir)
+		}
+	}
+
+	c.generatePdf()
+
+	if c.cancelled() == true && c.isDone() == false {
+		c.finishCancelled()
+	}
+}
+
+// records a failure, unless the job has been cancelled; anything going wrong
+// after that is just the generation being torn down
+func (c *clientContext) setFailed(reason string) {
+	if c.cancelled() == true {
+		c.info("job cancelled; not recording failure: %s", reason)
+		return
+	}
+
+	c.recordFailure(reason)
+}
+
+func (c *clientContext) recordFailure(reason string) {
+	c.updateState(func(state *jobState) {
+		now := time.Now()
+
+		state.State = "failed"
+		state.Finished = &now
+		state.Error = strings.TrimSpace(reason)
+	})
+
+	progressEvents.publish(c.pdf.workSubDir, nil)
+
+	c.fireCallbacks("failed", reason)
+}
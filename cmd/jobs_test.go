@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// a job queued just before a restart is picked up again by the restarted service,
+// without waiting for it to be considered abandoned, and runs to completion
+func TestQueueSurvivesRestart(t *testing.T) {
+	setupTestService(t)
+
+	if w := serve("GET", "/pdf/book1?embed=1", nil); w.Code != http.StatusOK {
+		t.Fatalf("generate: got %d: %s", w.Code, w.Body.String())
+	}
+
+	if status := serve("GET", "/pdf/book1/status", nil).Body.String(); status != "QUEUED 1" {
+		t.Fatalf("status before restart: got [%s], want [QUEUED 1]", status)
+	}
+
+	// the same process restarting gets a new instance id, and a new queue
+	previous := instanceID
+	initInstanceID()
+	if instanceID == previous {
+		t.Fatalf("instance id unchanged across restart: %s", instanceID)
+	}
+
+	restarted, err := newJobQueue(jobs.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs = restarted
+
+	jobs.restore()
+
+	if len(jobs.pending) != 1 {
+		t.Fatalf("restored %d jobs, want 1", len(jobs.pending))
+	}
+
+	go jobs.worker(1)
+
+	if status := waitForStatus(t, "book1", 30*time.Second); status != "READY" {
+		t.Fatalf("status after restart: got [%s], want [READY]", status)
+	}
+
+	if w := serve("GET", "/pdf/book1/download", nil); w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Fatalf("download: got %d with %d bytes", w.Code, w.Body.Len())
+	}
+}
+
+// jobs held by a live instance on another host sharing the storage directory are
+// left to that instance
+func TestQueueRestoreLeavesOtherInstances(t *testing.T) {
+	setupTestService(t)
+
+	if w := serve("GET", "/pdf/book1?embed=1", nil); w.Code != http.StatusOK {
+		t.Fatalf("generate: got %d: %s", w.Code, w.Body.String())
+	}
+
+	// the job now belongs to a live instance elsewhere
+	instanceID = "otherhost-1234-00000001"
+	writeJobOwner(jobs.pending[0])
+
+	initInstanceID()
+
+	restarted, err := newJobQueue(jobs.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs = restarted
+
+	jobs.restore()
+
+	if len(jobs.pending) != 0 {
+		t.Fatalf("restored %d jobs held by another host, want 0", len(jobs.pending))
+	}
+}
+
+func TestParseInstanceID(t *testing.T) {
+	tests := []struct {
+		id   string
+		host string
+		pid  int
+		ok   bool
+	}{
+		{"web1-42-0badf00d", "web1", 42, true},
+		{"pdf-ws-7c9f-1-deadbeef", "pdf-ws-7c9f", 1, true},
+		{"web1-x-0badf00d", "", 0, false},
+		{"web1", "", 0, false},
+	}
+
+	for _, test := range tests {
+		host, pid, ok := parseInstanceID(test.id)
+		if host != test.host || pid != test.pid || ok != test.ok {
+			t.Errorf("%s: got (%s, %d, %v), want (%s, %d, %v)", test.id, host, pid, ok, test.host, test.pid, test.ok)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// the request that created a job, recorded in its state so that the job can
+// be found again by id alone
+type jobRequest struct {
+	Pid    string `json:"pid"`
+	Unit   string `json:"unit,omitempty"`
+	Pages  string `json:"pages,omitempty"`
+	Token  string `json:"token,omitempty"`
+	Cover  string `json:"cover,omitempty"`
+	Format string `json:"format,omitempty"`
+	Ocr    string `json:"ocr,omitempty"`
+}
+
+// the body of a POST /jobs request
+type jobCreateRequest struct {
+	jobRequest
+	Callback string `json:"callback,omitempty"`
+}
+
+// a job is identified by its work directory, so the same pdf always has the same id
+func jobID(workSubDir string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(workSubDir))
+}
+
+func workSubDirFromJobID(id string) (string, bool) {
+	buf, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil || len(buf) == 0 {
+		return "", false
+	}
+
+	workSubDir := string(buf)
+
+	// only work directories; not the queue, locks, etc.
+	if isValidWorkSubDir(workSubDir) == false {
+		return "", false
+	}
+
+	return workSubDir, true
+}
+
+func (c *clientContext) jobURL() string {
+	return fmt.Sprintf("/jobs/%s", jobID(c.pdf.workSubDir))
+}
+
+// restores the original request options of a job found by id
+func (c *clientContext) loadJobRequest() {
+	req := c.legacyJobRequest()
+	if state := c.loadState(); state != nil && state.Request.Pid != "" {
+		req = state.Request
+	}
+
+	c.req.pid = req.Pid
+	c.req.unit = req.Unit
+	c.req.pages = req.Pages
+	c.req.token = req.Token
+	c.req.cover = req.Cover
+	c.req.format = req.Format
+	c.req.ocr = req.Ocr
+
+	if c.req.cover == "" {
+		c.req.cover = config.coverPosition.value
+	}
+
+	if c.req.format == "" {
+		c.req.format = config.pdfFormat.value
+	}
+}
+
+// creates a context for the job named in the request, or returns nil if there is no such job
+func newJobIDContext(ctx *gin.Context) *clientContext {
+	c := clientContext{}
+
+	c.ctx = ctx
+	c.reqID = randomHex(4)
+	c.ip = c.ctx.ClientIP()
+
+	c.logRequest()
+
+	workSubDir, ok := workSubDirFromJobID(c.ctx.Param("id"))
+	if ok == false {
+		c.err("invalid job id: [%s]", c.ctx.Param("id"))
+		c.respondJSON(http.StatusNotFound, gin.H{"job_id": c.ctx.Param("id"), "state": "not_found"})
+		return nil
+	}
+
+	c.pdf.workSubDir = workSubDir
+	c.pdf.workDir = getWorkDir(workSubDir)
+
+	c.loadJobRequest()
+
+	return &c
+}
+
+// the json status of this job, with urls pointing at the job api
+func (c *clientContext) getJobStatus() pdfStatus {
+	status := c.getStatus()
+
+	if status.DownloadURL != "" {
+		status.DownloadURL = fmt.Sprintf("%s/file", c.jobURL())
+	}
+
+	return status
+}
+
+func (c *clientContext) respondJobNotFound() {
+	c.respondJSON(http.StatusNotFound, gin.H{"job_id": jobID(c.pdf.workSubDir), "state": "not_found"})
+}
+
+/**
+ * Handle a request to create a job: POST /jobs with a json body
+ */
+func createJobHandler(ctx *gin.Context) {
+	c := newClientContext(ctx)
+
+	var req jobCreateRequest
+	if err := json.NewDecoder(c.ctx.Request.Body).Decode(&req); err != nil {
+		c.err("unable to parse job request: %s", err.Error())
+		c.respondJSON(http.StatusBadRequest, gin.H{"error": "Invalid job request"})
+		return
+	}
+
+	if isValidPathSegment(req.Pid) == false || (req.Token != "" && isValidPathSegment(req.Token) == false) {
+		c.err("invalid job request: pid [%s] token [%s]", req.Pid, req.Token)
+		c.respondJSON(http.StatusBadRequest, gin.H{"error": "Invalid PID or token"})
+		return
+	}
+
+	c.req.pid = req.Pid
+	c.req.unit = req.Unit
+	c.req.pages = req.Pages
+	c.req.token = req.Token
+	c.req.cover = req.Cover
+	c.req.format = req.Format
+	c.req.ocr = req.Ocr
+	c.req.callback = req.Callback
+
+	if c.req.cover == "" {
+		c.req.cover = config.coverPosition.value
+	}
+
+	if c.req.format == "" {
+		c.req.format = config.pdfFormat.value
+	}
+
+	// partial pdfs need their own work directory
+	if c.req.pages != "" && c.req.token == "" {
+		c.req.token = randomHex(8)
+	}
+
+	c.initPdfInfo()
+
+	if res := c.createJob(); res.err != nil {
+		c.respondJSON(res.status, gin.H{"error": strings.TrimSpace(res.msg)})
+		return
+	}
+
+	status := c.getJobStatus()
+
+	code := http.StatusAccepted
+	if status.State == "ready" {
+		code = http.StatusOK
+	}
+
+	c.ctx.Header("Location", c.jobURL())
+	c.respondJSON(code, status)
+}
+
+func getJobHandler(ctx *gin.Context) {
+	c := newJobIDContext(ctx)
+	if c == nil {
+		return
+	}
+
+	if c.progressInValidState() == false {
+		c.respondJobNotFound()
+		return
+	}
+
+	c.respondJSON(http.StatusOK, c.getJobStatus())
+}
+
+func jobFileHandler(ctx *gin.Context) {
+	c := newJobIDContext(ctx)
+	if c == nil {
+		return
+	}
+
+	if c.progressInValidState() == false {
+		c.respondJobNotFound()
+		return
+	}
+
+	if c.isDone() == false {
+		c.respondJSON(http.StatusConflict, c.getJobStatus())
+		return
+	}
+
+	c.sendPdf()
+}
+
+func deleteJobHandler(ctx *gin.Context) {
+	c := newJobIDContext(ctx)
+	if c == nil {
+		return
+	}
+
+	if _, err := os.Stat(c.pdf.workDir); err != nil {
+		c.respondJobNotFound()
+		return
+	}
+
+	c.deleteJob()
+
+	c.respondJSON(http.StatusAccepted, pdfStatus{JobID: jobID(c.pdf.workSubDir), Pid: c.req.pid, State: "deleted"})
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the longest conversion log kept in the job state; the end is the interesting part
+const maxConversionLog = 64 * 1024
+
+// everything known about a job, kept in job.json in its work directory.  the file
+// is only ever replaced as a whole, so readers never see a partial update.
+type jobState struct {
+	State         string     `json:"state"` // processing, ready, or failed
+	Percent       int        `json:"percent"`
+	Stage         string     `json:"stage,omitempty"`
+	Step          int        `json:"step"`
+	Steps         int        `json:"steps"`
+	PagesDone     int        `json:"pages_done"`
+	PagesTotal    int        `json:"pages_total"`
+	Created       time.Time  `json:"created"`
+	Updated       time.Time  `json:"updated"`
+	Started       *time.Time `json:"started,omitempty"`
+	Finished      *time.Time `json:"finished,omitempty"`
+	Downloaded    *time.Time `json:"downloaded,omitempty"`
+	Request       jobRequest `json:"request"`
+	Pages         []string   `json:"pages,omitempty"`     // tracksys page pids, in order
+	Output        string     `json:"output,omitempty"`    // location of the finished pdf (see pdfStorage)
+	FileName      string     `json:"file_name,omitempty"` // name the pdf is downloaded as
+	Size          int64      `json:"size,omitempty"`
+	Checksum      string     `json:"checksum,omitempty"` // sha256 of the pdf
+	Error         string     `json:"error,omitempty"`
+	ConversionLog string     `json:"conversion_log,omitempty"`
+
+	// fingerprints of the content the pdf was generated from, and when they were last
+	// compared against tracksys and solr (see contentChanged)
+	PagesFingerprint string     `json:"pages_fingerprint,omitempty"`
+	CoverFingerprint string     `json:"cover_fingerprint,omitempty"`
+	Checked          *time.Time `json:"checked,omitempty"`
+}
+
+// serialize read-modify-write updates to job state within this process.  work
+// directories are spread over a fixed set of locks, so that updating one job's
+// state does not hold up every other job.
+var jobStateLocks [64]sync.Mutex
+
+func jobStateLock(workDir string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(workDir))
+
+	return &jobStateLocks[h.Sum32()%uint32(len(jobStateLocks))]
+}
+
+// marker files used by older versions, replaced by job.json
+var legacyStateFiles = []string{"progress.txt", "progress.json", "done.txt", "fail.txt", "convert.txt", "request.json", "downloaded.txt"}
+
+func jobStateFile(workDir string) string {
+	return fmt.Sprintf("%s/job.json", workDir)
+}
+
+// returns the state of the job in this work directory, or nil if there is none
+func (c *clientContext) loadState() *jobState {
+	buf, err := os.ReadFile(jobStateFile(c.pdf.workDir))
+	if err != nil {
+		if os.IsNotExist(err) == false {
+			c.err("unable to read job state: %s", err.Error())
+			return nil
+		}
+
+		return c.migrateState()
+	}
+
+	var state jobState
+	if err := json.Unmarshal(buf, &state); err != nil {
+		c.err("unable to parse job state: %s", err.Error())
+		return nil
+	}
+
+	return &state
+}
+
+func (c *clientContext) saveState(state *jobState) error {
+	state.Updated = time.Now()
+
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(jobStateFile(c.pdf.workDir), buf)
+}
+
+// applies a change to the job state, creating it if need be
+func (c *clientContext) updateState(change func(state *jobState)) {
+	lock := jobStateLock(c.pdf.workDir)
+	lock.Lock()
+	defer lock.Unlock()
+
+	state := c.loadState()
+	if state == nil {
+		state = c.newState()
+	}
+
+	change(state)
+
+	if err := c.saveState(state); err != nil {
+		c.err("unable to write job state: %s", err.Error())
+	}
+}
+
+func (c *clientContext) newState() *jobState {
+	return &jobState{
+		State:   "processing",
+		Created: time.Now(),
+		Request: jobRequest{
+			Pid:    c.req.pid,
+			Unit:   c.req.unit,
+			Pages:  c.req.pages,
+			Token:  c.req.token,
+			Cover:  c.req.cover,
+			Format: c.req.format,
+			Ocr:    c.req.ocr,
+		},
+	}
+}
+
+// records a fresh job about to be queued, replacing anything left by a previous attempt
+func (c *clientContext) initState() {
+	state := c.newState()
+
+	state.Stage = "queued"
+	state.Steps = -1
+	state.PagesTotal = len(c.pdf.ts.Pages)
+
+	for _, page := range c.pdf.ts.Pages {
+		state.Pages = append(state.Pages, page.Pid)
+	}
+
+	lock := jobStateLock(c.pdf.workDir)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := c.saveState(state); err != nil {
+		c.err("unable to write job state: %s", err.Error())
+	}
+
+	c.removeLegacyState()
+}
+
+// records the in-memory progress of a running job
+func (s *jobState) setProgress(progress jobProgress) {
+	s.Stage = progress.Stage
+	s.Step = progress.Step
+	s.Steps = progress.Steps
+	s.PagesDone = progress.PagesDone
+	s.PagesTotal = progress.PagesTotal
+
+	if progress.Steps > 0 {
+		s.Percent = (100 * progress.Step) / progress.Steps
+	}
+
+	if progress.Started.IsZero() == false {
+		started := progress.Started
+		s.Started = &started
+	}
+}
+
+func (c *clientContext) setReady(location string, size int64, checksum string) {
+	c.updateState(func(state *jobState) {
+		now := time.Now()
+
+		state.State = "ready"
+		state.Finished = &now
+		state.Output = location
+		state.FileName = fmt.Sprintf("%s.pdf", c.req.pid)
+		state.Size = size
+		state.Checksum = checksum
+		state.Error = ""
+		state.PagesFingerprint = c.pagesFingerprint()
+		state.CoverFingerprint = c.coverFingerprint()
+		state.Checked = &now
+	})
+}
+
+func (c *clientContext) setConversionLog(out []byte) {
+	if len(out) > maxConversionLog {
+		out = out[len(out)-maxConversionLog:]
+	}
+
+	c.updateState(func(state *jobState) {
+		state.ConversionLog = string(out)
+	})
+}
+
+// builds the job state from the marker files written by older versions.  finished
+// jobs are converted for good; anything else may still be in the hands of an older
+// instance, so it is only read.
+func (c *clientContext) migrateState() *jobState {
+	legacy := false
+	for _, name := range legacyStateFiles {
+		if _, err := os.Stat(fmt.Sprintf("%s/%s", c.pdf.workDir, name)); err == nil {
+			legacy = true
+			break
+		}
+	}
+
+	if legacy == false {
+		return nil
+	}
+
+	state := jobState{State: "processing", Request: c.legacyJobRequest()}
+
+	if fi, err := os.Stat(c.pdf.workDir); err == nil {
+		state.Created = fi.ModTime()
+	}
+
+	if buf, err := os.ReadFile(fmt.Sprintf("%s/progress.json", c.pdf.workDir)); err == nil {
+		var progress jobProgress
+		if err := json.Unmarshal(buf, &progress); err == nil {
+			state.setProgress(progress)
+		}
+	} else if buf, err := os.ReadFile(fmt.Sprintf("%s/progress.txt", c.pdf.workDir)); err == nil {
+		state.Percent, _ = strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(string(buf)), "%"))
+	}
+
+	if t := fileModTime(fmt.Sprintf("%s/progress.txt", c.pdf.workDir)); t != nil {
+		state.Updated = *t
+	}
+
+	if buf, err := os.ReadFile(fmt.Sprintf("%s/convert.txt", c.pdf.workDir)); err == nil {
+		state.ConversionLog = string(buf)
+	}
+
+	if t := fileModTime(fmt.Sprintf("%s/downloaded.txt", c.pdf.workDir)); t != nil {
+		state.Downloaded = t
+	}
+
+	doneFile := fmt.Sprintf("%s/done.txt", c.pdf.workDir)
+	failFile := fmt.Sprintf("%s/fail.txt", c.pdf.workDir)
+
+	if buf, err := os.ReadFile(doneFile); err == nil {
+		state.State = "ready"
+		state.Percent = 100
+		state.Stage = "finished"
+		state.Finished = fileModTime(doneFile)
+		state.Output = legacyPdfLocation(strings.TrimSpace(string(buf)))
+		state.FileName = filepath.Base(state.Output)
+
+		if backend, err := storageFor(state.Output); err == nil {
+			if pdf, err := backend.stat(context.Background(), state.Output); err == nil {
+				state.Size = pdf.size
+			}
+		}
+	} else if buf, err := os.ReadFile(failFile); err == nil {
+		state.State = "failed"
+		state.Finished = fileModTime(failFile)
+		state.Error = strings.TrimSpace(string(buf))
+	}
+
+	if state.State == "processing" {
+		return &state
+	}
+
+	c.info("migrating job state from marker files in [%s]", c.pdf.workDir)
+
+	updated := state.Updated
+	if err := c.saveState(&state); err != nil {
+		c.warn("unable to save migrated job state: %s", err.Error())
+		state.Updated = updated
+		return &state
+	}
+
+	c.removeLegacyState()
+
+	return &state
+}
+
+// the request recorded by an older version, if any, or the pid (and unit) from the
+// work directory name, which is the best that can be recovered without one
+func (c *clientContext) legacyJobRequest() jobRequest {
+	var req jobRequest
+
+	if buf, err := os.ReadFile(fmt.Sprintf("%s/request.json", c.pdf.workDir)); err == nil {
+		if err := json.Unmarshal(buf, &req); err == nil && req.Pid != "" {
+			return req
+		}
+	}
+
+	parts := strings.SplitN(c.pdf.workSubDir, "/", 2)
+	req = jobRequest{Pid: parts[0]}
+	if len(parts) > 1 {
+		req.Unit = parts[1]
+	}
+
+	return req
+}
+
+// converts a pdf path recorded in a done file into a storage location.  very old
+// versions recorded paths under "tmp/", and later ones absolute paths under the
+// storage directory; both become paths relative to the storage directory.
+func legacyPdfLocation(pdfFile string) string {
+	if strings.HasPrefix(pdfFile, "tmp/") {
+		return strings.TrimPrefix(pdfFile, "tmp/")
+	}
+
+	if rel, err := filepath.Rel(config.storageDir.value, pdfFile); err == nil && strings.HasPrefix(rel, "..") == false {
+		return filepath.ToSlash(rel)
+	}
+
+	return pdfFile
+}
+
+func (c *clientContext) removeLegacyState() {
+	for _, name := range legacyStateFiles {
+		if err := os.Remove(fmt.Sprintf("%s/%s", c.pdf.workDir, name)); err != nil && os.IsNotExist(err) == false {
+			c.warn("unable to remove legacy state file %s: %s", name, err.Error())
+		}
+	}
+}
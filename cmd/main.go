@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"math/rand"
 	"net/http"
 	"time"
 
@@ -15,7 +14,6 @@ import (
 const version = "2.3.0"
 
 var client *http.Client
-var randomSource *rand.Rand
 
 /**
  * Main entry point for the web service
@@ -28,14 +26,37 @@ func main() {
 	// load version details
 	initVersion()
 
-	// initialize http client and random source
+	// initialize http client
 	client = &http.Client{Timeout: 10 * time.Second}
-	randomSource = rand.New(rand.NewSource(time.Now().UnixNano()))
+	initInstanceID()
+	initHostLimits()
+	initStorage()
+
+	// start the pdf generation workers, picking up any jobs left over from a previous run
+	initJobQueue()
+
+	// resume delivery of any completion callbacks left over from a previous run
+	initWebhooks()
+
+	// finish starting any batches interrupted by a previous run
+	initBatches()
+
+	// periodically remove old pdfs, if limits are set
+	initJanitor()
 
 	// Set routes and start server
 	gin.SetMode(gin.ReleaseMode)
 	gin.DisableConsoleColor()
 
+	router := newRouter()
+
+	portStr := fmt.Sprintf(":%s", config.listenPort.value)
+	log.Printf("Start service on %s", portStr)
+
+	log.Fatal(router.Run(portStr))
+}
+
+func newRouter() *gin.Engine {
 	router := gin.Default()
 
 	corsCfg := cors.DefaultConfig()
@@ -50,16 +71,30 @@ func main() {
 	router.GET("/favicon.ico", ignoreHandler)
 	router.GET("/version", versionHandler)
 	router.GET("/healthcheck", healthCheckHandler)
+	router.GET("/admin/cache", cacheStatusHandler)
 
 	router.GET("/pdf/:pid", generateHandler)
+
+	// outside /pdf, so that they cannot take the place of a pid
+	router.GET("/merge", mergeHandler)
+	router.POST("/batch", batchHandler)
+	router.GET("/batch/:id", batchStatusHandler)
+	router.GET("/batch/:id/download", batchDownloadHandler)
 	router.GET("/pdf/:pid/status", statusHandler)
+	router.GET("/pdf/:pid/status.json", statusHandler)
+	router.GET("/pdf/:pid/events", eventsHandler)
 	router.GET("/pdf/:pid/download", downloadHandler)
+	router.HEAD("/pdf/:pid/download", downloadHandler)
 	router.GET("/pdf/:pid/delete", deleteHandler)
 
-	portStr := fmt.Sprintf(":%s", config.listenPort.value)
-	log.Printf("Start service on %s", portStr)
+	router.POST("/jobs", createJobHandler)
+	router.GET("/jobs/:id", getJobHandler)
+	router.GET("/jobs/:id/file", jobFileHandler)
+	router.HEAD("/jobs/:id/file", jobFileHandler)
+	router.DELETE("/jobs/:id", deleteJobHandler)
+	router.POST("/jobs/:id/cancel", cancelJobHandler)
 
-	log.Fatal(router.Run(portStr))
+	return router
 }
 
 // Handle a request for /
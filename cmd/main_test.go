@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+// returns a jpeg of the given size, shaded so that each page differs
+func testJPEG(t *testing.T, n, w, h int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * n), uint8(y), uint8(n * 40), 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// stands in for tracksys, the iiif server and solr, counting the requests made to each
+type fakeServices struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests map[string]int // by path, less the pid
+	pages    int            // number of pages in every item
+}
+
+// changes the number of pages in every item
+func (f *fakeServices) setPages(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.pages = n
+}
+
+// returns the number of requests made to a path (less the pid), e.g. "/api/fulltext"
+func (f *fakeServices) count(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.requests[path]
+}
+
+// every pid is a three page item (unless changed), except "missing", which tracksys has never heard of
+func newFakeServices(t *testing.T) *fakeServices {
+	fake := &fakeServices{requests: make(map[string]int), pages: 3}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/api/pid/", func(w http.ResponseWriter, r *http.Request) {
+		pid := strings.TrimPrefix(r.URL.Path, "/api/pid/")
+		if pid == "missing" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"id":1,"pid":"%s","type":"sirsi_metadata","title":"A Book"}`, pid)
+	})
+
+	mux.HandleFunc("/api/manifest/", func(w http.ResponseWriter, r *http.Request) {
+		fake.mu.Lock()
+		n := fake.pages
+		fake.mu.Unlock()
+
+		var pages []string
+		for i := 1; i <= n; i++ {
+			pages = append(pages, fmt.Sprintf(`{"id":%d,"pid":"page-%d","title":"Page %d","filename":"p%d.tif"}`, i, i, i, i))
+		}
+		fmt.Fprintf(w, "[%s]", strings.Join(pages, ","))
+	})
+
+	mux.HandleFunc("/api/fulltext/", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+
+	mux.HandleFunc("/iiif/", func(w http.ResponseWriter, r *http.Request) {
+		n := 1
+		fmt.Sscanf(strings.TrimPrefix(r.URL.Path, "/iiif/"), "page-%d", &n)
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(testJPEG(t, n, 40+n, 60))
+	})
+
+	mux.HandleFunc("/solr/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"response":{"numFound":1,"docs":[{"id":"u1","title_a":["A Book"],"author_facet_a":["Smith, John."]}]}}`)
+	})
+
+	fake.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fake.mu.Lock()
+		fake.requests[path.Dir(r.URL.Path)]++
+		fake.mu.Unlock()
+
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(fake.Close)
+
+	return fake
+}
+
+// configures the service as main would, against fake services and a fresh storage
+// directory, with a job queue but no workers.  returns the fake services.
+func setupTestService(t *testing.T) *fakeServices {
+	fake := newFakeServices(t)
+
+	config.storageDir.value = t.TempDir()
+	config.tsAPIHost.value = fake.URL
+	config.iiifURLTemplate.value = fake.URL + "/iiif/{PID}"
+	config.solrURLTemplate.value = fake.URL + "/solr/{PID}"
+	config.virgoURLTemplate.value = "https://example.com/items/{ID}"
+	config.templateDir.value = "../web"
+	config.assetsDir.value = "../assets"
+	config.pdfGenerator.value = "native"
+	config.coverPosition.value = "none"
+	config.pdfFormat.value = "pdf"
+	config.storageBackend.value = "local"
+	config.contentCheck.value = 300
+
+	client = &http.Client{Timeout: 10 * time.Second}
+	initInstanceID()
+	initHostLimits()
+	initStorage()
+
+	var err error
+	if jobs, err = newJobQueue(fmt.Sprintf("%s/.queue", config.storageDir.value)); err != nil {
+		t.Fatal(err)
+	}
+
+	// workers outlive the test, so let them finish with its settings first
+	t.Cleanup(func() { waitForRunningJobs(t, jobs) })
+
+	return fake
+}
+
+// waits for any jobs a queue's workers are running to finish
+func waitForRunningJobs(t *testing.T, q *jobQueue) {
+	deadline := time.Now().Add(30 * time.Second)
+
+	for {
+		q.mu.Lock()
+		running := len(q.running)
+		q.mu.Unlock()
+
+		if running == 0 {
+			return
+		}
+
+		if time.Now().After(deadline) == true {
+			t.Fatalf("%d jobs still running at the end of the test", running)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// sends a request through the service's routes
+func serve(method, target string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, req)
+
+	return w
+}
+
+// polls the status of a pdf until it is no longer in progress, returning the last status
+func waitForStatus(t *testing.T, pid string, timeout time.Duration) string {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		status := serve("GET", fmt.Sprintf("/pdf/%s/status", pid), nil).Body.String()
+		if strings.HasSuffix(status, "%") == false && strings.HasPrefix(status, "QUEUED") == false {
+			return status
+		}
+
+		if time.Now().After(deadline) == true {
+			t.Fatalf("pdf %s still in progress after %s: %s", pid, timeout, status)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
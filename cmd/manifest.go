@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// details of a page image already downloaded into the work directory
+type manifestPage struct {
+	Pid      string `json:"pid"`
+	URL      string `json:"url"`
+	File     string `json:"file"` // relative to the work directory
+	Size     int64  `json:"size"`
+	Checksum string `json:"sha256"`
+}
+
+// tracks downloaded page images so that a retry can skip pages it already has.
+// pages are recorded in memory as they are downloaded, and the manifest is written
+// out once the downloads are over, however they ended.
+type pageManifest struct {
+	mu      sync.Mutex
+	file    string
+	changed bool
+	Pages   map[string]manifestPage `json:"pages"`
+}
+
+func (c *clientContext) loadManifest() *pageManifest {
+	m := pageManifest{
+		file:  fmt.Sprintf("%s/manifest.json", c.pdf.workDir),
+		Pages: make(map[string]manifestPage),
+	}
+
+	buf, err := os.ReadFile(m.file)
+	if err != nil {
+		return &m
+	}
+
+	if err := json.Unmarshal(buf, &m); err != nil {
+		c.warn("ignoring unreadable page manifest: %s", err.Error())
+		m.Pages = make(map[string]manifestPage)
+	}
+
+	if m.Pages == nil {
+		m.Pages = make(map[string]manifestPage)
+	}
+
+	return &m
+}
+
+// returns the path to the previously downloaded image for this pid and url, if it is still intact
+func (m *pageManifest) lookup(pid, url string) (string, bool) {
+	m.mu.Lock()
+	page, ok := m.Pages[pid]
+	m.mu.Unlock()
+
+	if ok == false || page.URL != url {
+		return "", false
+	}
+
+	fileName := filepath.Join(filepath.Dir(m.file), page.File)
+
+	fi, err := os.Stat(fileName)
+	if err != nil || fi.Size() != page.Size {
+		return "", false
+	}
+
+	sum, _, err := fileChecksum(fileName)
+	if err != nil || sum != page.Checksum {
+		return "", false
+	}
+
+	return fileName, true
+}
+
+func (m *pageManifest) record(page manifestPage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	page.File = filepath.Base(page.File)
+	m.Pages[page.Pid] = page
+	m.changed = true
+}
+
+// writes out the manifest if any pages have been recorded since it was loaded
+func (m *pageManifest) save(c *clientContext) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.changed == false {
+		return
+	}
+
+	// nothing to do if the work directory was removed, e.g. by deleting the job
+	if _, err := os.Stat(filepath.Dir(m.file)); err != nil {
+		return
+	}
+
+	buf, err := json.Marshal(m)
+	if err != nil {
+		c.err("unable to serialize page manifest: %s", err.Error())
+		return
+	}
+
+	if err := writeFileAtomic(m.file, buf); err != nil {
+		c.err("unable to write page manifest: %s", err.Error())
+		return
+	}
+
+	m.changed = false
+}
+
+// returns the hex-encoded sha256 checksum and size of a file
+func fileChecksum(fileName string) (string, int64, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
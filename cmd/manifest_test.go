@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestManifestSavedOnce(t *testing.T) {
+	c := &clientContext{reqID: "test", ip: "-"}
+	c.pdf.workDir = t.TempDir()
+
+	m := c.loadManifest()
+
+	for i := 1; i <= 3; i++ {
+		fileName := fmt.Sprintf("%s/page-%d.jpg", c.pdf.workDir, i)
+		if err := os.WriteFile(fileName, []byte(fmt.Sprintf("image %d", i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		sum, size, err := fileChecksum(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m.record(manifestPage{Pid: fmt.Sprintf("page-%d", i), URL: fmt.Sprintf("http://iiif/page-%d", i), File: fileName, Size: size, Checksum: sum})
+	}
+
+	if _, err := os.Stat(m.file); os.IsNotExist(err) == false {
+		t.Fatalf("manifest written before the downloads were over")
+	}
+
+	m.save(c)
+
+	reloaded := c.loadManifest()
+
+	if _, ok := reloaded.lookup("page-2", "http://iiif/page-2"); ok == false {
+		t.Errorf("page-2 not found in saved manifest")
+	}
+
+	if _, ok := reloaded.lookup("page-2", "http://iiif/elsewhere"); ok == true {
+		t.Errorf("page-2 found for a different url")
+	}
+
+	// a page whose image has changed since is downloaded again
+	os.WriteFile(fmt.Sprintf("%s/page-3.jpg", c.pdf.workDir), []byte("image 9"), 0644)
+	if _, ok := reloaded.lookup("page-3", "http://iiif/page-3"); ok == true {
+		t.Errorf("page-3 reused after its image changed")
+	}
+
+	// nothing is written for a work directory that has been removed
+	os.RemoveAll(c.pdf.workDir)
+	reloaded.record(manifestPage{Pid: "page-4", File: "page-4.jpg"})
+	reloaded.save(c)
+	if _, err := os.Stat(c.pdf.workDir); os.IsNotExist(err) == false {
+		t.Errorf("saving the manifest recreated a removed work directory")
+	}
+}
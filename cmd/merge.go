@@ -0,0 +1,453 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// the most pids a merged pdf may combine
+const maxMergePids = 100
+
+// merged pdfs are requested, tracked and downloaded using a pseudo-pid naming their definition
+var mergePidPattern = regexp.MustCompile(`^merge-[0-9a-f]{16}$`)
+
+// an ordered list of pids to combine into one pdf, persisted under the storage directory
+type mergeDefinition struct {
+	ID      string    `json:"id"`
+	Pids    []string  `json:"pids"`
+	Covers  string    `json:"covers"` // combined (one cover for the whole pdf) or section (one per pid)
+	Created time.Time `json:"created"`
+}
+
+// lookup results for a merged pdf
+type mergeInfo struct {
+	covers   string
+	sections []pdfSection
+}
+
+// the pages of one pid within a merged pdf
+type pdfSection struct {
+	pid   string
+	title string
+	first int // index of its first page in the combined page list
+	pages int
+	ts    *tsPidInfo
+	solr  *solrInfo
+}
+
+// a run of output pages, with an optional cover page and bookmark of its own
+type pdfPart struct {
+	title  string     // bookmark title; blank unless the pdf is merged
+	cover  *coverPage // cover page for just this part, if any
+	images []pageImage
+}
+
+func isMergePid(pid string) bool {
+	return mergePidPattern.MatchString(pid)
+}
+
+func isValidMergeCovers(covers string) bool {
+	return covers == "combined" || covers == "section"
+}
+
+func mergeDir() string {
+	return fmt.Sprintf("%s/.merges", config.storageDir.value)
+}
+
+func mergeFile(id string) string {
+	return fmt.Sprintf("%s/%s.json", mergeDir(), id)
+}
+
+// the same pids and cover layout always produce the same definition, so repeated
+// requests share a work directory
+func newMergeDefinition(pids []string, covers string) *mergeDefinition {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%s", strings.Join(pids, ","), covers)))
+
+	return &mergeDefinition{
+		ID:      hex.EncodeToString(sum[:8]),
+		Pids:    pids,
+		Covers:  covers,
+		Created: time.Now(),
+	}
+}
+
+func (m *mergeDefinition) pid() string {
+	return fmt.Sprintf("merge-%s", m.ID)
+}
+
+func (m *mergeDefinition) save() error {
+	if _, err := os.Stat(mergeFile(m.ID)); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(mergeDir(), 0755); err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(mergeFile(m.ID), buf)
+}
+
+func loadMergeDefinition(pid string) (*mergeDefinition, error) {
+	if isMergePid(pid) == false {
+		return nil, os.ErrNotExist
+	}
+
+	buf, err := os.ReadFile(mergeFile(strings.TrimPrefix(pid, "merge-")))
+	if err != nil {
+		return nil, err
+	}
+
+	var m mergeDefinition
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+/**
+ * Handle a request to combine several pids into one pdf.  This records the list of
+ * pids, then redirects to the usual generation endpoint for the merged pseudo-pid
+ */
+func mergeHandler(ctx *gin.Context) {
+	c := newClientContext(ctx)
+
+	var pids []string
+	for _, pid := range strings.Split(c.ctx.Query("pids"), ",") {
+		if pid = strings.TrimSpace(pid); pid != "" {
+			pids = append(pids, pid)
+		}
+	}
+
+	covers := c.ctx.DefaultQuery("covers", "combined")
+
+	if len(pids) < 2 {
+		c.err("merge request has %d pids", len(pids))
+		c.respondString(http.StatusBadRequest, "At least two PIDs are required")
+		return
+	}
+
+	if len(pids) > maxMergePids {
+		c.err("merge request has %d pids", len(pids))
+		c.respondString(http.StatusBadRequest, fmt.Sprintf("Too many PIDs (at most %d per merged PDF)", maxMergePids))
+		return
+	}
+
+	for _, pid := range pids {
+		if isValidPathSegment(pid) == false || isMergePid(pid) == true {
+			c.err("invalid pid in merge request: [%s]", pid)
+			c.respondString(http.StatusBadRequest, fmt.Sprintf("Invalid PID: %s", pid))
+			return
+		}
+	}
+
+	if isValidMergeCovers(covers) == false {
+		c.err("invalid merge covers option: [%s]", covers)
+		c.respondString(http.StatusBadRequest, "Invalid covers option")
+		return
+	}
+
+	if c.req.unit != "" {
+		c.err("unit requested for merged pdf")
+		c.respondString(http.StatusBadRequest, "Units are not supported for merged PDFs")
+		return
+	}
+
+	if msg := c.checkOptions(); msg != "" {
+		c.respondString(http.StatusBadRequest, msg)
+		return
+	}
+
+	// the helper script only knows how to add a single cover page
+	if covers == "section" && config.pdfGenerator.value != "native" {
+		c.err("per-section covers requested, but the %s generator is configured", config.pdfGenerator.value)
+		c.respondString(http.StatusBadRequest, "Per-section cover pages are not available")
+		return
+	}
+
+	m := newMergeDefinition(pids, covers)
+
+	if err := m.save(); err != nil {
+		c.err("unable to save merge definition %s: %s", m.ID, err.Error())
+		c.respondString(http.StatusInternalServerError, "ERROR: failed to initialize merged PDF")
+		return
+	}
+
+	// everything else about the request (token, format, embed, callback, etc.) carries over
+	query := c.ctx.Request.URL.Query()
+	query.Del("pids")
+	query.Del("covers")
+
+	location := fmt.Sprintf("/pdf/%s", m.pid())
+	if len(query) > 0 {
+		location = fmt.Sprintf("%s?%s", location, query.Encode())
+	}
+
+	c.info("merging %d pids as %s", len(pids), m.pid())
+	c.logResponse(http.StatusSeeOther, location)
+	c.ctx.Redirect(http.StatusSeeOther, location)
+}
+
+// creates a copy of this context for looking up one of the pids in a merged pdf
+func (c *clientContext) subContext(pid string) *clientContext {
+	sc := *c
+
+	sc.req.pid = pid
+	sc.req.unit = ""
+	sc.pdf.ts = nil
+	sc.pdf.solr = nil
+	sc.pdf.merge = nil
+
+	return &sc
+}
+
+func (c *clientContext) sectionContext(i int) *clientContext {
+	section := c.pdf.merge.sections[i]
+
+	sc := c.subContext(section.pid)
+	sc.pdf.ts = section.ts
+	sc.pdf.solr = section.solr
+
+	return sc
+}
+
+// looks up each pid of a merged pdf in tracksys, combining their pages in order
+func (c *clientContext) tsGetMergeInfo() tsResult {
+	m, err := loadMergeDefinition(c.req.pid)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) == true {
+			return tsResult{status: http.StatusNotFound, err: fmt.Errorf("unknown merged PDF: %s", c.req.pid)}
+		}
+		return tsResult{status: http.StatusInternalServerError, err: fmt.Errorf("unable to read merged PDF definition: %s", err.Error())}
+	}
+
+	ts := tsPidInfo{Pid: tsGenericPidInfo{Pid: c.req.pid, Type: "merge"}}
+	merge := mergeInfo{covers: m.Covers}
+
+	for _, pid := range m.Pids {
+		sc := c.subContext(pid)
+
+		if res := sc.tsGetPidInfo(); res.err != nil {
+			return tsResult{status: res.status, err: fmt.Errorf("%s: %s", pid, res.err.Error())}
+		}
+
+		merge.sections = append(merge.sections, pdfSection{
+			pid:   pid,
+			title: strings.TrimSpace(sc.pdf.ts.Pid.Title),
+			first: len(ts.Pages),
+			pages: len(sc.pdf.ts.Pages),
+			ts:    sc.pdf.ts,
+		})
+
+		ts.Pages = append(ts.Pages, sc.pdf.ts.Pages...)
+	}
+
+	c.info("merged pdf %s combines %d pids with %d pages", c.req.pid, len(m.Pids), len(ts.Pages))
+
+	c.pdf.ts = &ts
+	c.pdf.merge = &merge
+
+	ts.Pid.Title = c.mergedTitle()
+
+	return tsResult{status: http.StatusOK}
+}
+
+// looks up each pid of a merged pdf in solr.  the first record found stands in for
+// the whole pdf where a single record is needed, e.g. to pick a cover template.
+func (c *clientContext) solrGetMergeInfo() error {
+	if c.pdf.merge == nil {
+		return errors.New("merged PDF has not been looked up in tracksys")
+	}
+
+	c.pdf.solr = nil
+
+	for i := range c.pdf.merge.sections {
+		section := &c.pdf.merge.sections[i]
+
+		sc := c.subContext(section.pid)
+
+		if err := sc.solrGetInfo(); err != nil {
+			c.warn("solr error for %s: %s", section.pid, err.Error())
+			continue
+		}
+
+		section.solr = sc.pdf.solr
+
+		if title := firstElementOf(sc.pdf.solr.Response.Docs[0].Title); title != "" {
+			section.title = title
+		}
+
+		if c.pdf.solr == nil {
+			c.pdf.solr = sc.pdf.solr
+		}
+	}
+
+	c.pdf.ts.Pid.Title = c.mergedTitle()
+
+	if c.pdf.solr == nil {
+		return errors.New("no solr records found for merged PDF")
+	}
+
+	return nil
+}
+
+func (s *pdfSection) displayTitle() string {
+	if s.title != "" {
+		return s.title
+	}
+
+	return s.pid
+}
+
+func (c *clientContext) mergedTitle() string {
+	var titles []string
+	for _, section := range c.pdf.merge.sections {
+		titles = append(titles, section.displayTitle())
+	}
+
+	return strings.Join(titles, "; ")
+}
+
+// returns which section of a merged pdf a page belongs to (always 0 if not merged)
+func (c *clientContext) pageSection(page int) int {
+	if c.pdf.merge == nil {
+		return 0
+	}
+
+	for i, section := range c.pdf.merge.sections {
+		if page >= section.first && page < section.first+section.pages {
+			return i
+		}
+	}
+
+	return 0
+}
+
+// splits the pages into the parts of the output document: a single part
+// normally, or one per pid (with its own cover page, if requested) when merged
+func (c *clientContext) documentParts(images []pageImage) []pdfPart {
+	if c.pdf.merge == nil {
+		return []pdfPart{{images: images}}
+	}
+
+	parts := make([]pdfPart, len(c.pdf.merge.sections))
+
+	for _, image := range images {
+		parts[image.section].images = append(parts[image.section].images, image)
+	}
+
+	var nonEmpty []pdfPart
+
+	for i, part := range parts {
+		section := c.pdf.merge.sections[i]
+
+		// a pid whose pages could not be downloaded is left out altogether
+		if len(part.images) == 0 {
+			c.warn("no pages for %s; leaving it out of the merged PDF", section.pid)
+			continue
+		}
+
+		part.title = section.displayTitle()
+
+		if c.pdf.merge.covers == "section" {
+			part.cover = c.sectionContext(i).getCoverPage()
+		}
+
+		nonEmpty = append(nonEmpty, part)
+	}
+
+	return nonEmpty
+}
+
+// builds one cover page describing every pid in a merged pdf, using the
+// template selected for the first of them
+func (c *clientContext) getMergedCoverPage() *coverPage {
+	if c.pdf.merge.covers != "combined" || c.pdf.solr == nil || c.req.cover == "none" {
+		return nil
+	}
+
+	doc := c.pdf.solr.Response.Docs[0]
+	data := c.getCoverData(&doc)
+
+	var titles, authors, years, citations []string
+	seen := make(map[string]bool)
+
+	for i, section := range c.pdf.merge.sections {
+		titles = append(titles, section.displayTitle())
+
+		if section.solr == nil {
+			continue
+		}
+
+		sectionDoc := section.solr.Response.Docs[0]
+		sectionData := c.sectionContext(i).getCoverData(&sectionDoc)
+
+		if sectionData.Author != "" && seen["author:"+sectionData.Author] == false {
+			seen["author:"+sectionData.Author] = true
+			authors = append(authors, sectionData.Author)
+		}
+
+		if sectionData.Year != "" && seen["year:"+sectionData.Year] == false {
+			seen["year:"+sectionData.Year] = true
+			years = append(years, sectionData.Year)
+		}
+
+		citations = append(citations, sectionData.Citation)
+	}
+
+	data.Title = strings.Join(titles, "\n")
+	data.Author = strings.Join(authors, "; ")
+	data.Year = strings.Join(years, ", ")
+	data.Citation = strings.Join(citations, "\n")
+
+	return c.renderCoverPage(&doc, data)
+}
+
+// adjusts the metadata of a merged pdf to describe all of its pids
+func (c *clientContext) mergePdfMetadata(meta *pdfMetadata) {
+	meta.title = c.mergedTitle()
+	meta.authors = nil
+	meta.published = ""
+	meta.catalogID = ""
+	meta.virgoURL = ""
+
+	seen := make(map[string]bool)
+	rights := make(map[string]bool)
+
+	for _, section := range c.pdf.merge.sections {
+		if section.solr == nil {
+			continue
+		}
+
+		doc := section.solr.Response.Docs[0]
+
+		for _, author := range doc.AuthorFacet {
+			if seen[author] == false {
+				seen[author] = true
+				meta.authors = append(meta.authors, author)
+			}
+		}
+
+		rights[formatRights(firstElementOf(doc.RightsWrapper))] = true
+	}
+
+	// a rights statement only applies to the whole pdf if every pid shares it
+	if len(rights) != 1 {
+		meta.rights = ""
+	}
+}
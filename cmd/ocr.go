@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// a word recognized on a page image, with its bounding box in pixels
+type ocrWord struct {
+	text   string
+	left   int
+	top    int
+	width  int
+	height int
+}
+
+// determines whether this pdf gets a text layer: an explicit request
+// option wins, otherwise it depends on the record's collection
+func (c *clientContext) ocrEnabled() bool {
+	enabled := false
+
+	switch c.req.ocr {
+	case "1":
+		enabled = true
+
+	case "0":
+		enabled = false
+
+	default:
+		enabled = c.inOcrCollection()
+	}
+
+	if enabled == true && config.pdfGenerator.value != "native" {
+		c.warn("text layers require the native pdf generator; skipping ocr")
+		enabled = false
+	}
+
+	return enabled
+}
+
+func (c *clientContext) inOcrCollection() bool {
+	if config.ocrCollections.value == "" || c.pdf.solr == nil || len(c.pdf.solr.Response.Docs) == 0 {
+		return false
+	}
+
+	doc := c.pdf.solr.Response.Docs[0]
+
+	for _, collection := range doc.fieldValues(config.ocrField.value) {
+		for _, name := range strings.Split(config.ocrCollections.value, ",") {
+			if strings.EqualFold(strings.TrimSpace(name), collection) == true {
+				c.info("ocr enabled for collection [%s]", collection)
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// recognizes the text on each downloaded page lacking a transcription, using a
+// bounded number of concurrent ocr processes, recording the results with each
+// image.  pages that cannot be recognized are left without text.
+func (c *clientContext) ocrPages(images []pageImage, step *int, steps int) error {
+	// each image is recognized once, however many pages use it
+	var recognized onceGroup[string]
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	aborted := false
+	indexes := make(chan int)
+
+	for w := 0; w < config.ocrWorkers.value; w++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for i := range indexes {
+				// stop as soon as the job is cancelled or deleted
+				if c.cancelled() == true {
+					mu.Lock()
+					aborted = true
+					mu.Unlock()
+					continue
+				}
+
+				// pages with a tracksys transcription do not need ocr
+				tsvFile := ""
+				if images[i].text == "" {
+					var err error
+					if tsvFile, err = recognized.do(images[i].file, func() (string, error) { return c.ocrPage(images[i].file) }); err != nil {
+						c.warn("ocr failed for %s: %s; continuing", images[i].file, err.Error())
+					}
+				}
+
+				mu.Lock()
+				images[i].ocr = tsvFile
+				c.pdf.progress.PagesDone++
+				*step++
+				c.updateProgress(*step, steps)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for i := range images {
+		mu.Lock()
+		stop := aborted
+		mu.Unlock()
+
+		if stop == true {
+			break
+		}
+
+		indexes <- i
+	}
+
+	close(indexes)
+	wg.Wait()
+
+	if aborted == true || c.cancelled() == true {
+		c.warn("job cancelled; abandoning ocr")
+		return errors.New("job cancelled")
+	}
+
+	return nil
+}
+
+// runs ocr on a page image, producing a tsv file of recognized words alongside it.
+// results from a previous attempt are reused if they are newer than the image.
+func (c *clientContext) ocrPage(jpgFile string) (string, error) {
+	base := strings.TrimSuffix(jpgFile, ".jpg")
+	tsvFile := base + ".tsv"
+
+	if jpg, err := os.Stat(jpgFile); err == nil {
+		if tsv, err := os.Stat(tsvFile); err == nil && tsv.ModTime().Before(jpg.ModTime()) == false {
+			c.info("reusing ocr results: %s", tsvFile)
+			return tsvFile, nil
+		}
+	}
+
+	// tesseract <image> <output base> -l <lang> tsv
+	args := strings.Fields(config.ocrCommand.value)
+	args = append(args, jpgFile, base, "-l", config.ocrLanguage.value, "tsv")
+
+	out, err := c.command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		os.Remove(tsvFile)
+		return "", fmt.Errorf("%s (%s)", err.Error(), strings.TrimSpace(string(out)))
+	}
+
+	if _, err := os.Stat(tsvFile); err != nil {
+		return "", fmt.Errorf("no ocr output produced")
+	}
+
+	return tsvFile, nil
+}
+
+// reads the recognized words from a tesseract tsv file
+func readOcrWords(tsvFile string) ([]ocrWord, error) {
+	f, err := os.Open(tsvFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var words []ocrWord
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		// level page_num block_num par_num line_num word_num left top width height conf text
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 12 || fields[0] != "5" {
+			continue
+		}
+
+		text := strings.TrimSpace(fields[11])
+		if text == "" {
+			continue
+		}
+
+		var nums [4]int
+		valid := true
+		for i := range nums {
+			if nums[i], err = strconv.Atoi(fields[6+i]); err != nil {
+				valid = false
+			}
+		}
+
+		if valid == false || nums[2] <= 0 || nums[3] <= 0 {
+			continue
+		}
+
+		words = append(words, ocrWord{text: text, left: nums[0], top: nums[1], width: nums[2], height: nums[3]})
+	}
+
+	return words, scanner.Err()
+}
+
+// builds content stream operators that place each word invisibly (text render
+// mode 3) over its location on the page, stretched to fill its bounding box, so
+// that it can be searched and selected.  scale converts image pixels to points.
+func ocrTextLayer(words []ocrWord, font *pdfFont, scale, pageHeight float64) []byte {
+	var b bytes.Buffer
+
+	b.WriteString("BT\n3 Tr\n")
+
+	for _, word := range words {
+		size := float64(word.height) * scale
+		width := font.textWidth(word.text, size)
+		if width <= 0 {
+			continue
+		}
+
+		// place the baseline near the bottom of the box, allowing for descenders
+		x := float64(word.left) * scale
+		y := pageHeight - float64(word.top+word.height)*scale + size*0.2
+
+		fmt.Fprintf(&b, "/F1 %s Tf %s Tz 1 0 0 1 %s %s Tm %s Tj\n", pdfNumber(size),
+			pdfNumber(100*float64(word.width)*scale/width), pdfNumber(x), pdfNumber(y), pdfLiteral(font.encode(word.text)))
+	}
+
+	b.WriteString("ET\n")
+
+	return b.Bytes()
+}
+
+// builds content stream operators that place a page's transcription invisibly
+// across the page.  transcriptions carry no word positions, so the lines are
+// simply spread down the page, shrinking the text if needed to fit them all.
+func transcriptionTextLayer(text string, font *pdfFont, width, height float64) []byte {
+	margin := width * 0.05
+	size := 10.0
+
+	lines := font.wrapText(text, size, width-2*margin)
+
+	// shrink until everything fits; the text is invisible, so legibility is not a concern
+	for float64(len(lines))*size*coverLineSpacing > height-2*margin && size > 1 {
+		size = size * 0.8
+		lines = font.wrapText(text, size, width-2*margin)
+	}
+
+	var b bytes.Buffer
+
+	b.WriteString("BT\n3 Tr\n")
+	fmt.Fprintf(&b, "/F1 %s Tf\n", pdfNumber(size))
+
+	for i, line := range lines {
+		if line == "" {
+			continue
+		}
+
+		y := height - margin - float64(i+1)*size*coverLineSpacing
+		fmt.Fprintf(&b, "1 0 0 1 %s %s Tm %s Tj\n", pdfNumber(margin), pdfNumber(y), pdfLiteral(font.encode(line)))
+	}
+
+	b.WriteString("ET\n")
+
+	return b.Bytes()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestInOcrCollection(t *testing.T) {
+	solr := solrInfo{Response: solrResponse{NumFound: 1, Docs: []solrDoc{{
+		ID: "u1",
+		fields: map[string]interface{}{
+			"collection_a":         []interface{}{"Special Stuff"},
+			"digital_collection_f": "Daily Progress",
+		},
+	}}}}
+
+	tests := []struct {
+		field       string
+		collections string
+		want        bool
+	}{
+		{"collection_a", "", false},
+		{"collection_a", "special stuff", true},
+		{"collection_a", "Other, Special Stuff ", true},
+		{"collection_a", "Daily Progress", false},
+		{"digital_collection_f", "Daily Progress", true},
+		{"missing_field", "Special Stuff", false},
+	}
+
+	defer func() {
+		config.ocrField.value = ""
+		config.ocrCollections.value = ""
+	}()
+
+	for _, test := range tests {
+		config.ocrField.value = test.field
+		config.ocrCollections.value = test.collections
+
+		c := &clientContext{reqID: "test", ip: "-"}
+		c.pdf.solr = &solr
+
+		if got := c.inOcrCollection(); got != test.want {
+			t.Errorf("%s in [%s]: got %v, want %v", test.field, test.collections, got, test.want)
+		}
+	}
+}
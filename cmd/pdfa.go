@@ -0,0 +1,582 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+func isValidPdfFormat(format string) bool {
+	switch format {
+	case "pdf", "pdfa":
+		return true
+	}
+
+	return false
+}
+
+// builds a version 2 ICC profile for the sRGB color space, used as the PDF/A
+// output intent.  it is generated rather than shipped so there is no external
+// file to go missing, and is the same for every pdf.
+func srgbProfile() []byte {
+	type tag struct {
+		sig  string
+		data []byte
+	}
+
+	s15 := func(b *bytes.Buffer, v float64) {
+		binary.Write(b, binary.BigEndian, int32(math.Round(v*65536)))
+	}
+
+	xyz := func(x, y, z float64) []byte {
+		var b bytes.Buffer
+		b.WriteString("XYZ \x00\x00\x00\x00")
+		s15(&b, x)
+		s15(&b, y)
+		s15(&b, z)
+		return b.Bytes()
+	}
+
+	text := func(s string) []byte {
+		var b bytes.Buffer
+		b.WriteString("text\x00\x00\x00\x00")
+		b.WriteString(s)
+		b.WriteByte(0)
+		return b.Bytes()
+	}
+
+	desc := func(s string) []byte {
+		var b bytes.Buffer
+		b.WriteString("desc\x00\x00\x00\x00")
+		binary.Write(&b, binary.BigEndian, uint32(len(s)+1))
+		b.WriteString(s)
+		b.WriteByte(0)
+		// empty unicode and scriptcode descriptions
+		b.Write(make([]byte, 4+4+2+1+67))
+		return b.Bytes()
+	}
+
+	// the sRGB tone response curve, sampled
+	var curve bytes.Buffer
+	curve.WriteString("curv\x00\x00\x00\x00")
+	binary.Write(&curve, binary.BigEndian, uint32(1024))
+	for i := 0; i < 1024; i++ {
+		v := float64(i) / 1023
+		if v <= 0.04045 {
+			v = v / 12.92
+		} else {
+			v = math.Pow((v+0.055)/1.055, 2.4)
+		}
+		binary.Write(&curve, binary.BigEndian, uint16(math.Round(v*65535)))
+	}
+
+	// colorants are adapted to the D50 profile connection space
+	tags := []tag{
+		{"desc", desc("sRGB IEC61966-2.1")},
+		{"cprt", text("No copyright, use freely")},
+		{"wtpt", xyz(0.9505, 1.0, 1.0891)},
+		{"rXYZ", xyz(0.4361, 0.2225, 0.0139)},
+		{"gXYZ", xyz(0.3851, 0.7169, 0.0971)},
+		{"bXYZ", xyz(0.1431, 0.0606, 0.7141)},
+		{"rTRC", curve.Bytes()},
+		{"gTRC", curve.Bytes()},
+		{"bTRC", curve.Bytes()},
+	}
+
+	// lay out tag data after the header and tag table, on 4 byte boundaries
+	offset := 128 + 4 + 12*len(tags)
+	offsets := make([]int, len(tags))
+	for i, t := range tags {
+		offsets[i] = offset
+		offset += (len(t.data) + 3) &^ 3
+	}
+
+	var b bytes.Buffer
+
+	binary.Write(&b, binary.BigEndian, uint32(offset)) // profile size
+	b.WriteString("\x00\x00\x00\x00")                  // preferred cmm
+	b.WriteString("\x02\x10\x00\x00")                  // version 2.1
+	b.WriteString("mntrRGB XYZ ")                      // class, color space, connection space
+	for _, v := range []uint16{2000, 1, 1, 0, 0, 0} {  // creation date
+		binary.Write(&b, binary.BigEndian, v)
+	}
+	b.WriteString("acsp")
+	b.Write(make([]byte, 4+4+4+4+8+4)) // platform, flags, manufacturer, model, attributes, intent
+	s15(&b, 0.9642)                    // D50 illuminant
+	s15(&b, 1.0)
+	s15(&b, 0.8249)
+	b.Write(make([]byte, 4+16+28)) // creator, id, reserved
+
+	binary.Write(&b, binary.BigEndian, uint32(len(tags)))
+	for i, t := range tags {
+		b.WriteString(t.sig)
+		binary.Write(&b, binary.BigEndian, uint32(offsets[i]))
+		binary.Write(&b, binary.BigEndian, uint32(len(t.data)))
+	}
+
+	for _, t := range tags {
+		b.Write(t.data)
+		b.Write(make([]byte, ((len(t.data)+3)&^3)-len(t.data)))
+	}
+
+	return b.Bytes()
+}
+
+// declares the color space the page images are intended for, as PDF/A requires
+func (p *pdfWriter) addOutputIntent() {
+	profileObj := p.stream(0, "/N 3 /Filter /FlateDecode", deflate(srgbProfile()))
+
+	intentObj := p.object(0, fmt.Sprintf("<< /Type /OutputIntent /S /GTS_PDFA1 /OutputConditionIdentifier (sRGB IEC61966-2.1) /Info (sRGB IEC61966-2.1) /RegistryName (http://www.color.org) /DestOutputProfile %d 0 R >>", profileObj))
+
+	p.catalog = append(p.catalog, fmt.Sprintf("/OutputIntents [%d 0 R]", intentObj))
+}
+
+// sanity checks a pdf produced by the native generator against the PDF/A-2b
+// requirements it could plausibly violate, then runs the external validator, if one
+// is configured.  only the external validator actually verifies conformance.
+func (c *clientContext) validatePdfA(pdfFile string) error {
+	problems := sanityCheckPdfA(pdfFile)
+
+	if len(problems) == 0 && config.pdfaValidator.value != "" {
+		args := strings.Fields(config.pdfaValidator.value)
+		args = append(args, pdfFile)
+
+		out, err := c.command(args[0], args[1:]...).CombinedOutput()
+		if err != nil {
+			c.err("external PDF/A validator output: %s", string(out))
+			problems = append(problems, fmt.Sprintf("external validator failed (%s)", err.Error()))
+		}
+	}
+
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			c.err("PDF/A check: %s", problem)
+		}
+		return fmt.Errorf("PDF/A validation failed: %s", strings.Join(problems, "; "))
+	}
+
+	if config.pdfaValidator.value == "" {
+		c.info("PDF/A sanity check passed (conformance not verified; no external validator configured)")
+		return nil
+	}
+
+	c.info("PDF/A validation passed")
+
+	return nil
+}
+
+// a pdf object as found in the file: its dictionary (or other body), and stream data if any
+type pdfObject struct {
+	dict   string
+	stream []byte
+}
+
+// a reader for the files written by pdfWriter: an uncompressed cross-reference
+// table, and objects whose dictionaries are written on a single line
+type pdfReader struct {
+	f       *os.File
+	size    int64
+	offsets []int64
+	trailer string
+}
+
+var (
+	pdfRefRegex     = regexp.MustCompile(`^(\d+) 0 R`)
+	pdfStartXref    = regexp.MustCompile(`startxref\s+(\d+)\s+%%EOF\s*$`)
+	pdfObjHeader    = regexp.MustCompile(`^(\d+) 0 obj\n`)
+	pdfLengthRegex  = regexp.MustCompile(`/Length (\d+)`)
+	pdfNameKeyRegex = regexp.MustCompile(`/[A-Za-z0-9]+`)
+)
+
+func openPdfReader(fileName string) (*pdfReader, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	r := pdfReader{f: f, size: fi.Size()}
+
+	tailSize := int64(1024)
+	if tailSize > r.size {
+		tailSize = r.size
+	}
+
+	tail := make([]byte, tailSize)
+	if _, err := f.ReadAt(tail, r.size-tailSize); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	m := pdfStartXref.FindSubmatch(tail)
+	if m == nil {
+		f.Close()
+		return nil, errors.New("missing startxref or end of file marker")
+	}
+
+	xrefOffset, _ := strconv.ParseInt(string(m[1]), 10, 64)
+	if xrefOffset <= 0 || xrefOffset >= r.size {
+		f.Close()
+		return nil, errors.New("invalid startxref offset")
+	}
+
+	xref, err := io.ReadAll(io.NewSectionReader(f, xrefOffset, r.size-xrefOffset))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	lines := strings.Split(string(xref), "\n")
+	if len(lines) < 3 || lines[0] != "xref" {
+		f.Close()
+		return nil, errors.New("missing cross-reference table")
+	}
+
+	var count int
+	if _, err := fmt.Sscanf(lines[1], "0 %d", &count); err != nil || len(lines) < 2+count+1 {
+		f.Close()
+		return nil, errors.New("invalid cross-reference table")
+	}
+
+	r.offsets = make([]int64, count)
+	for i := 1; i < count; i++ {
+		r.offsets[i], _ = strconv.ParseInt(lines[2+i][:10], 10, 64)
+	}
+
+	r.trailer = strings.Join(lines[2+count:], "\n")
+
+	return &r, nil
+}
+
+func (r *pdfReader) close() {
+	r.f.Close()
+}
+
+// reads an object, including its stream data (for small streams only, unless all is set)
+func (r *pdfReader) object(n int, all bool) (*pdfObject, error) {
+	if n <= 0 || n >= len(r.offsets) || r.offsets[n] <= 0 || r.offsets[n] >= r.size {
+		return nil, fmt.Errorf("object %d is missing from the cross-reference table", n)
+	}
+
+	br := io.NewSectionReader(r.f, r.offsets[n], r.size-r.offsets[n])
+
+	head := make([]byte, 64)
+	k, _ := io.ReadFull(br, head)
+	head = head[:k]
+
+	m := pdfObjHeader.FindSubmatch(head)
+	if m == nil || string(m[1]) != strconv.Itoa(n) {
+		return nil, fmt.Errorf("object %d is not at its cross-reference offset", n)
+	}
+
+	// dictionaries are written on one line, followed by "stream" or "endobj"
+	start := r.offsets[n] + int64(len(m[0]))
+	line, err := readLine(io.NewSectionReader(r.f, start, r.size-start))
+	if err != nil {
+		return nil, fmt.Errorf("object %d is truncated", n)
+	}
+
+	obj := pdfObject{dict: line}
+
+	next, err := readLine(io.NewSectionReader(r.f, start+int64(len(line))+1, r.size-start-int64(len(line))-1))
+	if err != nil {
+		return nil, fmt.Errorf("object %d is truncated", n)
+	}
+
+	if next != "stream" {
+		return &obj, nil
+	}
+
+	lm := pdfLengthRegex.FindStringSubmatch(line)
+	if lm == nil {
+		return nil, fmt.Errorf("stream object %d has no length", n)
+	}
+
+	length, _ := strconv.ParseInt(lm[1], 10, 64)
+	dataStart := start + int64(len(line)) + 1 + int64(len("stream\n"))
+
+	end := make([]byte, len("\nendstream\nendobj"))
+	if _, err := r.f.ReadAt(end, dataStart+length); err != nil || string(end) != "\nendstream\nendobj" {
+		return nil, fmt.Errorf("stream object %d length does not match its data", n)
+	}
+
+	if all == true || length <= 64*1024 {
+		obj.stream = make([]byte, length)
+		if _, err := r.f.ReadAt(obj.stream, dataStart); err != nil {
+			return nil, fmt.Errorf("stream object %d is truncated", n)
+		}
+	}
+
+	return &obj, nil
+}
+
+func readLine(r io.Reader) (string, error) {
+	var b bytes.Buffer
+	buf := make([]byte, 4096)
+
+	for {
+		n, err := r.Read(buf)
+		if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+			b.Write(buf[:i])
+			return b.String(), nil
+		}
+		b.Write(buf[:n])
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// returns the object number referenced by a dictionary key, or zero if there is none
+func pdfDictRef(dict, key string) int {
+	i := strings.Index(dict, key+" ")
+	if i < 0 {
+		return 0
+	}
+
+	m := pdfRefRegex.FindStringSubmatch(dict[i+len(key)+1:])
+	if m == nil {
+		return 0
+	}
+
+	n, _ := strconv.Atoi(m[1])
+	return n
+}
+
+// returns the decoded text string value of a dictionary key, if present
+func pdfDictString(dict, key string) (string, bool) {
+	i := strings.Index(dict, key+" ")
+	if i < 0 {
+		return "", false
+	}
+
+	v := dict[i+len(key)+1:]
+
+	switch {
+	case strings.HasPrefix(v, "<FEFF"):
+		end := strings.IndexByte(v, '>')
+		if end < 0 {
+			return "", false
+		}
+
+		hex := v[5:end]
+		var units []uint16
+		for j := 0; j+4 <= len(hex); j += 4 {
+			u, _ := strconv.ParseUint(hex[j:j+4], 16, 16)
+			units = append(units, uint16(u))
+		}
+		return string(utf16.Decode(units)), true
+
+	case strings.HasPrefix(v, "("):
+		var b strings.Builder
+		for j := 1; j < len(v); j++ {
+			switch v[j] {
+			case '\\':
+				j++
+				if j < len(v) {
+					switch v[j] {
+					case 'n':
+						b.WriteByte('\n')
+					case 'r':
+						b.WriteByte('\r')
+					default:
+						b.WriteByte(v[j])
+					}
+				}
+			case ')':
+				return b.String(), true
+			default:
+				b.WriteByte(v[j])
+			}
+		}
+	}
+
+	return "", false
+}
+
+// returns the text of the first occurrence of an XMP property, unescaped
+func xmpValue(xmp, property string) (string, bool) {
+	re := regexp.MustCompile(`(?s)<` + regexp.QuoteMeta(property) + `>(?:<rdf:(?:Alt|Seq|Bag)><rdf:li[^>]*>)?(.*?)<`)
+
+	m := re.FindStringSubmatch(xmp)
+	if m == nil {
+		return "", false
+	}
+
+	var v string
+	if err := xml.Unmarshal([]byte("<v>"+m[1]+"</v>"), &v); err != nil {
+		return m[1], true
+	}
+
+	return v, true
+}
+
+// returns a list of problems found by scanning a file written by pdfWriter for the
+// PDF/A-2b requirements it is most likely to break.  this is a sanity check of our
+// own output, not a validator: a clean result does not mean the file conforms.
+func sanityCheckPdfA(fileName string) []string {
+	var problems []string
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	header := make([]byte, 16)
+	_, err = io.ReadFull(f, header)
+	f.Close()
+
+	binaryMarker := err == nil && bytes.HasPrefix(header, []byte("%PDF-1.")) && header[9] == '%'
+	for _, c := range header[10:14] {
+		binaryMarker = binaryMarker && c >= 128
+	}
+	if binaryMarker == false {
+		problems = append(problems, "file header is missing or lacks a binary comment")
+	}
+
+	r, err := openPdfReader(fileName)
+	if err != nil {
+		return append(problems, err.Error())
+	}
+	defer r.close()
+
+	if strings.Contains(r.trailer, "/ID [") == false {
+		problems = append(problems, "trailer has no file identifier")
+	}
+
+	if strings.Contains(r.trailer, "/Encrypt") == true {
+		problems = append(problems, "file is encrypted")
+	}
+
+	catalog, err := r.object(pdfDictRef(r.trailer, "/Root"), false)
+	if err != nil {
+		return append(problems, fmt.Sprintf("catalog: %s", err.Error()))
+	}
+
+	// output intent
+	rgbIntent := false
+	if m := regexp.MustCompile(`/OutputIntents \[(\d+) 0 R\]`).FindStringSubmatch(catalog.dict); m == nil {
+		problems = append(problems, "no output intent")
+	} else {
+		n, _ := strconv.Atoi(m[1])
+		intent, err := r.object(n, false)
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("output intent: %s", err.Error()))
+		case strings.Contains(intent.dict, "/S /GTS_PDFA1") == false:
+			problems = append(problems, "output intent is not a PDF/A output intent")
+		default:
+			profile, err := r.object(pdfDictRef(intent.dict, "/DestOutputProfile"), false)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("output intent profile: %s", err.Error()))
+			} else {
+				rgbIntent = strings.Contains(profile.dict, "/N 3")
+			}
+		}
+	}
+
+	// xmp metadata, and its agreement with the document information dictionary
+	xmp := ""
+	if metaObj := pdfDictRef(catalog.dict, "/Metadata"); metaObj == 0 {
+		problems = append(problems, "no XMP metadata")
+	} else if meta, err := r.object(metaObj, true); err != nil {
+		problems = append(problems, fmt.Sprintf("XMP metadata: %s", err.Error()))
+	} else if strings.Contains(meta.dict, "/Filter") == true {
+		problems = append(problems, "XMP metadata stream is compressed")
+	} else {
+		xmp = string(meta.stream)
+	}
+
+	if xmp != "" {
+		if v, _ := xmpValue(xmp, "pdfaid:part"); v != "2" {
+			problems = append(problems, "XMP metadata does not identify the file as PDF/A-2")
+		}
+		if v, _ := xmpValue(xmp, "pdfaid:conformance"); v != "B" {
+			problems = append(problems, "XMP metadata does not declare conformance level B")
+		}
+
+		if info, err := r.object(pdfDictRef(r.trailer, "/Info"), false); err == nil {
+			for key, property := range map[string]string{
+				"/Title":    "dc:title",
+				"/Author":   "dc:creator",
+				"/Producer": "pdf:Producer",
+				"/Creator":  "xmp:CreatorTool",
+			} {
+				value, ok := pdfDictString(info.dict, key)
+				if ok == false {
+					continue
+				}
+				if got, _ := xmpValue(xmp, property); got != value {
+					problems = append(problems, fmt.Sprintf("document information %s does not match XMP %s", key, property))
+				}
+			}
+
+			if created, ok := pdfDictString(info.dict, "/CreationDate"); ok == true {
+				xmpCreated, _ := xmpValue(xmp, "xmp:CreateDate")
+				t1, err1 := parsePdfDate(created)
+				t2, err2 := time.Parse(time.RFC3339, xmpCreated)
+				if err1 != nil || err2 != nil || t1.Equal(t2) == false {
+					problems = append(problems, "document information /CreationDate does not match XMP xmp:CreateDate")
+				}
+			}
+		}
+	}
+
+	// every object: fonts must be embedded, colors must suit the output intent,
+	// and only permitted filters may be used
+	descriptors := make(map[int]bool)
+	var fonts []int
+
+	for n := 1; n < len(r.offsets); n++ {
+		obj, err := r.object(n, false)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+
+		switch {
+		case strings.Contains(obj.dict, "/Type /Font "):
+			fonts = append(fonts, n)
+		case strings.Contains(obj.dict, "/Type /FontDescriptor "):
+			descriptors[n] = strings.Contains(obj.dict, "/FontFile2 ") || strings.Contains(obj.dict, "/FontFile ") || strings.Contains(obj.dict, "/FontFile3 ")
+		}
+
+		if strings.Contains(obj.dict, "/DeviceCMYK") == true {
+			problems = append(problems, fmt.Sprintf("object %d uses DeviceCMYK, which the output intent does not allow", n))
+		}
+
+		if strings.Contains(obj.dict, "/DeviceRGB") == true && rgbIntent == false {
+			problems = append(problems, fmt.Sprintf("object %d uses DeviceRGB without an RGB output intent", n))
+		}
+
+		for _, name := range pdfNameKeyRegex.FindAllString(obj.dict, -1) {
+			if name == "/LZWDecode" || name == "/JS" || name == "/JavaScript" || name == "/EmbeddedFiles" {
+				problems = append(problems, fmt.Sprintf("object %d uses %s, which PDF/A does not allow", n, name))
+			}
+		}
+	}
+
+	for _, n := range fonts {
+		obj, _ := r.object(n, false)
+		if descriptors[pdfDictRef(obj.dict, "/FontDescriptor")] == false {
+			problems = append(problems, fmt.Sprintf("font object %d is not embedded", n))
+		}
+	}
+
+	return problems
+}
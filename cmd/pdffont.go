@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// a simple (single-byte) font using WinAnsiEncoding
+type pdfFont struct {
+	baseFont string
+	widths   [256]int      // glyph widths in 1/1000 em, indexed by WinAnsi code
+	trueType *trueTypeFont // font program to embed; standard fonts are not embedded
+	obj      int           // object number, once written
+}
+
+// WinAnsi codes 128-159 that do not map directly to the same unicode code point
+var winAnsiSpecials = map[rune]byte{
+	'€': 0x80, '‚': 0x82, 'ƒ': 0x83, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87, 'ˆ': 0x88,
+	'‰': 0x89, 'Š': 0x8a, '‹': 0x8b, 'Œ': 0x8c, 'Ž': 0x8e, '‘': 0x91, '’': 0x92, '“': 0x93,
+	'”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97, '˜': 0x98, '™': 0x99, 'š': 0x9a, '›': 0x9b,
+	'œ': 0x9c, 'ž': 0x9e, 'Ÿ': 0x9f,
+}
+
+// standard Helvetica metrics, for WinAnsi codes 32-255
+var helveticaWidths = []int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278, // 32
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556, // 48
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778, // 64
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556, // 80
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556, // 96
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584, 350, // 112
+	556, 350, 222, 556, 333, 1000, 556, 556, 333, 1000, 667, 333, 1000, 350, 611, 350, // 128
+	350, 222, 222, 333, 333, 350, 556, 1000, 333, 1000, 500, 333, 944, 350, 500, 667, // 144
+	278, 333, 556, 556, 556, 556, 260, 556, 333, 737, 370, 556, 584, 333, 737, 333, // 160
+	400, 584, 333, 333, 333, 556, 537, 278, 333, 333, 365, 556, 834, 834, 834, 611, // 176
+	667, 667, 667, 667, 667, 667, 1000, 722, 667, 667, 667, 667, 278, 278, 278, 278, // 192
+	722, 722, 778, 778, 778, 778, 778, 584, 778, 722, 722, 722, 722, 667, 667, 611, // 208
+	556, 556, 556, 556, 556, 556, 889, 500, 556, 556, 556, 556, 278, 278, 278, 278, // 224
+	556, 556, 556, 556, 556, 556, 556, 584, 611, 556, 556, 556, 556, 500, 556, 500, // 240
+}
+
+func newHelveticaFont() *pdfFont {
+	f := pdfFont{baseFont: "Helvetica"}
+
+	for i, w := range helveticaWidths {
+		f.widths[32+i] = w
+	}
+
+	return &f
+}
+
+// converts a string to WinAnsi bytes, substituting '?' for anything unrepresentable
+func winAnsiEncode(s string) []byte {
+	var b []byte
+
+	for _, r := range s {
+		switch {
+		case r >= 0x20 && r <= 0x7e, r >= 0xa0 && r <= 0xff:
+			b = append(b, byte(r))
+		case r == '\t':
+			b = append(b, ' ')
+		default:
+			if c, ok := winAnsiSpecials[r]; ok == true {
+				b = append(b, c)
+			} else {
+				b = append(b, '?')
+			}
+		}
+	}
+
+	return b
+}
+
+// returns the unicode character for a WinAnsi code, or zero if it has none
+func winAnsiRune(c byte) rune {
+	switch {
+	case c >= 0x20 && c <= 0x7e, c >= 0xa0:
+		return rune(c)
+	}
+
+	for r, code := range winAnsiSpecials {
+		if code == c {
+			return r
+		}
+	}
+
+	return 0
+}
+
+// converts a string to WinAnsi bytes, additionally substituting '?' for
+// any characters this font has no glyph for
+func (f *pdfFont) encode(s string) []byte {
+	b := winAnsiEncode(s)
+
+	for i, c := range b {
+		if f.widths[c] == 0 {
+			b[i] = '?'
+		}
+	}
+
+	return b
+}
+
+// writes the font dictionary, if not already written, returning its object number
+func (p *pdfWriter) addFont(f *pdfFont) int {
+	if f.obj != 0 {
+		return f.obj
+	}
+
+	if f.trueType == nil {
+		f.obj = p.object(0, fmt.Sprintf("<< /Type /Font /Subtype /Type1 /BaseFont /%s /Encoding /WinAnsiEncoding >>", f.baseFont))
+		return f.obj
+	}
+
+	tt := f.trueType
+
+	fileObj := p.stream(0, fmt.Sprintf("/Length1 %d /Filter /FlateDecode", len(tt.data)), deflate(tt.data))
+
+	descriptorObj := p.object(0, fmt.Sprintf("<< /Type /FontDescriptor /FontName /%s /Flags %d /FontBBox [%d %d %d %d] /ItalicAngle %s /Ascent %d /Descent %d /CapHeight %d /StemV %d /FontFile2 %d 0 R >>",
+		f.baseFont, tt.flags, tt.bbox[0], tt.bbox[1], tt.bbox[2], tt.bbox[3], pdfNumber(tt.italicAngle), tt.ascent, tt.descent, tt.capHeight, tt.stemV, fileObj))
+
+	widths := []string{}
+	for _, w := range f.widths[32:] {
+		widths = append(widths, fmt.Sprintf("%d", w))
+	}
+
+	f.obj = p.object(0, fmt.Sprintf("<< /Type /Font /Subtype /TrueType /BaseFont /%s /FirstChar 32 /LastChar 255 /Widths [%s] /Encoding /WinAnsiEncoding /FontDescriptor %d 0 R >>",
+		f.baseFont, strings.Join(widths, " "), descriptorObj))
+
+	return f.obj
+}
+
+// returns the width of a string in points at the given font size
+func (f *pdfFont) textWidth(s string, size float64) float64 {
+	total := 0
+
+	for _, c := range f.encode(s) {
+		total += f.widths[c]
+	}
+
+	return float64(total) * size / 1000
+}
+
+// breaks text into lines no wider than the given width, honoring existing line breaks.
+// words too long to fit on a line by themselves are broken wherever necessary.
+func (f *pdfFont) wrapText(text string, size, width float64) []string {
+	var lines []string
+
+	for _, para := range strings.Split(text, "\n") {
+		line := ""
+
+		for _, word := range strings.Fields(para) {
+			candidate := word
+			if line != "" {
+				candidate = line + " " + word
+			}
+
+			if f.textWidth(candidate, size) <= width {
+				line = candidate
+				continue
+			}
+
+			if line != "" {
+				lines = append(lines, line)
+				line = ""
+			}
+
+			for f.textWidth(word, size) > width {
+				runes := []rune(word)
+				n := len(runes) - 1
+				for n > 1 && f.textWidth(string(runes[:n]), size) > width {
+					n--
+				}
+				lines = append(lines, string(runes[:n]))
+				word = string(runes[n:])
+			}
+
+			line = word
+		}
+
+		lines = append(lines, line)
+	}
+
+	return lines
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// descriptive metadata embedded in the generated PDF
+type pdfMetadata struct {
+	title     string
+	authors   []string
+	published string // publication date, as given by solr
+	rights    string
+	catalogID string
+	virgoURL  string
+	pid       string
+	unit      string
+}
+
+// dates that XMP accepts as-is (year, year-month, or full date)
+var xmpDateRegex = regexp.MustCompile(`^\d{4}(-\d{2}(-\d{2})?)?$`)
+
+// gathers metadata from solr (when available) and tracksys
+func (c *clientContext) getPdfMetadata() *pdfMetadata {
+	meta := pdfMetadata{
+		pid:  c.req.pid,
+		unit: c.req.unit,
+	}
+
+	if c.pdf.solr != nil && len(c.pdf.solr.Response.Docs) > 0 {
+		doc := c.pdf.solr.Response.Docs[0]
+
+		meta.title = firstElementOf(doc.Title)
+		meta.authors = doc.AuthorFacet
+		meta.published = firstElementOf(doc.PublishedDaterange)
+		meta.rights = formatRights(firstElementOf(doc.RightsWrapper))
+		meta.catalogID = doc.ID
+		meta.virgoURL = getVirgoURL(doc.ID)
+	}
+
+	if c.pdf.merge != nil {
+		c.mergePdfMetadata(&meta)
+	}
+
+	// fall back to the tracksys title, then the pid
+	if meta.title == "" && c.pdf.ts != nil {
+		meta.title = c.pdf.ts.Pid.Title
+	}
+
+	if meta.title == "" {
+		meta.title = c.req.pid
+	}
+
+	return &meta
+}
+
+// document information dictionary entries, beyond those the writer always sets.
+// besides the standard keys, identifiers are stored under custom keys.
+func (m *pdfMetadata) infoEntries() []string {
+	var entries []string
+
+	add := func(key, value string) {
+		if value != "" {
+			entries = append(entries, fmt.Sprintf("/%s %s", key, pdfTextString(value)))
+		}
+	}
+
+	add("Title", m.title)
+	add("Author", strings.Join(m.authors, "; "))
+	add("Creator", "pdf-ws")
+	add("Published", m.published)
+	add("Rights", m.rights)
+	add("CatalogID", m.catalogID)
+	add("URL", m.virgoURL)
+	add("PID", m.pid)
+	add("Unit", m.unit)
+
+	return entries
+}
+
+// builds an XMP metadata packet describing the document, optionally identifying it as PDF/A-2b
+func (m *pdfMetadata) xmp(created time.Time, pdfa bool) []byte {
+	var b bytes.Buffer
+
+	esc := func(s string) string {
+		var e bytes.Buffer
+		xml.EscapeText(&e, []byte(s))
+		return e.String()
+	}
+
+	alt := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(&b, "   <%s><rdf:Alt><rdf:li xml:lang=\"x-default\">%s</rdf:li></rdf:Alt></%s>\n", name, esc(value), name)
+		}
+	}
+
+	simple := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(&b, "   <%s>%s</%s>\n", name, esc(value), name)
+		}
+	}
+
+	date := created.Format(time.RFC3339)
+
+	b.WriteString("<?xpacket begin=\"\xef\xbb\xbf\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	b.WriteString("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n")
+	b.WriteString(" <rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">\n")
+	b.WriteString("  <rdf:Description rdf:about=\"\"\n")
+	b.WriteString("    xmlns:dc=\"http://purl.org/dc/elements/1.1/\"\n")
+	b.WriteString("    xmlns:xmp=\"http://ns.adobe.com/xap/1.0/\"\n")
+	b.WriteString("    xmlns:pdf=\"http://ns.adobe.com/pdf/1.3/\"\n")
+	b.WriteString("    xmlns:pdfws=\"" + pdfwsNamespace + "\">\n")
+
+	simple("dc:format", "application/pdf")
+	alt("dc:title", m.title)
+
+	// authors are kept together in a single entry, matching the information dictionary
+	if len(m.authors) > 0 {
+		fmt.Fprintf(&b, "   <dc:creator><rdf:Seq><rdf:li>%s</rdf:li></rdf:Seq></dc:creator>\n", esc(strings.Join(m.authors, "; ")))
+	}
+
+	if xmpDateRegex.MatchString(m.published) == true {
+		fmt.Fprintf(&b, "   <dc:date><rdf:Seq><rdf:li>%s</rdf:li></rdf:Seq></dc:date>\n", esc(m.published))
+	}
+
+	alt("dc:rights", m.rights)
+	simple("dc:identifier", m.pid)
+	simple("dc:source", m.virgoURL)
+
+	simple("xmp:CreateDate", date)
+	simple("xmp:ModifyDate", date)
+	simple("xmp:MetadataDate", date)
+	simple("xmp:CreatorTool", "pdf-ws")
+	simple("pdf:Producer", "pdf-ws")
+
+	simple("pdfws:pid", m.pid)
+	simple("pdfws:unit", m.unit)
+	simple("pdfws:catalogID", m.catalogID)
+	simple("pdfws:virgoURL", m.virgoURL)
+	simple("pdfws:published", m.published)
+
+	b.WriteString("  </rdf:Description>\n")
+
+	if pdfa == true {
+		b.WriteString("  <rdf:Description rdf:about=\"\" xmlns:pdfaid=\"http://www.aiim.org/pdfa/ns/id/\">\n")
+		simple("pdfaid:part", "2")
+		simple("pdfaid:conformance", "B")
+		b.WriteString("  </rdf:Description>\n")
+	}
+
+	b.WriteString(pdfwsExtensionSchema)
+	b.WriteString(" </rdf:RDF>\n")
+	b.WriteString("</x:xmpmeta>\n")
+
+	// padding allows in-place edits by other tools
+	for i := 0; i < 20; i++ {
+		b.WriteString(strings.Repeat(" ", 99) + "\n")
+	}
+
+	b.WriteString("<?xpacket end=\"w\"?>")
+
+	return b.Bytes()
+}
+
+// namespace for metadata properties specific to this service
+const pdfwsNamespace = "http://lib.virginia.edu/ns/pdf-ws/1.0/"
+
+// describes the pdfws namespace properties, since PDF/A only permits
+// properties outside the predefined schemas if they are declared
+var pdfwsExtensionSchema = func() string {
+	var b strings.Builder
+
+	b.WriteString("  <rdf:Description rdf:about=\"\"\n")
+	b.WriteString("    xmlns:pdfaExtension=\"http://www.aiim.org/pdfa/ns/extension/\"\n")
+	b.WriteString("    xmlns:pdfaSchema=\"http://www.aiim.org/pdfa/ns/schema#\"\n")
+	b.WriteString("    xmlns:pdfaProperty=\"http://www.aiim.org/pdfa/ns/property#\">\n")
+	b.WriteString("   <pdfaExtension:schemas><rdf:Bag><rdf:li rdf:parseType=\"Resource\">\n")
+	b.WriteString("    <pdfaSchema:schema>pdf-ws identifiers</pdfaSchema:schema>\n")
+	b.WriteString("    <pdfaSchema:namespaceURI>" + pdfwsNamespace + "</pdfaSchema:namespaceURI>\n")
+	b.WriteString("    <pdfaSchema:prefix>pdfws</pdfaSchema:prefix>\n")
+	b.WriteString("    <pdfaSchema:property><rdf:Seq>\n")
+
+	for _, p := range [][2]string{
+		{"pid", "Tracksys PID"},
+		{"unit", "Tracksys unit"},
+		{"catalogID", "catalog record ID"},
+		{"virgoURL", "Virgo record URL"},
+		{"published", "publication date"},
+	} {
+		fmt.Fprintf(&b, "     <rdf:li rdf:parseType=\"Resource\"><pdfaProperty:name>%s</pdfaProperty:name><pdfaProperty:valueType>Text</pdfaProperty:valueType><pdfaProperty:category>external</pdfaProperty:category><pdfaProperty:description>%s</pdfaProperty:description></rdf:li>\n", p[0], p[1])
+	}
+
+	b.WriteString("    </rdf:Seq></pdfaSchema:property>\n")
+	b.WriteString("   </rdf:li></rdf:Bag></pdfaExtension:schemas>\n")
+	b.WriteString("  </rdf:Description>\n")
+
+	return b.String()
+}()
+
+// sets the document information and embeds the XMP packet, which viewers and
+// repositories prefer over the information dictionary
+func (p *pdfWriter) setMetadata(m *pdfMetadata) {
+	p.info = append(p.info, m.infoEntries()...)
+
+	// metadata streams are left uncompressed so that they can be found without parsing the pdf
+	metaObj := p.stream(0, "/Type /Metadata /Subtype /XML", m.xmp(p.created, p.pdfa))
+
+	p.catalog = append(p.catalog, fmt.Sprintf("/Metadata %d 0 R", metaObj))
+}
+
+// writes a ghostscript pdfmark file setting the document information, for the helper script
+func (m *pdfMetadata) pdfmark() []byte {
+	var b bytes.Buffer
+
+	b.WriteString("[")
+	for _, entry := range m.infoEntries() {
+		fmt.Fprintf(&b, " %s\n", entry)
+	}
+	b.WriteString(" /DOCINFO pdfmark\n")
+
+	return b.Bytes()
+}
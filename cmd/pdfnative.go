@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+)
+
+// page height used for every image page, matching the helper script
+const outputPageInches = 11
+
+// picks an output height and resolution for a set of image heights (in pixels).
+// this follows the helper script: find the tallest image that is not an outlier
+// (within two standard deviations of the mean), and use 300 DPI if it is tall
+// enough to fill the page at that resolution, otherwise 150 DPI.
+func determineOutputResolution(heights []int) (int, int) {
+	if len(heights) == 0 {
+		return outputPageInches * 150, 150
+	}
+
+	sum := 0.0
+	sumSquares := 0.0
+
+	for _, h := range heights {
+		sum += float64(h)
+		sumSquares += float64(h) * float64(h)
+	}
+
+	n := float64(len(heights))
+	mean := sum / n
+	stddev := math.Sqrt(math.Max(sumSquares/n-mean*mean, 0))
+	limit := int(mean + 2*stddev)
+
+	maxHeight := 0
+	for _, h := range heights {
+		if h > maxHeight && h <= limit {
+			maxHeight = h
+		}
+	}
+
+	dpi := 150
+	if maxHeight >= outputPageInches*300 {
+		dpi = 300
+	}
+
+	return outputPageInches * dpi, dpi
+}
+
+/**
+ * assemble downloaded JPEGs (and optional cover pages) into a PDF, embedding each image as-is
+ */
+func (c *clientContext) generatePdfNative(pdfFile string, parts []pdfPart, cover *coverPage) error {
+	var images []pageImage
+	hasCovers := cover != nil
+
+	for _, part := range parts {
+		images = append(images, part.images...)
+		if part.cover != nil {
+			hasCovers = true
+		}
+	}
+
+	// read image headers up front to determine the output resolution
+	infos := make(map[string]jpegInfo)
+	heights := make([]int, len(images))
+
+	for i, image := range images {
+		info, err := readJpegInfo(image.file)
+		if err != nil {
+			return err
+		}
+
+		infos[image.file] = info
+		heights[i] = info.height
+	}
+
+	hmax, dpi := determineOutputResolution(heights)
+	c.info("output resolution: height %d at %d dpi", hmax, dpi)
+
+	// PDF/A requires every font to be embedded, so cover and page text use a truetype font instead of Helvetica
+	font := newHelveticaFont()
+	hasText := false
+	for _, image := range images {
+		if image.text != "" || image.ocr != "" {
+			hasText = true
+			break
+		}
+	}
+
+	if c.req.format == "pdfa" && (hasCovers == true || hasText == true) {
+		ttf, err := loadTrueTypeFont(config.pdfaFont.value)
+		if err != nil {
+			return fmt.Errorf("unable to load PDF/A font: %s", err.Error())
+		}
+		font = ttf
+	}
+
+	p, err := createPdf(pdfFile)
+	if err != nil {
+		return err
+	}
+
+	if c.req.format == "pdfa" {
+		p.pdfa = true
+		p.addOutputIntent()
+	}
+
+	// page titles, used for bookmarks and page labels
+	var titles []string
+
+	// adds a cover page, if there is one for this position
+	addCover := func(cover *coverPage, position string) error {
+		if cover == nil || c.req.cover != position {
+			return nil
+		}
+
+		if err := p.addCoverPage(cover, font); err != nil {
+			return err
+		}
+		titles = append(titles, "Cover")
+
+		return nil
+	}
+
+	// merged pdfs are bookmarked by part
+	var sections []pdfBookmark
+
+	if err := addCover(cover, "front"); err != nil {
+		p.close()
+		return err
+	}
+
+	for _, part := range parts {
+		if part.title != "" {
+			sections = append(sections, pdfBookmark{title: part.title, page: len(p.pages)})
+		}
+
+		if err := addCover(part.cover, "front"); err != nil {
+			p.close()
+			return err
+		}
+
+		if err := c.addImagePages(p, part.images, infos, font, hmax, dpi); err != nil {
+			p.close()
+			return err
+		}
+
+		for _, image := range part.images {
+			titles = append(titles, image.title)
+		}
+
+		if err := addCover(part.cover, "back"); err != nil {
+			p.close()
+			return err
+		}
+	}
+
+	if err := addCover(cover, "back"); err != nil {
+		p.close()
+		return err
+	}
+
+	// only add page navigation if tracksys supplied page titles
+	hasTitles := false
+	for _, image := range images {
+		if image.title != "" {
+			hasTitles = true
+			break
+		}
+	}
+
+	switch {
+	case len(sections) > 0:
+		p.addOutline(sections)
+		if hasTitles == true {
+			p.addPageLabels(titles)
+		}
+
+	case hasTitles == true:
+		p.addOutline(bookmarksFromTitles(titles))
+		p.addPageLabels(titles)
+	}
+
+	p.setMetadata(c.getPdfMetadata())
+
+	if err := p.close(); err != nil {
+		return err
+	}
+
+	if p.pdfa == true {
+		c.setStage("validating", 0, c.pdf.progress.PagesTotal)
+		if err := c.validatePdfA(pdfFile); err != nil {
+			return err
+		}
+	}
+
+	if fi, err := os.Stat(pdfFile); err == nil {
+		c.info("wrote %d pages (%d bytes)", len(p.pages), fi.Size())
+	}
+
+	return nil
+}
+
+// adds a page for each image, with any text layer beneath it.  every image is scaled
+// to the same height, so each page is as tall as the output height at the output
+// resolution, and as wide as its aspect ratio allows
+func (c *clientContext) addImagePages(p *pdfWriter, images []pageImage, infos map[string]jpegInfo, font *pdfFont, hmax, dpi int) error {
+	for _, image := range images {
+		if c.cancelled() == true {
+			return errors.New("job cancelled")
+		}
+
+		info := infos[image.file]
+
+		imageObj, err := p.jpegImage(image.file, info)
+		if err != nil {
+			return err
+		}
+
+		height := float64(hmax) / float64(dpi) * 72
+		width := height * float64(info.width) / float64(info.height)
+
+		// a tracksys transcription is preferred over ocr results
+		var text []byte
+		if image.text != "" {
+			buf, err := os.ReadFile(image.text)
+			if err != nil {
+				c.warn("unable to read text for %s: %s", image.file, err.Error())
+			} else {
+				text = transcriptionTextLayer(string(buf), font, width, height)
+			}
+		} else if image.ocr != "" {
+			words, err := readOcrWords(image.ocr)
+			if err != nil {
+				c.warn("unable to read ocr results for %s: %s", image.file, err.Error())
+			}
+			if len(words) > 0 {
+				text = ocrTextLayer(words, font, height/float64(info.height), height)
+			}
+		}
+
+		if text != nil {
+			p.addImagePageWithText(imageObj, width, height, text, p.addFont(font))
+		} else {
+			p.addImagePage(imageObj, width, height)
+		}
+	}
+
+	return p.err
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+var resolutionTests = []struct {
+	name    string
+	heights []int
+	height  int
+	dpi     int
+}{
+	{"no images", nil, 1650, 150},
+	{"short", []int{1200, 1300, 1250}, 1650, 150},
+	{"just under 300 dpi", []int{3299}, 1650, 150},
+	{"exactly 300 dpi", []int{3300}, 3300, 300},
+	{"tall", []int{4000, 4100, 3900}, 3300, 300},
+	{"one tall page among short ones", []int{1000, 5000}, 3300, 300},
+	{"tall outlier ignored", []int{2000, 2000, 2000, 2000, 2000, 2000, 2000, 2000, 2000, 2000, 9000}, 1650, 150},
+}
+
+func TestDetermineOutputResolution(t *testing.T) {
+	for _, test := range resolutionTests {
+		height, dpi := determineOutputResolution(test.heights)
+		if height != test.height || dpi != test.dpi {
+			t.Errorf("%s: got height %d at %d dpi, want height %d at %d dpi", test.name, height, dpi, test.height, test.dpi)
+		}
+	}
+}
+
+// runs the resolution calculation from the helper script over the same heights
+func TestDetermineOutputResolutionMatchesScript(t *testing.T) {
+	if _, err := exec.LookPath("awk"); err != nil {
+		t.Skip("awk not available")
+	}
+
+	script, err := os.ReadFile("../scripts/mkpdf.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the program is the single-quoted awk argument in determine_output_resolution()
+	_, program, _ := strings.Cut(string(script), "function determine_output_resolution ()")
+	_, program, _ = strings.Cut(program, "awk '")
+	program, _, found := strings.Cut(program, "')")
+	if found == false {
+		t.Fatal("resolution calculation not found in mkpdf.sh")
+	}
+
+	for _, test := range resolutionTests {
+		// the script cannot handle an empty item
+		if len(test.heights) == 0 {
+			continue
+		}
+
+		// lines as output by identify
+		var identify bytes.Buffer
+		for i, h := range test.heights {
+			fmt.Fprintf(&identify, "page-%d.jpg JPEG 2000x%d 2000x%d+0+0 8-bit sRGB 1MiB 0.000u 0:00.000\n", i, h, h)
+		}
+
+		cmd := exec.Command("awk", program)
+		cmd.Stdin = &identify
+
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err.Error())
+		}
+
+		height, dpi := determineOutputResolution(test.heights)
+		if want := fmt.Sprintf("%d %d", height, dpi); strings.TrimSpace(string(out)) != want {
+			t.Errorf("%s: script gives %s, native writer gives %s", test.name, strings.TrimSpace(string(out)), want)
+		}
+	}
+}
+
+// builds a small pdf from images of differing sizes and checks its pages
+func TestGeneratePdfNative(t *testing.T) {
+	dir := t.TempDir()
+
+	sizes := [][2]int{{40, 60}, {80, 60}, {30, 90}}
+
+	var images []pageImage
+	var jpegs [][]byte
+
+	for i, size := range sizes {
+		data := testJPEG(t, i+1, size[0], size[1])
+		jpegs = append(jpegs, data)
+
+		fileName := fmt.Sprintf("%s/page-%d.jpg", dir, i+1)
+		if err := os.WriteFile(fileName, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		images = append(images, pageImage{file: fileName})
+	}
+
+	c := &clientContext{reqID: "test", ip: "-"}
+	c.req.pid = "book1"
+	c.req.format = "pdf"
+	c.req.cover = "none"
+
+	pdfFile := fmt.Sprintf("%s/book1.pdf", dir)
+	if err := c.generatePdfNative(pdfFile, []pdfPart{{images: images}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	pdf, _ := os.ReadFile(pdfFile)
+	objects := checkPdfStructure(t, pdf)
+
+	// short images are output at 150 dpi on an 11 inch page, i.e. 792 points tall
+	var pages, embedded int
+	for n := 1; n <= len(objects); n++ {
+		object := objects[n]
+
+		if bytes.HasPrefix(object, []byte("<< /Type /Page ")) == true {
+			var width float64
+			fmt.Sscanf(string(object[bytes.Index(object, []byte("/MediaBox")):]), "/MediaBox [0 0 %g 792]", &width)
+
+			size := sizes[pages]
+			if want := 792 * float64(size[0]) / float64(size[1]); fmt.Sprintf("%.3f", width) != fmt.Sprintf("%.3f", want) {
+				t.Errorf("page %d: got %s, want a %.3fx792 media box", pages+1, object, want)
+			}
+			pages++
+		}
+
+		if bytes.Contains(object, []byte("/Subtype /Image ")) == true {
+			if _, data := splitPdfStream(t, object); bytes.Equal(data, jpegs[embedded]) == false {
+				t.Errorf("image %d differs from its jpeg", embedded+1)
+			}
+			embedded++
+		}
+	}
+
+	if pages != len(sizes) || embedded != len(sizes) {
+		t.Errorf("found %d pages and %d images, want %d of each", pages, embedded, len(sizes))
+	}
+
+	if bytes.Contains(pdf, []byte("/Title (book1)")) == false {
+		t.Errorf("pdf is not titled by its pid")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// a bookmark in the document outline
+type pdfBookmark struct {
+	title string
+	page  int // zero-based page index
+}
+
+// builds a flat outline from per-page titles.  consecutive pages sharing a title
+// are treated as one logical section, bookmarked at its first page.  pages
+// without a title are not bookmarked.
+func bookmarksFromTitles(titles []string) []pdfBookmark {
+	var bookmarks []pdfBookmark
+
+	prev := ""
+	for i, title := range titles {
+		if title != "" && title != prev {
+			bookmarks = append(bookmarks, pdfBookmark{title: title, page: i})
+		}
+		prev = title
+	}
+
+	return bookmarks
+}
+
+// writes a flat document outline and references it from the catalog,
+// so that viewers open with the bookmarks panel showing
+func (p *pdfWriter) addOutline(bookmarks []pdfBookmark) {
+	if len(bookmarks) == 0 {
+		return
+	}
+
+	outlineObj := p.newObject()
+
+	items := make([]int, len(bookmarks))
+	for i := range bookmarks {
+		items[i] = p.newObject()
+	}
+
+	for i, bookmark := range bookmarks {
+		entries := []string{
+			fmt.Sprintf("/Title %s", pdfTextString(bookmark.title)),
+			fmt.Sprintf("/Parent %d 0 R", outlineObj),
+			fmt.Sprintf("/Dest [%d 0 R /Fit]", p.pages[bookmark.page]),
+		}
+
+		if i > 0 {
+			entries = append(entries, fmt.Sprintf("/Prev %d 0 R", items[i-1]))
+		}
+		if i < len(items)-1 {
+			entries = append(entries, fmt.Sprintf("/Next %d 0 R", items[i+1]))
+		}
+
+		p.object(items[i], fmt.Sprintf("<< %s >>", strings.Join(entries, " ")))
+	}
+
+	p.object(outlineObj, fmt.Sprintf("<< /Type /Outlines /First %d 0 R /Last %d 0 R /Count %d >>",
+		items[0], items[len(items)-1], len(items)))
+
+	p.catalog = append(p.catalog, fmt.Sprintf("/Outlines %d 0 R", outlineObj), "/PageMode /UseOutlines")
+}
+
+// writes page labels, one per page.  pages with a blank label fall back to
+// their physical page number, so viewers still show something sensible.
+func (p *pdfWriter) addPageLabels(labels []string) {
+	var nums []string
+
+	for i, label := range labels {
+		if label == "" {
+			nums = append(nums, fmt.Sprintf("%d << /S /D /St %d >>", i, i+1))
+		} else {
+			nums = append(nums, fmt.Sprintf("%d << /P %s >>", i, pdfTextString(label)))
+		}
+	}
+
+	if len(nums) == 0 {
+		return
+	}
+
+	labelsObj := p.object(0, fmt.Sprintf("<< /Nums [%s] >>", strings.Join(nums, " ")))
+
+	p.catalog = append(p.catalog, fmt.Sprintf("/PageLabels %d 0 R", labelsObj))
+}
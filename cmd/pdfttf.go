@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+)
+
+// details of an embedded truetype font program, needed for its font descriptor
+type trueTypeFont struct {
+	data        []byte // the complete font file
+	flags       int
+	bbox        [4]int
+	italicAngle float64
+	ascent      int
+	descent     int
+	capHeight   int
+	stemV       int
+}
+
+// loads a truetype font for embedding, with widths for the WinAnsi character set.
+// characters the font has no glyph for are left with a zero width, so that
+// encode() substitutes them.
+func loadTrueTypeFont(fileName string) (*pdfFont, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	tables, err := trueTypeTables(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fileName, err.Error())
+	}
+
+	for _, tag := range []string{"head", "hhea", "hmtx", "cmap", "post"} {
+		if _, ok := tables[tag]; ok == false {
+			return nil, fmt.Errorf("%s: missing %s table", fileName, tag)
+		}
+	}
+
+	head := tables["head"]
+	hhea := tables["hhea"]
+	hmtx := tables["hmtx"]
+	post := tables["post"]
+
+	if len(head) < 54 || len(hhea) < 36 || len(post) < 16 {
+		return nil, fmt.Errorf("%s: truncated font tables", fileName)
+	}
+
+	unitsPerEm := float64(binary.BigEndian.Uint16(head[18:]))
+	if unitsPerEm == 0 {
+		return nil, fmt.Errorf("%s: invalid units per em", fileName)
+	}
+
+	// scales font units to the 1/1000 em units used by pdf
+	scale := func(v int) int {
+		return int(math.Round(float64(v) * 1000 / unitsPerEm))
+	}
+
+	glyphs, err := trueTypeUnicodeMap(tables["cmap"])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fileName, err.Error())
+	}
+
+	numHMetrics := int(binary.BigEndian.Uint16(hhea[34:]))
+	if numHMetrics == 0 || len(hmtx) < numHMetrics*4 {
+		return nil, fmt.Errorf("%s: truncated hmtx table", fileName)
+	}
+
+	// glyphs beyond the last metric share its advance width
+	advance := func(glyph int) int {
+		if glyph >= numHMetrics {
+			glyph = numHMetrics - 1
+		}
+		return int(binary.BigEndian.Uint16(hmtx[glyph*4:]))
+	}
+
+	name := trueTypePostScriptName(tables["name"])
+	if name == "" {
+		name = strings.TrimSuffix(fileName[strings.LastIndex(fileName, "/")+1:], ".ttf")
+	}
+
+	f := pdfFont{baseFont: name}
+
+	for code := 32; code < 256; code++ {
+		r := winAnsiRune(byte(code))
+		if glyph, ok := glyphs[r]; ok == true && r != 0 {
+			f.widths[code] = scale(advance(int(glyph)))
+		}
+	}
+
+	// the space glyph may legitimately have no outline, but it must have a width
+	if f.widths[' '] == 0 {
+		return nil, fmt.Errorf("%s: font has no space character", fileName)
+	}
+
+	tt := trueTypeFont{
+		data:        data,
+		italicAngle: float64(int32(binary.BigEndian.Uint32(post[4:]))) / 65536,
+		ascent:      scale(int(int16(binary.BigEndian.Uint16(hhea[4:])))),
+		descent:     scale(int(int16(binary.BigEndian.Uint16(hhea[6:])))),
+	}
+
+	for i := range tt.bbox {
+		tt.bbox[i] = scale(int(int16(binary.BigEndian.Uint16(head[36+2*i:]))))
+	}
+
+	tt.capHeight = tt.ascent
+	tt.stemV = 80
+
+	if os2 := tables["OS/2"]; len(os2) >= 6 {
+		weight := int(binary.BigEndian.Uint16(os2[4:]))
+		// a common approximation, since truetype fonts do not record stem widths
+		tt.stemV = 10 + 220*(weight-50)/900
+		if len(os2) >= 90 && binary.BigEndian.Uint16(os2[0:]) >= 2 {
+			tt.capHeight = scale(int(int16(binary.BigEndian.Uint16(os2[88:]))))
+		}
+	}
+
+	// nonsymbolic, plus fixed pitch and italic where applicable
+	tt.flags = 1 << 5
+	if binary.BigEndian.Uint32(post[12:]) != 0 {
+		tt.flags |= 1 << 0
+	}
+	if tt.italicAngle != 0 {
+		tt.flags |= 1 << 6
+	}
+
+	f.trueType = &tt
+
+	return &f, nil
+}
+
+// splits a truetype font file into its tables
+func trueTypeTables(data []byte) (map[string][]byte, error) {
+	if len(data) < 12 {
+		return nil, errors.New("not a truetype font")
+	}
+
+	switch binary.BigEndian.Uint32(data) {
+	case 0x00010000, 0x74727565: // version 1.0, or 'true'
+	default:
+		return nil, errors.New("not a truetype font")
+	}
+
+	numTables := int(binary.BigEndian.Uint16(data[4:]))
+	if len(data) < 12+numTables*16 {
+		return nil, errors.New("truncated table directory")
+	}
+
+	tables := make(map[string][]byte)
+
+	for i := 0; i < numTables; i++ {
+		entry := data[12+i*16:]
+		tag := string(entry[0:4])
+		offset := int(binary.BigEndian.Uint32(entry[8:]))
+		length := int(binary.BigEndian.Uint32(entry[12:]))
+
+		if offset < 0 || length < 0 || offset+length > len(data) {
+			return nil, fmt.Errorf("table %s extends past end of file", tag)
+		}
+
+		tables[tag] = data[offset : offset+length]
+	}
+
+	return tables, nil
+}
+
+// reads the unicode (platform 3, encoding 1, format 4) character map,
+// which pdf viewers use to find glyphs in a nonsymbolic truetype font
+func trueTypeUnicodeMap(cmap []byte) (map[rune]uint16, error) {
+	if len(cmap) < 4 {
+		return nil, errors.New("truncated cmap table")
+	}
+
+	numTables := int(binary.BigEndian.Uint16(cmap[2:]))
+
+	for i := 0; i < numTables; i++ {
+		if len(cmap) < 4+i*8+8 {
+			break
+		}
+
+		entry := cmap[4+i*8:]
+		platform := binary.BigEndian.Uint16(entry[0:])
+		encoding := binary.BigEndian.Uint16(entry[2:])
+		offset := int(binary.BigEndian.Uint32(entry[4:]))
+
+		if platform != 3 || encoding != 1 || offset+14 > len(cmap) {
+			continue
+		}
+
+		sub := cmap[offset:]
+		if binary.BigEndian.Uint16(sub[0:]) != 4 {
+			continue
+		}
+
+		segCount := int(binary.BigEndian.Uint16(sub[6:])) / 2
+		if len(sub) < 16+segCount*8 {
+			return nil, errors.New("truncated cmap subtable")
+		}
+
+		endCodes := sub[14:]
+		startCodes := sub[16+segCount*2:]
+		deltas := sub[16+segCount*4:]
+		rangeOffsets := sub[16+segCount*6:]
+
+		glyphs := make(map[rune]uint16)
+
+		for s := 0; s < segCount; s++ {
+			start := int(binary.BigEndian.Uint16(startCodes[s*2:]))
+			end := int(binary.BigEndian.Uint16(endCodes[s*2:]))
+			delta := binary.BigEndian.Uint16(deltas[s*2:])
+			rangeOffset := int(binary.BigEndian.Uint16(rangeOffsets[s*2:]))
+
+			// only the basic multilingual plane below 0x2200 matters for WinAnsi
+			if start > 0x2200 {
+				continue
+			}
+
+			for code := start; code <= end && code < 0xffff; code++ {
+				var glyph uint16
+
+				if rangeOffset == 0 {
+					glyph = uint16(code) + delta
+				} else {
+					// the offset is relative to the range offset entry itself
+					pos := 16 + segCount*6 + s*2 + rangeOffset + (code-start)*2
+					if pos+2 > len(sub) {
+						continue
+					}
+					glyph = binary.BigEndian.Uint16(sub[pos:])
+					if glyph != 0 {
+						glyph += delta
+					}
+				}
+
+				if glyph != 0 {
+					glyphs[rune(code)] = glyph
+				}
+			}
+		}
+
+		return glyphs, nil
+	}
+
+	return nil, errors.New("font has no unicode character map")
+}
+
+// returns the postscript name of a font from its name table, if present
+func trueTypePostScriptName(name []byte) string {
+	if len(name) < 6 {
+		return ""
+	}
+
+	count := int(binary.BigEndian.Uint16(name[2:]))
+	storage := int(binary.BigEndian.Uint16(name[4:]))
+
+	for i := 0; i < count; i++ {
+		if len(name) < 6+i*12+12 {
+			break
+		}
+
+		rec := name[6+i*12:]
+		platform := binary.BigEndian.Uint16(rec[0:])
+		nameID := binary.BigEndian.Uint16(rec[6:])
+		length := int(binary.BigEndian.Uint16(rec[8:]))
+		offset := storage + int(binary.BigEndian.Uint16(rec[10:]))
+
+		if nameID != 6 || offset+length > len(name) {
+			continue
+		}
+
+		raw := name[offset : offset+length]
+
+		// windows names are UTF-16BE; mac names are single byte
+		var s strings.Builder
+		if platform == 3 {
+			for j := 0; j+1 < len(raw); j += 2 {
+				s.WriteByte(raw[j+1])
+			}
+		} else {
+			s.Write(raw)
+		}
+
+		// postscript names are restricted to printable ascii, without delimiters
+		clean := strings.Map(func(r rune) rune {
+			if r <= 0x20 || r >= 0x7f || strings.ContainsRune("[](){}<>/%", r) {
+				return -1
+			}
+			return r
+		}, s.String())
+
+		if clean != "" {
+			return clean
+		}
+	}
+
+	return ""
+}
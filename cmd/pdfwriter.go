@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// a minimal streaming PDF writer.  objects are written to disk as they are
+// created, so memory use does not grow with the number of pages; only the
+// byte offset of each object is kept for the cross-reference table.
+type pdfWriter struct {
+	file     *os.File
+	out      *bufio.Writer
+	offset   int64
+	xref     []int64  // byte offset of each object, indexed by object number
+	pages    []int    // object numbers of each page, in order
+	pagesObj int      // object number of the page tree
+	catalog  []string // additional catalog entries, e.g. "/PageLabels 12 0 R"
+	info     []string // document information entries, e.g. "/Title (abc)"
+	created  time.Time
+	pdfa     bool  // identify the output as PDF/A-2b
+	err      error // first write error encountered, if any
+}
+
+// image details needed to embed a JPEG as-is
+type jpegInfo struct {
+	width      int
+	height     int
+	components int
+	bits       int
+	adobe      bool // has an Adobe APP14 marker (CMYK data is stored inverted)
+}
+
+func createPdf(fileName string) (*pdfWriter, error) {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &pdfWriter{
+		file:    f,
+		out:     bufio.NewWriterSize(f, 256*1024),
+		xref:    []int64{0},
+		created: time.Now().Truncate(time.Second),
+	}
+
+	p.pagesObj = p.newObject()
+
+	// header, followed by a comment with high-bit characters to mark the file as binary
+	p.printf("%%PDF-1.7\n%%\xe2\xe3\xcf\xd3\n")
+
+	return p, p.err
+}
+
+func (p *pdfWriter) Write(b []byte) (int, error) {
+	if p.err != nil {
+		return 0, p.err
+	}
+
+	n, err := p.out.Write(b)
+	p.offset += int64(n)
+	if err != nil {
+		p.err = err
+	}
+
+	return n, err
+}
+
+func (p *pdfWriter) printf(format string, args ...interface{}) {
+	fmt.Fprintf(p, format, args...)
+}
+
+// reserves an object number, so that it can be referenced before it is written
+func (p *pdfWriter) newObject() int {
+	p.xref = append(p.xref, 0)
+	return len(p.xref) - 1
+}
+
+func (p *pdfWriter) startObject(n int) {
+	p.xref[n] = p.offset
+	p.printf("%d 0 obj\n", n)
+}
+
+func (p *pdfWriter) endObject() {
+	p.printf("\nendobj\n")
+}
+
+// writes a non-stream object with the given body, returning its object number
+func (p *pdfWriter) object(n int, body string) int {
+	if n == 0 {
+		n = p.newObject()
+	}
+
+	p.startObject(n)
+	p.printf("%s", body)
+	p.endObject()
+
+	return n
+}
+
+// writes a stream object; dict holds any entries besides /Length
+func (p *pdfWriter) stream(n int, dict string, data []byte) int {
+	return p.streamFrom(n, dict, bytes.NewReader(data), int64(len(data)))
+}
+
+func (p *pdfWriter) streamFrom(n int, dict string, r io.Reader, length int64) int {
+	if n == 0 {
+		n = p.newObject()
+	}
+
+	if dict != "" {
+		dict += " "
+	}
+
+	p.startObject(n)
+	p.printf("<< %s/Length %d >>\nstream\n", dict, length)
+
+	copied, err := io.Copy(p, r)
+	if err == nil && copied != length {
+		err = fmt.Errorf("stream length mismatch: expected %d bytes, copied %d", length, copied)
+	}
+	if err != nil && p.err == nil {
+		p.err = err
+	}
+
+	p.printf("\nendstream")
+	p.endObject()
+
+	return n
+}
+
+// embeds a JPEG file as an image XObject without re-encoding it
+func (p *pdfWriter) jpegImage(fileName string, info jpegInfo) (int, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	dict := fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /BitsPerComponent %d /Filter /DCTDecode",
+		info.width, info.height, info.bits)
+
+	switch info.components {
+	case 1:
+		dict += " /ColorSpace /DeviceGray"
+	case 3:
+		dict += " /ColorSpace /DeviceRGB"
+	case 4:
+		dict += " /ColorSpace /DeviceCMYK"
+		if info.adobe == true {
+			dict += " /Decode [1 0 1 0 1 0 1 0]"
+		}
+	default:
+		return 0, fmt.Errorf("unsupported number of color components (%d) in %s", info.components, fileName)
+	}
+
+	n := p.streamFrom(0, dict, f, fi.Size())
+
+	return n, p.err
+}
+
+// adds a page of the given size (in points), returning its object number
+func (p *pdfWriter) addPage(width, height float64, resources string, content []byte) int {
+	contentObj := p.stream(0, "", content)
+
+	pageObj := p.object(0, fmt.Sprintf("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %s %s] /Resources << %s >> /Contents %d 0 R >>",
+		p.pagesObj, pdfNumber(width), pdfNumber(height), resources, contentObj))
+
+	p.pages = append(p.pages, pageObj)
+
+	return pageObj
+}
+
+// adds a page consisting of a single image scaled to fill it
+func (p *pdfWriter) addImagePage(imageObj int, width, height float64) int {
+	return p.addImagePageWithText(imageObj, width, height, nil, 0)
+}
+
+// adds an image page with text beneath the image, e.g. an invisible ocr layer using font /F1
+func (p *pdfWriter) addImagePageWithText(imageObj int, width, height float64, text []byte, fontObj int) int {
+	var content bytes.Buffer
+
+	resources := fmt.Sprintf("/XObject << /Im0 %d 0 R >>", imageObj)
+
+	if len(text) > 0 {
+		content.Write(text)
+		resources += fmt.Sprintf(" /Font << /F1 %d 0 R >>", fontObj)
+	}
+
+	fmt.Fprintf(&content, "q %s 0 0 %s 0 0 cm /Im0 Do Q", pdfNumber(width), pdfNumber(height))
+
+	return p.addPage(width, height, resources, content.Bytes())
+}
+
+// writes the page tree, catalog, document info and cross-reference table, and closes the file
+func (p *pdfWriter) close() error {
+	defer p.file.Close()
+
+	if len(p.pages) == 0 {
+		return errors.New("pdf has no pages")
+	}
+
+	kids := []string{}
+	for _, page := range p.pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", page))
+	}
+
+	p.object(p.pagesObj, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(p.pages)))
+
+	catalog := []string{"/Type /Catalog", fmt.Sprintf("/Pages %d 0 R", p.pagesObj)}
+	catalogObj := p.object(0, fmt.Sprintf("<< %s >>", strings.Join(append(catalog, p.catalog...), " ")))
+
+	info := []string{"/Producer (pdf-ws)", fmt.Sprintf("/CreationDate %s", pdfDate(p.created))}
+	infoObj := p.object(0, fmt.Sprintf("<< %s >>", strings.Join(append(info, p.info...), " ")))
+
+	// document id, derived from when and where it was created
+	sum := md5.Sum([]byte(fmt.Sprintf("%s %d %d", p.file.Name(), time.Now().UnixNano(), p.offset)))
+	id := hex.EncodeToString(sum[:])
+
+	xrefOffset := p.offset
+
+	p.printf("xref\n0 %d\n", len(p.xref))
+	p.printf("0000000000 65535 f \n")
+	for _, offset := range p.xref[1:] {
+		p.printf("%010d 00000 n \n", offset)
+	}
+
+	p.printf("trailer\n<< /Size %d /Root %d 0 R /Info %d 0 R /ID [<%s> <%s>] >>\n", len(p.xref), catalogObj, infoObj, id, id)
+	p.printf("startxref\n%d\n%%%%EOF\n", xrefOffset)
+
+	if p.err != nil {
+		return p.err
+	}
+
+	if err := p.out.Flush(); err != nil {
+		return err
+	}
+
+	return p.file.Close()
+}
+
+// reads the dimensions and color details of a JPEG file
+func readJpegInfo(fileName string) (jpegInfo, error) {
+	var info jpegInfo
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return info, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi[0] != 0xff || soi[1] != 0xd8 {
+		return info, fmt.Errorf("not a JPEG file: %s", fileName)
+	}
+
+	for {
+		// find the next marker, skipping any fill bytes
+		b, err := r.ReadByte()
+		if err != nil {
+			return info, fmt.Errorf("no image header found in %s", fileName)
+		}
+		if b != 0xff {
+			continue
+		}
+
+		marker, err := r.ReadByte()
+		for err == nil && marker == 0xff {
+			marker, err = r.ReadByte()
+		}
+		if err != nil {
+			return info, fmt.Errorf("no image header found in %s", fileName)
+		}
+
+		// standalone markers carry no length
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			continue
+		}
+
+		var lenBuf [2]byte
+		if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+			return info, fmt.Errorf("truncated JPEG file: %s", fileName)
+		}
+
+		length := int(lenBuf[0])<<8 | int(lenBuf[1]) - 2
+		if length < 0 {
+			return info, fmt.Errorf("corrupt JPEG file: %s", fileName)
+		}
+
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return info, fmt.Errorf("truncated JPEG file: %s", fileName)
+		}
+
+		switch {
+		case marker == 0xee && length >= 5 && string(segment[:5]) == "Adobe":
+			info.adobe = true
+
+		case marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc:
+			if length < 6 {
+				return info, fmt.Errorf("corrupt JPEG header in %s", fileName)
+			}
+
+			info.bits = int(segment[0])
+			info.height = int(segment[1])<<8 | int(segment[2])
+			info.width = int(segment[3])<<8 | int(segment[4])
+			info.components = int(segment[5])
+
+			if info.width == 0 || info.height == 0 {
+				return info, fmt.Errorf("JPEG has no dimensions: %s", fileName)
+			}
+
+			return info, nil
+
+		case marker == 0xda:
+			return info, fmt.Errorf("no image header found in %s", fileName)
+		}
+	}
+}
+
+// formats a number for use in a content stream or dictionary
+func pdfNumber(f float64) string {
+	s := fmt.Sprintf("%.3f", f)
+	s = strings.TrimRight(s, "0")
+	s = strings.TrimRight(s, ".")
+
+	if s == "-0" {
+		s = "0"
+	}
+
+	return s
+}
+
+func pdfDate(t time.Time) string {
+	_, offset := t.Zone()
+
+	tz := "Z"
+	if offset != 0 {
+		sign := "+"
+		if offset < 0 {
+			sign = "-"
+			offset = -offset
+		}
+		tz = fmt.Sprintf("%s%02d'%02d'", sign, offset/3600, (offset%3600)/60)
+	}
+
+	return fmt.Sprintf("(D:%s%s)", t.Format("20060102150405"), tz)
+}
+
+// parses a date as written by pdfDate (without the parentheses).  the offset is taken
+// apart by hand, as time.Parse cannot match its minutes between quotes.
+func parsePdfDate(s string) (time.Time, error) {
+	if len(s) < 16 || strings.HasPrefix(s, "D:") == false {
+		return time.Time{}, fmt.Errorf("invalid pdf date: [%s]", s)
+	}
+
+	t, err := time.Parse("20060102150405", s[2:16])
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	tz := strings.TrimSuffix(s[16:], "'")
+	if tz == "" || tz == "Z" {
+		return t, nil
+	}
+
+	var hours, minutes int
+	if len(tz) != 6 || (tz[0] != '+' && tz[0] != '-') || tz[3] != '\'' {
+		return time.Time{}, fmt.Errorf("invalid pdf date offset: [%s]", s)
+	}
+	if _, err := fmt.Sscanf(tz[1:], "%02d'%02d", &hours, &minutes); err != nil {
+		return time.Time{}, fmt.Errorf("invalid pdf date offset: [%s]", s)
+	}
+
+	offset := hours*3600 + minutes*60
+	if tz[0] == '-' {
+		offset = -offset
+	}
+
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.FixedZone("", offset)), nil
+}
+
+// encodes a string for use outside of content streams (document info, outlines, etc.),
+// as a literal string when it is plain ascii, otherwise as UTF-16 with a byte order mark
+func pdfTextString(s string) string {
+	ascii := true
+	for _, r := range s {
+		if r < 0x20 || r > 0x7e {
+			ascii = false
+			break
+		}
+	}
+
+	if ascii == true {
+		return pdfLiteral([]byte(s))
+	}
+
+	var b strings.Builder
+	b.WriteString("<FEFF")
+	for _, u := range utf16.Encode([]rune(s)) {
+		fmt.Fprintf(&b, "%04X", u)
+	}
+	b.WriteString(">")
+
+	return b.String()
+}
+
+// escapes raw bytes as a pdf literal string
+func pdfLiteral(s []byte) string {
+	var b strings.Builder
+
+	b.WriteByte('(')
+	for _, c := range s {
+		switch c {
+		case '(', ')', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString("\\n")
+		case '\r':
+			b.WriteString("\\r")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte(')')
+
+	return b.String()
+}
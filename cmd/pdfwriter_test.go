@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// returns the start of a jpeg: an optional Adobe marker, a huffman table and a frame
+// header of the given type, followed by the start of the scan
+func testJPEGHeader(sof byte, w, h, components int, adobe bool) []byte {
+	var buf bytes.Buffer
+
+	buf.Write([]byte{0xff, 0xd8})
+
+	if adobe == true {
+		buf.Write([]byte{0xff, 0xee, 0x00, 0x0e})
+		buf.WriteString("Adobe")
+		buf.Write([]byte{0x00, 0x64, 0x00, 0x00, 0x00, 0x00, 0x00})
+	}
+
+	// a table segment, which is not a frame header despite its marker
+	buf.Write([]byte{0xff, 0xc4, 0x00, 0x04, 0x00, 0x00})
+
+	// fill bytes may precede any marker
+	buf.Write([]byte{0xff, 0xff, sof})
+	length := 8 + 3*components
+	buf.Write([]byte{byte(length >> 8), byte(length), 8, byte(h >> 8), byte(h), byte(w >> 8), byte(w), byte(components)})
+	for i := 1; i <= components; i++ {
+		buf.Write([]byte{byte(i), 0x11, 0x00})
+	}
+
+	buf.Write([]byte{0xff, 0xda, 0x00, 0x02})
+
+	return buf.Bytes()
+}
+
+// writes a file into the test's temporary directory, returning its name
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	fileName := fmt.Sprintf("%s/%s", t.TempDir(), name)
+	if err := os.WriteFile(fileName, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return fileName
+}
+
+// checks the cross-reference table of a pdf against the objects in it, returning
+// the body of each object by number
+func checkPdfStructure(t *testing.T, pdf []byte) map[int][]byte {
+	t.Helper()
+
+	if bytes.HasPrefix(pdf, []byte("%PDF-1.7\n")) == false {
+		t.Fatalf("missing pdf header")
+	}
+
+	tail := regexp.MustCompile(`startxref\n(\d+)\n%%EOF\n$`).FindSubmatch(pdf)
+	if tail == nil {
+		t.Fatalf("missing startxref")
+	}
+
+	xrefOffset, _ := strconv.Atoi(string(tail[1]))
+	if xrefOffset >= len(pdf) || bytes.HasPrefix(pdf[xrefOffset:], []byte("xref\n0 ")) == false {
+		t.Fatalf("startxref %d does not point at the cross-reference table", xrefOffset)
+	}
+
+	var count int
+	fmt.Sscanf(string(pdf[xrefOffset:]), "xref\n0 %d\n", &count)
+
+	// every entry is exactly 20 bytes, starting after the subsection header
+	entries := pdf[xrefOffset+len(fmt.Sprintf("xref\n0 %d\n", count)):]
+	if bytes.HasPrefix(entries, []byte("0000000000 65535 f \n")) == false {
+		t.Fatalf("cross-reference table does not start with the free entry")
+	}
+
+	objects := make(map[int][]byte)
+
+	for n := 1; n < count; n++ {
+		entry := string(entries[n*20 : (n+1)*20])
+		if strings.HasSuffix(entry, " 00000 n \n") == false {
+			t.Fatalf("object %d: malformed entry [%q]", n, entry)
+		}
+
+		offset, _ := strconv.Atoi(entry[:10])
+		header := fmt.Sprintf("%d 0 obj\n", n)
+		if bytes.HasPrefix(pdf[offset:], []byte(header)) == false {
+			t.Fatalf("object %d: offset %d does not point at its header", n, offset)
+		}
+
+		body := pdf[offset+len(header):]
+		end := bytes.Index(body, []byte("\nendobj\n"))
+		if end < 0 {
+			t.Fatalf("object %d: no endobj", n)
+		}
+		objects[n] = body[:end]
+	}
+
+	trailer := string(entries[count*20:])
+	if strings.HasPrefix(trailer, fmt.Sprintf("trailer\n<< /Size %d ", count)) == false {
+		t.Errorf("trailer does not give the size as %d: %s", count, trailer)
+	}
+
+	return objects
+}
+
+// returns the dictionary and data of a stream object
+func splitPdfStream(t *testing.T, object []byte) (string, []byte) {
+	t.Helper()
+
+	dict, data, found := bytes.Cut(object, []byte("\nstream\n"))
+	if found == false || bytes.HasSuffix(data, []byte("\nendstream")) == false {
+		t.Fatalf("not a stream object: %.40q", object)
+	}
+
+	return string(dict), bytes.TrimSuffix(data, []byte("\nendstream"))
+}
+
+func TestPdfDateRoundTrip(t *testing.T) {
+	base := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		zone *time.Location
+		want string
+	}{
+		{time.UTC, "(D:20260101120000Z)"},
+		{time.FixedZone("IST", 5*3600+30*60), "(D:20260101173000+05'30')"},
+		{time.FixedZone("NST", -(3*3600 + 30*60)), "(D:20260101083000-03'30')"},
+		{time.FixedZone("EST", -5*3600), "(D:20260101070000-05'00')"},
+		{time.FixedZone("NPT", 5*3600+45*60), "(D:20260101174500+05'45')"},
+	}
+
+	for _, test := range tests {
+		written := pdfDate(base.In(test.zone))
+		if written != test.want {
+			t.Errorf("%s: wrote %s, want %s", test.zone, written, test.want)
+			continue
+		}
+
+		parsed, err := parsePdfDate(strings.Trim(written, "()"))
+		if err != nil {
+			t.Errorf("%s: %s", test.zone, err.Error())
+			continue
+		}
+
+		if parsed.Equal(base) == false {
+			t.Errorf("%s: parsed %s back as %s", test.zone, written, parsed)
+		}
+	}
+}
+
+func TestParsePdfDate(t *testing.T) {
+	tests := []struct {
+		date string
+		want string // RFC 3339, or "" if invalid
+	}{
+		{"D:20260101120000", "2026-01-01T12:00:00Z"},
+		{"D:20260101120000+05'30", "2026-01-01T12:00:00+05:30"},
+		{"D:20260101120000Z", "2026-01-01T12:00:00Z"},
+		{"20260101120000Z", ""},
+		{"D:2026010112", ""},
+		{"D:20260101120000+0530", ""},
+		{"D:20260101120000+05'xx'", ""},
+	}
+
+	for _, test := range tests {
+		parsed, err := parsePdfDate(test.date)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%s: parsed as %s, want an error", test.date, parsed)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", test.date, err.Error())
+			continue
+		}
+
+		if got := parsed.Format(time.RFC3339); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.date, got, test.want)
+		}
+	}
+}
+
+func TestReadJpegInfo(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want jpegInfo // zero if the file is rejected
+	}{
+		{"baseline rgb", testJPEGHeader(0xc0, 640, 480, 3, false), jpegInfo{width: 640, height: 480, components: 3, bits: 8}},
+		{"progressive gray", testJPEGHeader(0xc2, 300, 4000, 1, false), jpegInfo{width: 300, height: 4000, components: 1, bits: 8}},
+		{"adobe cmyk", testJPEGHeader(0xc0, 100, 200, 4, true), jpegInfo{width: 100, height: 200, components: 4, bits: 8, adobe: true}},
+		{"encoded", testJPEG(t, 1, 41, 60), jpegInfo{width: 41, height: 60, components: 3, bits: 8}},
+		{"no dimensions", testJPEGHeader(0xc0, 0, 480, 3, false), jpegInfo{}},
+		{"not a jpeg", []byte("\x89PNG\r\n\x1a\n"), jpegInfo{}},
+		{"empty", nil, jpegInfo{}},
+		{"truncated", testJPEGHeader(0xc0, 640, 480, 3, false)[:14], jpegInfo{}},
+		{"scan before frame", []byte{0xff, 0xd8, 0xff, 0xda, 0x00, 0x02}, jpegInfo{}},
+	}
+
+	for _, test := range tests {
+		info, err := readJpegInfo(writeTestFile(t, "page.jpg", test.data))
+
+		if test.want == (jpegInfo{}) {
+			if err == nil {
+				t.Errorf("%s: read %+v, want an error", test.name, info)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+
+		if info != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, info, test.want)
+		}
+	}
+}
+
+// images are embedded byte for byte, described by their own headers
+func TestJpegImagePassthrough(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		dict string
+	}{
+		{"rgb", testJPEG(t, 2, 42, 60), "/Width 42 /Height 60 /BitsPerComponent 8 /Filter /DCTDecode /ColorSpace /DeviceRGB"},
+		{"gray", testJPEGHeader(0xc0, 10, 20, 1, false), "/Width 10 /Height 20 /BitsPerComponent 8 /Filter /DCTDecode /ColorSpace /DeviceGray"},
+		{"cmyk", testJPEGHeader(0xc0, 10, 20, 4, false), "/ColorSpace /DeviceCMYK /Length"},
+		{"adobe cmyk", testJPEGHeader(0xc0, 10, 20, 4, true), "/ColorSpace /DeviceCMYK /Decode [1 0 1 0 1 0 1 0] /Length"},
+	}
+
+	for _, test := range tests {
+		jpgFile := writeTestFile(t, "page.jpg", test.data)
+		pdfFile := writeTestFile(t, "test.pdf", nil)
+
+		info, err := readJpegInfo(jpgFile)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err.Error())
+		}
+
+		p, err := createPdf(pdfFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		imageObj, err := p.jpegImage(jpgFile, info)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err.Error())
+		}
+
+		p.addImagePage(imageObj, 100, 200)
+
+		if err := p.close(); err != nil {
+			t.Fatalf("%s: %s", test.name, err.Error())
+		}
+
+		pdf, _ := os.ReadFile(pdfFile)
+		objects := checkPdfStructure(t, pdf)
+
+		dict, data := splitPdfStream(t, objects[imageObj])
+
+		if strings.Contains(dict, test.dict) == false {
+			t.Errorf("%s: image dictionary %s does not contain %s", test.name, dict, test.dict)
+		}
+
+		if strings.Contains(dict, fmt.Sprintf("/Length %d ", len(test.data))) == false {
+			t.Errorf("%s: image dictionary %s does not give the length as %d", test.name, dict, len(test.data))
+		}
+
+		if bytes.Equal(data, test.data) == false {
+			t.Errorf("%s: embedded image differs from the jpeg", test.name)
+		}
+	}
+}
+
+func TestJpegImageUnsupportedComponents(t *testing.T) {
+	jpgFile := writeTestFile(t, "page.jpg", testJPEGHeader(0xc0, 10, 20, 2, false))
+
+	p, err := createPdf(writeTestFile(t, "test.pdf", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.file.Close()
+
+	info, _ := readJpegInfo(jpgFile)
+	if _, err := p.jpegImage(jpgFile, info); err == nil {
+		t.Errorf("two component image embedded without error")
+	}
+}
+
+// every object can be found through the cross-reference table, which the trailer
+// points at, and the page tree lists each page in order
+func TestPdfCrossReference(t *testing.T) {
+	pdfFile := writeTestFile(t, "test.pdf", nil)
+
+	p, err := createPdf(pdfFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pages []string
+	for i := 1; i <= 3; i++ {
+		jpgFile := writeTestFile(t, fmt.Sprintf("page-%d.jpg", i), testJPEG(t, i, 40+i, 60))
+
+		info, err := readJpegInfo(jpgFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		imageObj, err := p.jpegImage(jpgFile, info)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pages = append(pages, fmt.Sprintf("%d 0 R", p.addImagePage(imageObj, float64(40+i), 60)))
+	}
+
+	p.info = append(p.info, "/Title (A Book)")
+
+	if err := p.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	pdf, _ := os.ReadFile(pdfFile)
+	objects := checkPdfStructure(t, pdf)
+
+	want := fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count 3 >>", strings.Join(pages, " "))
+	if got := string(objects[p.pagesObj]); got != want {
+		t.Errorf("page tree is %s, want %s", got, want)
+	}
+
+	// 3 images, 3 content streams, 3 pages, and the page tree, catalog and info
+	if len(objects) != 12 {
+		t.Errorf("found %d objects, want 12", len(objects))
+	}
+
+	trailer := pdf[bytes.LastIndex(pdf, []byte("trailer\n")):]
+	var root, info int
+	fmt.Sscanf(string(trailer), "trailer\n<< /Size 13 /Root %d 0 R /Info %d 0 R", &root, &info)
+
+	if strings.HasPrefix(string(objects[root]), "<< /Type /Catalog ") == false {
+		t.Errorf("trailer root %d is not the catalog: %s", root, objects[root])
+	}
+
+	if strings.Contains(string(objects[info]), "/Title (A Book)") == false {
+		t.Errorf("trailer info %d is not the document info: %s", info, objects[info])
+	}
+}
+
+func TestPdfWithoutPages(t *testing.T) {
+	p, err := createPdf(writeTestFile(t, "test.pdf", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.close(); err == nil {
+		t.Errorf("pdf without pages closed without error")
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// identifies this process as the owner of the jobs it is working on
+var instanceID string
+
+// records which instance is responsible for a job, and when it last checked in
+type jobOwner struct {
+	Instance  string    `json:"instance"`
+	Heartbeat time.Time `json:"heartbeat"`
+	Job       pdfJob    `json:"job"`
+}
+
+func initInstanceID() {
+	host, _ := os.Hostname()
+	if host == "" {
+		host = "unknown"
+	}
+
+	instanceID = fmt.Sprintf("%s-%d-%s", host, os.Getpid(), randomHex(4))
+}
+
+func heartbeatInterval() time.Duration {
+	// check in several times within the stale threshold, so that a single
+	// slow write does not get a healthy job mistaken for an abandoned one
+	interval := time.Duration(config.staleJobSeconds.value) * time.Second / 5
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	return interval
+}
+
+func ownerFile(workDir string) string {
+	return fmt.Sprintf("%s/owner.json", workDir)
+}
+
+func writeJobOwner(job *pdfJob) {
+	workDir := getWorkDir(job.WorkSubDir)
+
+	// nothing to do if the work directory was removed out from under the job
+	if _, err := os.Stat(workDir); err != nil {
+		return
+	}
+
+	owner := jobOwner{
+		Instance:  instanceID,
+		Heartbeat: time.Now(),
+		Job:       *job,
+	}
+
+	buf, err := json.Marshal(owner)
+	if err != nil {
+		log.Printf("WARNING: unable to serialize owner for [%s]: %s", job.WorkSubDir, err.Error())
+		return
+	}
+
+	if err := writeFileAtomic(ownerFile(workDir), buf); err != nil {
+		log.Printf("WARNING: unable to write owner for [%s]: %s", job.WorkSubDir, err.Error())
+	}
+}
+
+func readJobOwner(workDir string) (*jobOwner, error) {
+	buf, err := os.ReadFile(ownerFile(workDir))
+	if err != nil {
+		return nil, err
+	}
+
+	var owner jobOwner
+	if err := json.Unmarshal(buf, &owner); err != nil {
+		return nil, err
+	}
+
+	if owner.Job.WorkSubDir == "" {
+		owner.Job.WorkSubDir = getWorkSubDir(owner.Job.Pid, owner.Job.Unit, owner.Job.Token)
+	}
+
+	return &owner, nil
+}
+
+func (o *jobOwner) isAlive() bool {
+	return time.Since(o.Heartbeat) < time.Duration(config.staleJobSeconds.value)*time.Second
+}
+
+// returns true if the owner is an earlier process on this host that is no longer
+// running: either its pid is gone, or it is ours (as when restarted in a container)
+func (o *jobOwner) isPreviousRun() bool {
+	if o.Instance == instanceID {
+		return false
+	}
+
+	host, pid, ok := parseInstanceID(o.Instance)
+	if ok == false {
+		return false
+	}
+
+	ourHost, ourPid, _ := parseInstanceID(instanceID)
+	if host != ourHost {
+		return false
+	}
+
+	if pid == ourPid {
+		return true
+	}
+
+	return syscall.Kill(pid, 0) == syscall.ESRCH
+}
+
+// splits an instance id into its host and pid.  host names may contain dashes,
+// so the fields are taken from the end.
+func parseInstanceID(id string) (string, int, bool) {
+	parts := strings.Split(id, "-")
+	if len(parts) < 3 {
+		return "", 0, false
+	}
+
+	pid, err := strconv.Atoi(parts[len(parts)-2])
+	if err != nil || pid <= 0 {
+		return "", 0, false
+	}
+
+	return strings.Join(parts[:len(parts)-2], "-"), pid, true
+}
+
+// returns true if the job in this work directory is held by another live instance
+func ownedElsewhere(workSubDir string) bool {
+	owner, err := readJobOwner(getWorkDir(workSubDir))
+	if err != nil {
+		return false
+	}
+
+	return owner.Instance != instanceID && owner.isAlive() == true
+}
+
+// returns true if the in-progress job in this work directory has stopped making progress
+func (c *clientContext) isStale() bool {
+	if jobs.owns(c.pdf.workSubDir) == true {
+		return false
+	}
+
+	owner, err := readJobOwner(c.pdf.workDir)
+	if err == nil {
+		return owner.isAlive() == false
+	}
+
+	// work directories created before owners were recorded only have their last update to go on
+	state := c.loadState()
+	if state == nil {
+		return false
+	}
+
+	return time.Since(state.Updated) >= time.Duration(config.staleJobSeconds.value)*time.Second
+}
+
+// takes over an abandoned job, either queueing another attempt or failing it outright
+func (c *clientContext) recoverStaleJob() {
+	// make sure no other instance is recovering this job at the same time
+	if c.claimed == false {
+		unlock, err := lockWorkSubDir(c.pdf.workSubDir)
+		if err != nil {
+			c.warn("unable to claim abandoned job in [%s]: %s", c.pdf.workDir, err.Error())
+			return
+		}
+		defer unlock()
+
+		if c.isDone() == true || c.isFailed() == true || c.isStale() == false {
+			return
+		}
+	}
+
+	owner, err := readJobOwner(c.pdf.workDir)
+	if err != nil || owner.Job.Pid == "" {
+		c.warn("abandoned job in [%s] has no owner record; marking it failed", c.pdf.workDir)
+		c.setFailed("PDF generation was interrupted")
+		return
+	}
+
+	job := owner.Job
+
+	if job.Attempts+1 >= config.maxJobAttempts.value {
+		c.warn("job %s in [%s] abandoned by %s (heartbeat %s) after %d attempts; marking it failed",
+			job.ID, c.pdf.workDir, owner.Instance, owner.Heartbeat.Format(time.RFC3339), job.Attempts+1)
+		c.setFailed(fmt.Sprintf("PDF generation was interrupted %d times; giving up", job.Attempts+1))
+		return
+	}
+
+	c.warn("job %s in [%s] abandoned by %s (heartbeat %s); requeueing",
+		job.ID, c.pdf.workDir, owner.Instance, owner.Heartbeat.Format(time.RFC3339))
+
+	if err := jobs.requeue(&job); err != nil {
+		c.err("failed to requeue job: %s", err.Error())
+		c.setFailed("Unable to queue PDF generation")
+	}
+}
+
+// scans the storage directory for in-progress jobs whose owners have gone away
+func recoverStaleJobs() {
+	start := time.Now()
+	found := 0
+
+	root := config.storageDir.value
+
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() == false || path == root {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(root, path)
+
+		if strings.HasPrefix(rel, ".") {
+			return filepath.SkipDir
+		}
+
+		// work directories live at most two levels down (pid, or pid/unit)
+		if strings.Count(rel, string(filepath.Separator)) > 1 {
+			return filepath.SkipDir
+		}
+
+		c := &clientContext{reqID: "recovery", ip: "-"}
+		c.pdf.workSubDir = filepath.ToSlash(rel)
+		c.pdf.workDir = path
+
+		if c.isDone() == true || c.isFailed() == true || c.isInProgress() == false {
+			return nil
+		}
+
+		if c.isStale() == true {
+			found++
+			c.recoverStaleJob()
+		}
+
+		return nil
+	})
+
+	if found > 0 {
+		log.Printf("INFO: stale job scan found %d abandoned jobs in %0.2f seconds", found, time.Since(start).Seconds())
+	}
+}
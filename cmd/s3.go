@@ -0,0 +1,512 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// locations of pdfs in s3 storage look like s3://bucket/key
+const s3LocationPrefix = "s3://"
+
+// the payload hash used when the body is not signed, as for presigned urls
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// keeps pdfs in an s3-compatible object store (AWS S3, MinIO, etc.).  requests are
+// signed with AWS signature version 4.  AWS itself is addressed as bucket.host;
+// any other endpoint is addressed as host/bucket, which is what MinIO expects.
+type s3Storage struct {
+	endpoint      *url.URL
+	virtualHosted bool
+	region        string
+	bucket        string
+	prefix        string
+	accessKey     string
+	secretKey     string
+	redirect      bool
+	urlExpiry     time.Duration
+	client        *http.Client
+}
+
+// the error document returned by s3 for failed requests
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func newS3Storage() *s3Storage {
+	s := s3Storage{
+		region:    config.s3Region.value,
+		bucket:    config.s3Bucket.value,
+		prefix:    strings.Trim(config.s3Prefix.value, "/"),
+		accessKey: config.s3AccessKey.value,
+		secretKey: config.s3SecretKey.value,
+		redirect:  config.s3Downloads.value == "redirect",
+		urlExpiry: time.Duration(config.s3URLExpiry.value) * time.Second,
+	}
+
+	endpoint := config.s3Endpoint.value
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s.region)
+		s.virtualHosted = true
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		log.Fatalf("invalid s3 endpoint: [%s]", endpoint)
+	}
+	s.endpoint = u
+
+	if s.prefix != "" {
+		s.prefix += "/"
+	}
+
+	// no overall timeout, as pdfs can be large; just guard against unresponsive servers
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = 60 * time.Second
+	s.client = &http.Client{Transport: transport}
+
+	return &s
+}
+
+func s3Location(bucket, key string) string {
+	return fmt.Sprintf("%s%s/%s", s3LocationPrefix, bucket, key)
+}
+
+func parseS3Location(location string) (string, string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(location, s3LocationPrefix), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid s3 location: %s", location)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// returns the url of an object, with its path already in canonical (signed) form
+func (s *s3Storage) objectURL(bucket, key string) *url.URL {
+	host := s.endpoint.Host
+	path := strings.TrimSuffix(s.endpoint.Path, "/")
+
+	if s.virtualHosted == true {
+		host = fmt.Sprintf("%s.%s", bucket, host)
+	} else {
+		path = fmt.Sprintf("%s/%s", path, bucket)
+	}
+
+	rawPath := fmt.Sprintf("%s/%s", s3Encode(path, false), s3Encode(key, false))
+
+	u := url.URL{Scheme: s.endpoint.Scheme, Host: host, RawPath: rawPath}
+	u.Path, _ = url.PathUnescape(rawPath)
+
+	return &u
+}
+
+func (s *s3Storage) store(ctx context.Context, workSubDir, pdfFile string) (string, error) {
+	key := fmt.Sprintf("%s%s/%s", s.prefix, workSubDir, filepath.Base(pdfFile))
+
+	if err := s.putObject(ctx, key, pdfFile); err != nil {
+		return "", err
+	}
+
+	// the stored copy is the one that gets served from now on
+	if err := os.Remove(pdfFile); err != nil {
+		log.Printf("WARNING: unable to remove local copy of stored pdf [%s]: %s", pdfFile, err.Error())
+	}
+
+	return s3Location(s.bucket, key), nil
+}
+
+func (s *s3Storage) putObject(ctx context.Context, key, fileName string) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// the body is signed too, so it gets read twice
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", s.objectURL(s.bucket, key).String(), f)
+	if err != nil {
+		return err
+	}
+
+	req.ContentLength = fi.Size()
+	req.Header.Set("Content-Type", "application/pdf")
+
+	res, err := s.do(req, hex.EncodeToString(h.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	return nil
+}
+
+func (s *s3Storage) stat(ctx context.Context, location string) (storedPdf, error) {
+	res, err := s.request(ctx, "HEAD", location)
+	if err != nil {
+		return storedPdf{}, err
+	}
+	res.Body.Close()
+
+	pdf := storedPdf{size: res.ContentLength}
+	if modified, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		pdf.modified = modified
+	}
+
+	return pdf, nil
+}
+
+func (s *s3Storage) open(ctx context.Context, location string) (io.ReadSeekCloser, error) {
+	if _, _, err := parseS3Location(location); err != nil {
+		return nil, err
+	}
+
+	return &s3ObjectReader{ctx: ctx, store: s, location: location, size: -1}, nil
+}
+
+func (s *s3Storage) downloadURL(location, fileName string) (string, error) {
+	if s.redirect == false {
+		return "", nil
+	}
+
+	bucket, key, err := parseS3Location(location)
+	if err != nil {
+		return "", err
+	}
+
+	// have the object store send the same headers this service would
+	query := url.Values{}
+	query.Set("response-content-disposition", fmt.Sprintf(`attachment; filename="%s"`, fileName))
+	query.Set("response-content-type", "application/pdf")
+
+	return s.presign("GET", s.objectURL(bucket, key), query, time.Now().UTC()), nil
+}
+
+func (s *s3Storage) remove(ctx context.Context, location string) error {
+	res, err := s.request(ctx, "DELETE", location)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	return nil
+}
+
+// makes a bodiless request for the object at a location
+func (s *s3Storage) request(ctx context.Context, method, location string) (*http.Response, error) {
+	bucket, key, err := parseS3Location(location)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(bucket, key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.do(req, hex.EncodeToString(sha256.New().Sum(nil)))
+}
+
+// fetches an object from an offset onwards
+func (s *s3Storage) get(ctx context.Context, location string, offset int64) (io.ReadCloser, error) {
+	bucket, key, err := parseS3Location(location)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", s.objectURL(bucket, key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	res, err := s.do(req, hex.EncodeToString(sha256.New().Sum(nil)))
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Body, nil
+}
+
+// reads an object from wherever it is positioned, fetching it only once read, so
+// that downloads streamed through this service can answer range requests without
+// transferring the whole object.  the size is looked up only if seeking from the end.
+type s3ObjectReader struct {
+	ctx      context.Context
+	store    *s3Storage
+	location string
+	size     int64 // -1 until looked up
+	offset   int64
+	body     io.ReadCloser
+}
+
+func (r *s3ObjectReader) Read(p []byte) (int, error) {
+	if r.size >= 0 && r.offset >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.body == nil {
+		body, err := r.store.get(r.ctx, r.location, r.offset)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+
+	return n, err
+}
+
+func (r *s3ObjectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+
+	case io.SeekCurrent:
+		offset += r.offset
+
+	case io.SeekEnd:
+		if r.size < 0 {
+			pdf, err := r.store.stat(r.ctx, r.location)
+			if err != nil {
+				return 0, err
+			}
+			r.size = pdf.size
+		}
+		offset += r.size
+
+	default:
+		return 0, errors.New("s3 object reader: invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("s3 object reader: negative position")
+	}
+
+	// the next read starts a new request from here
+	if offset != r.offset {
+		r.Close()
+		r.offset = offset
+	}
+
+	return offset, nil
+}
+
+func (r *s3ObjectReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+
+	err := r.body.Close()
+	r.body = nil
+
+	return err
+}
+
+// signs and sends a request, turning error responses into errors
+func (s *s3Storage) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	s.sign(req, payloadHash, time.Now().UTC())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= 200 && res.StatusCode <= 299 {
+		return res, nil
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, os.ErrNotExist
+	}
+
+	var s3err s3Error
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 64*1024))
+	if xml.Unmarshal(body, &s3err) == nil && s3err.Code != "" {
+		return nil, fmt.Errorf("s3 %s %s: %s (%s: %s)", req.Method, req.URL.Path, res.Status, s3err.Code, s3err.Message)
+	}
+
+	return nil, fmt.Errorf("s3 %s %s: %s", req.Method, req.URL.Path, res.Status)
+}
+
+// adds an AWS signature version 4 authorization header to a request
+func (s *s3Storage) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+
+	canonical, signed := s3CanonicalHeaders(headers)
+	request := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonical,
+		signed,
+		payloadHash,
+	}, "\n")
+
+	scope := s.scope(now)
+	signature := s.signature(now, s3StringToSign(amzDate, scope, request))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.accessKey, scope, signed, signature))
+}
+
+// returns a url granting temporary access to an object without credentials
+func (s *s3Storage) presign(method string, u *url.URL, query url.Values, now time.Time) string {
+	amzDate := now.Format("20060102T150405Z")
+	scope := s.scope(now)
+
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", fmt.Sprintf("%s/%s", s.accessKey, scope))
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", fmt.Sprintf("%d", int(s.urlExpiry.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonical, signed := s3CanonicalHeaders(map[string]string{"host": u.Host})
+	canonicalQuery := s3CanonicalQuery(query)
+
+	request := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		canonicalQuery,
+		canonical,
+		signed,
+		s3UnsignedPayload,
+	}, "\n")
+
+	signature := s.signature(now, s3StringToSign(amzDate, scope, request))
+
+	presigned := *u
+	presigned.RawQuery = fmt.Sprintf("%s&X-Amz-Signature=%s", canonicalQuery, signature)
+
+	return presigned.String()
+}
+
+func (s *s3Storage) scope(now time.Time) string {
+	return fmt.Sprintf("%s/%s/s3/aws4_request", now.Format("20060102"), s.region)
+}
+
+func (s *s3Storage) signature(now time.Time, stringToSign string) string {
+	key := s3HMAC([]byte("AWS4"+s.secretKey), now.Format("20060102"))
+	key = s3HMAC(key, s.region)
+	key = s3HMAC(key, "s3")
+	key = s3HMAC(key, "aws4_request")
+
+	return hex.EncodeToString(s3HMAC(key, stringToSign))
+}
+
+func s3StringToSign(amzDate, scope, canonicalRequest string) string {
+	h := sha256.Sum256([]byte(canonicalRequest))
+
+	return strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(h[:])}, "\n")
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// returns the canonical header block and the list of signed header names
+func s3CanonicalHeaders(headers map[string]string) (string, string) {
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonical strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonical, "%s:%s\n", name, strings.TrimSpace(headers[name]))
+	}
+
+	return canonical.String(), strings.Join(names, ";")
+}
+
+// returns the query parameters encoded and sorted by name, then by value
+func s3CanonicalQuery(query url.Values) string {
+	encoded := make(map[string][]string)
+	var names []string
+
+	for name, values := range query {
+		key := s3Encode(name, true)
+		names = append(names, key)
+
+		for _, value := range values {
+			encoded[key] = append(encoded[key], s3Encode(value, true))
+		}
+		sort.Strings(encoded[key])
+	}
+	sort.Strings(names)
+
+	var params []string
+	for _, name := range names {
+		for _, value := range encoded[name] {
+			params = append(params, fmt.Sprintf("%s=%s", name, value))
+		}
+	}
+
+	return strings.Join(params, "&")
+}
+
+// percent-encodes everything but the unreserved characters, as signature version 4 requires
+func s3Encode(s string, encodeSlash bool) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+
+		switch {
+		case ch >= 'A' && ch <= 'Z', ch >= 'a' && ch <= 'z', ch >= '0' && ch <= '9', ch == '-', ch == '_', ch == '.', ch == '~':
+			b.WriteByte(ch)
+
+		case ch == '/' && encodeSlash == false:
+			b.WriteByte(ch)
+
+		default:
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+
+	return b.String()
+}
@@ -17,6 +17,8 @@ type solrDoc struct {
 	PublishedDaterange []string `json:"published_daterange,omitempty"`
 	AlternateID        []string `json:"alternate_id_a,omitempty"`
 	RightsWrapper      []string `json:"rights_wrapper_a,omitempty"`
+
+	fields map[string]interface{} // every field in the record, for lookups by name
 }
 
 type solrResponse struct {
@@ -35,7 +37,31 @@ type solrInfo struct {
 	Response       solrResponse       `json:"response,omitempty"`
 }
 
+// returns the values of a field by name, whether it is single- or multi-valued
+func (d *solrDoc) fieldValues(name string) []string {
+	var values []string
+
+	switch v := d.fields[name].(type) {
+	case nil:
+		// field not present
+
+	case []interface{}:
+		for _, item := range v {
+			values = append(values, fmt.Sprintf("%v", item))
+		}
+
+	default:
+		values = append(values, fmt.Sprintf("%v", v))
+	}
+
+	return values
+}
+
 func (c *clientContext) solrGetInfo() error {
+	if isMergePid(c.req.pid) == true {
+		return c.solrGetMergeInfo()
+	}
+
 	url := config.solrURLTemplate.value
 	url = strings.Replace(url, "{PID}", c.req.pid, -1)
 
@@ -65,6 +91,19 @@ func (c *clientContext) solrGetInfo() error {
 		return fmt.Errorf("failed to unmarshal solr response: [%s]", buf)
 	}
 
+	// also keep the full records, so that any field can be looked up by name
+	var raw struct {
+		Response struct {
+			Docs []map[string]interface{} `json:"docs"`
+		} `json:"response"`
+	}
+
+	if jErr := json.Unmarshal(buf, &raw); jErr == nil && len(raw.Response.Docs) == len(solr.Response.Docs) {
+		for i := range solr.Response.Docs {
+			solr.Response.Docs[i].fields = raw.Response.Docs[i]
+		}
+	}
+
 	c.info("status              : %d", solr.ResponseHeader.Status)
 	c.info("numFound            : %d", solr.Response.NumFound)
 	c.info("start               : %d", solr.Response.Start)
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// how often a running job's progress is written out to its state, as it moves through pages
+const progressSaveInterval = 2 * time.Second
+
+// generation progress details, kept in memory while a job runs and recorded in its state
+type jobProgress struct {
+	Stage      string    `json:"stage"`
+	Step       int       `json:"step"`
+	Steps      int       `json:"steps"`
+	PagesDone  int       `json:"pages_done"`
+	PagesTotal int       `json:"pages_total"`
+	Started    time.Time `json:"started,omitempty"`
+}
+
+// the json status representation
+type pdfStatus struct {
+	JobID         string     `json:"job_id,omitempty"`
+	Pid           string     `json:"pid"`
+	State         string     `json:"state"` // not_found, queued, processing, ready, or failed
+	Percent       int        `json:"percent"`
+	Stage         string     `json:"stage,omitempty"`
+	PagesDone     int        `json:"pages_done"`
+	PagesTotal    int        `json:"pages_total"`
+	QueuePosition int        `json:"queue_position,omitempty"`
+	Started       *time.Time `json:"started,omitempty"`
+	Finished      *time.Time `json:"finished,omitempty"`
+	FailureReason string     `json:"failure_reason,omitempty"`
+	PdfSize       int64      `json:"pdf_size,omitempty"`
+	DownloadURL   string     `json:"download_url,omitempty"`
+}
+
+// records the current stage of generation, and how many of its pages are done
+func (c *clientContext) setStage(stage string, pagesDone, pagesTotal int) {
+	c.pdf.progress.Stage = stage
+	c.pdf.progress.PagesDone = pagesDone
+	c.pdf.progress.PagesTotal = pagesTotal
+
+	c.writeProgress()
+}
+
+func (c *clientContext) writeProgress() {
+	if c.cancelled() == true {
+		return
+	}
+
+	progress := c.pdf.progress
+	progressEvents.publish(c.pdf.workSubDir, &progress)
+
+	// progress moves on with every page, so the job state is only rewritten when the
+	// stage or step count changes, at the last step, or once it has gone stale
+	if progress.Stage == c.pdf.saved.Stage && progress.Steps == c.pdf.saved.Steps &&
+		progress.Step < progress.Steps && time.Since(c.pdf.savedAt) < progressSaveInterval {
+		return
+	}
+
+	c.updateState(func(state *jobState) {
+		state.setProgress(progress)
+	})
+
+	c.pdf.saved = progress
+	c.pdf.savedAt = time.Now()
+}
+
+func fileModTime(fileName string) *time.Time {
+	fi, err := os.Stat(fileName)
+	if err != nil {
+		return nil
+	}
+
+	t := fi.ModTime()
+	return &t
+}
+
+// returns true if the client asked for the json status representation
+func (c *clientContext) wantsJSON() bool {
+	if strings.HasSuffix(c.ctx.Request.URL.Path, ".json") == true {
+		return true
+	}
+
+	return c.ctx.NegotiateFormat(gin.MIMEPlain, gin.MIMEJSON) == gin.MIMEJSON
+}
+
+// builds the download url for this pdf, keeping the options that select its work directory
+func (c *clientContext) downloadURL() string {
+	query := url.Values{}
+
+	if c.req.unit != "" {
+		query.Set("unit", c.req.unit)
+	}
+
+	if c.req.token != "" {
+		query.Set("token", c.req.token)
+	}
+
+	if c.req.cover != config.coverPosition.value {
+		query.Set("cover", c.req.cover)
+	}
+
+	if c.req.format != config.pdfFormat.value {
+		query.Set("format", c.req.format)
+	}
+
+	if c.req.ocr != "" {
+		query.Set("ocr", c.req.ocr)
+	}
+
+	downloadURL := fmt.Sprintf("/pdf/%s/download", url.PathEscape(c.req.pid))
+	if len(query) > 0 {
+		downloadURL = fmt.Sprintf("%s?%s", downloadURL, query.Encode())
+	}
+
+	return downloadURL
+}
+
+// gathers the full status of this pdf; assumes progressInValidState() has been checked
+func (c *clientContext) getStatus() pdfStatus {
+	return c.statusFromState(c.loadState())
+}
+
+// builds the status reported for a job state, whether it was read from disk or
+// built from an in-process progress notification
+func (c *clientContext) statusFromState(state *jobState) pdfStatus {
+	status := pdfStatus{JobID: jobID(c.pdf.workSubDir), Pid: c.req.pid, State: "processing"}
+
+	if state == nil {
+		return status
+	}
+
+	status.Percent = state.Percent
+	status.Stage = state.Stage
+	status.PagesDone = state.PagesDone
+	status.PagesTotal = state.PagesTotal
+	status.Started = state.Started
+
+	switch state.State {
+	case "ready":
+		status.State = "ready"
+		status.Stage = ""
+		status.Percent = 100
+		status.PagesDone = status.PagesTotal
+		status.Finished = state.Finished
+		status.PdfSize = state.Size
+		status.DownloadURL = c.downloadURL()
+
+	case "failed":
+		status.State = "failed"
+		status.Finished = state.Finished
+		status.FailureReason = state.Error
+
+	default:
+		if pos := jobs.position(c.pdf.workSubDir); pos > 0 {
+			status.State = "queued"
+			status.Stage = "queued"
+			status.QueuePosition = pos
+		}
+	}
+
+	return status
+}
+
+func (c *clientContext) respondStatusJSON(code int, status pdfStatus) {
+	c.respondJSON(code, status)
+}
+
+func (c *clientContext) respondJSON(code int, v interface{}) {
+	output, jsonErr := json.Marshal(v)
+	if jsonErr != nil {
+		c.err("failed to serialize status: %s", jsonErr.Error())
+		c.respondString(http.StatusInternalServerError, "")
+		return
+	}
+
+	c.respondData(code, gin.MIMEJSON, output)
+}
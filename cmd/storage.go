@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// details of a finished pdf, wherever it is stored
+type storedPdf struct {
+	size     int64
+	modified time.Time
+}
+
+// where finished pdfs are kept.  a pdf is generated in its work directory, then
+// handed to the storage backend, which returns a location recorded in the job state.
+// work directories themselves (page images, progress, markers) always stay local.
+type pdfStorage interface {
+	// takes ownership of a finished pdf, returning the location to record for it
+	store(ctx context.Context, workSubDir, pdfFile string) (string, error)
+
+	stat(ctx context.Context, location string) (storedPdf, error)
+
+	// opens the pdf for reading from any position, for range requests.  the context
+	// covers every read, not just the open.
+	open(ctx context.Context, location string) (io.ReadSeekCloser, error)
+
+	// returns a url the client can download the pdf from directly, or "" if the
+	// pdf should be streamed through this service instead
+	downloadURL(location, fileName string) (string, error)
+
+	remove(ctx context.Context, location string) error
+}
+
+// keeps pdfs in their work directories.  locations are relative to the storage
+// directory, though pdfs recorded by older versions may have absolute ones.
+type localStorage struct{}
+
+// the backend new pdfs are stored in
+var storage pdfStorage
+
+// set up when the s3 backend is configured, and used for any pdf stored there
+var s3Store *s3Storage
+
+func initStorage() {
+	storage = localStorage{}
+
+	if config.s3Bucket.value != "" {
+		s3Store = newS3Storage()
+		log.Printf("INFO: s3 storage: bucket [%s] at [%s]", s3Store.bucket, s3Store.endpoint.String())
+	}
+
+	if config.storageBackend.value == "s3" {
+		storage = s3Store
+	}
+
+	log.Printf("INFO: storing finished pdfs in %s storage", config.storageBackend.value)
+}
+
+// returns the backend holding the pdf at this location.  pdfs keep the backend they
+// were stored in, so switching backends does not strand anything already generated.
+func storageFor(location string) (pdfStorage, error) {
+	if strings.HasPrefix(location, s3LocationPrefix) == true {
+		if s3Store == nil {
+			return nil, fmt.Errorf("pdf is in s3 storage, which is not configured: %s", location)
+		}
+		return s3Store, nil
+	}
+
+	return localStorage{}, nil
+}
+
+func (s localStorage) path(location string) string {
+	if filepath.IsAbs(location) == true {
+		return location
+	}
+
+	return fmt.Sprintf("%s/%s", config.storageDir.value, location)
+}
+
+func (s localStorage) store(ctx context.Context, workSubDir, pdfFile string) (string, error) {
+	return fmt.Sprintf("%s/%s", workSubDir, filepath.Base(pdfFile)), nil
+}
+
+func (s localStorage) stat(ctx context.Context, location string) (storedPdf, error) {
+	fi, err := os.Stat(s.path(location))
+	if err != nil {
+		return storedPdf{}, err
+	}
+
+	return storedPdf{size: fi.Size(), modified: fi.ModTime()}, nil
+}
+
+func (s localStorage) open(ctx context.Context, location string) (io.ReadSeekCloser, error) {
+	return os.Open(s.path(location))
+}
+
+func (s localStorage) downloadURL(location, fileName string) (string, error) {
+	return "", nil
+}
+
+func (s localStorage) remove(ctx context.Context, location string) error {
+	if err := os.Remove(s.path(location)); err != nil && os.IsNotExist(err) == false {
+		return err
+	}
+
+	return nil
+}
+
+// returns the location of the finished pdf and the backend holding it
+func (c *clientContext) storedPdf() (string, pdfStorage, error) {
+	state := c.loadState()
+	if state == nil || state.State != "ready" || state.Output == "" {
+		return "", nil, os.ErrNotExist
+	}
+
+	location := state.Output
+
+	backend, err := storageFor(location)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return location, backend, nil
+}
+
+// removes the finished pdf from wherever it is stored, if there is one
+func (c *clientContext) removeStoredPdf() {
+	location, backend, err := c.storedPdf()
+	if err != nil {
+		if os.IsNotExist(err) == false {
+			c.warn("unable to locate stored pdf: %s", err.Error())
+		}
+		return
+	}
+
+	if err := backend.remove(c.context(), location); err != nil {
+		c.err("unable to remove stored pdf [%s]: %s", location, err.Error())
+		return
+	}
+
+	c.info("removed stored pdf [%s]", location)
+}
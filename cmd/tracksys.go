@@ -111,6 +111,10 @@ func (c *clientContext) tsGetPagesFromManifest() ([]tsGenericPidInfo, tsResult)
 }
 
 func (c *clientContext) tsGetPidInfo() tsResult {
+	if isMergePid(c.req.pid) == true {
+		return c.tsGetMergeInfo()
+	}
+
 	url := c.getTsURL("/api/pid", c.req.pid, "")
 
 	req, reqErr := http.NewRequest("GET", url, nil)
@@ -168,3 +172,34 @@ func (c *clientContext) tsGetPidInfo() tsResult {
 
 	return tsResult{status: http.StatusOK}
 }
+
+// fetches the transcription or stored ocr text for a master file, if tracksys has any.
+// a page without text is not an error; an empty string is returned.
+func (c *clientContext) tsGetPageText(pid string) (string, error) {
+	url := c.getTsURL("/api/fulltext", pid, "")
+
+	req, reqErr := http.NewRequestWithContext(c.context(), "GET", url, nil)
+	if reqErr != nil {
+		return "", reqErr
+	}
+
+	res, resErr := client.Do(req)
+	if resErr != nil {
+		return "", resErr
+	}
+
+	defer res.Body.Close()
+
+	buf, _ := ioutil.ReadAll(res.Body)
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return strings.TrimSpace(string(buf)), nil
+
+	case http.StatusNotFound:
+		return "", nil
+
+	default:
+		return "", fmt.Errorf("unexpected tracksys fulltext response: %d [%s]", res.StatusCode, buf)
+	}
+}
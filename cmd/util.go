@@ -1,7 +1,10 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"os"
 	"path/filepath"
 	"runtime"
 	"strconv"
@@ -48,6 +51,15 @@ func initVersion() {
 	}
 }
 
+// returns n random bytes, hex encoded.  they come from a cryptographic source, which
+// is safe for concurrent use, and makes tokens and batch ids impossible to guess.
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+
+	return hex.EncodeToString(buf)
+}
+
 func firstElementOf(s []string) string {
 	// return first element of slice, or blank string if empty
 	val := ""
@@ -76,6 +88,60 @@ func getWorkSubDir(pid, unit, token string) string {
 	return subDir
 }
 
+// pids and tokens from a request end up in work directory paths.  names starting
+// with a dot are reserved for the service's own directories (.queue, .locks, etc.)
+func isValidPathSegment(s string) bool {
+	return s != "" && strings.HasPrefix(s, ".") == false && strings.ContainsAny(s, `/\`) == false
+}
+
+// returns true if a work subdirectory stays within the storage directory, and does
+// not name (or lie within) one of the service's own directories
+func isValidWorkSubDir(workSubDir string) bool {
+	for _, part := range strings.Split(workSubDir, "/") {
+		if isValidPathSegment(part) == false {
+			return false
+		}
+	}
+
+	return true
+}
+
+func getWorkDir(workSubDir string) string {
+	return fmt.Sprintf("%s/%s", config.storageDir.value, workSubDir)
+}
+
+// writes data to a temporary file alongside the destination, then renames it
+// into place so that readers never see a partially written file
+func writeFileAtomic(fileName string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	tmpFile := f.Name()
+
+	// temp files are created private; match the permissions of other files we write
+	f.Chmod(0644)
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmpFile)
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+
+	if err := os.Rename(tmpFile, fileName); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+
+	return nil
+}
+
 //
 // end of file
 //
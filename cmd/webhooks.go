@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// webhook delivery retry schedule: the delay doubles after each failed attempt
+const (
+	webhookInitialBackoff = 5 * time.Second
+	webhookMaxBackoff     = 10 * time.Minute
+)
+
+// a callback registered by a caller, waiting for its pdf to finish
+type webhookCallback struct {
+	URL         string `json:"url"`
+	Token       string `json:"token,omitempty"`
+	DownloadURL string `json:"download_url"`
+}
+
+// the body posted to a callback url
+type webhookPayload struct {
+	Pid           string    `json:"pid"`
+	Token         string    `json:"token,omitempty"`
+	State         string    `json:"state"` // ready or failed
+	DownloadURL   string    `json:"download_url,omitempty"`
+	FailureReason string    `json:"failure_reason,omitempty"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// a pending webhook delivery, persisted so that retries survive a restart
+type webhookDelivery struct {
+	ID       string          `json:"id"`
+	URL      string          `json:"url"`
+	Payload  json.RawMessage `json:"payload"`
+	Attempts int             `json:"attempts"`
+	Instance string          `json:"instance"`
+}
+
+// serializes registering and collecting callbacks within this instance
+var callbacksMu sync.Mutex
+
+// callbacks connect directly (not through any proxy), so that every address they
+// connect to can be checked.  redirects are not followed: they could take a signed
+// callback from an allowed host to any other.
+var webhookClient = &http.Client{
+	Timeout:   30 * time.Second,
+	Transport: &http.Transport{DialContext: webhookDial, TLSHandshakeTimeout: 10 * time.Second},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return fmt.Errorf("callback redirected to %s; redirects are not followed", req.URL.Redacted())
+	},
+}
+
+// address ranges that are not reachable from the internet at large, beyond those the
+// net package knows about: shared (carrier-grade NAT) addresses, and ipv6 translation
+// and tunnelling prefixes, which embed ipv4 addresses that could be private
+var nonPublicNets = parseCIDRs(
+	"0.0.0.0/8",      // this network
+	"100.64.0.0/10",  // shared address space (CGNAT)
+	"192.0.0.0/24",   // ietf protocol assignments
+	"198.18.0.0/15",  // benchmarking
+	"240.0.0.0/4",    // reserved, and broadcast
+	"64:ff9b::/96",   // NAT64, well-known prefix
+	"64:ff9b:1::/48", // NAT64, local use
+	"2001::/32",      // teredo
+	"2002::/16",      // 6to4
+	"100::/64",       // discard only
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Fatalf("invalid cidr: [%s]", cidr)
+		}
+		nets = append(nets, n)
+	}
+
+	return nets
+}
+
+// where callbacks may be sent, from PDFWS_WEBHOOK_ALLOW: whole hosts, and url prefixes
+var webhookAllowHosts = make(map[string]bool)
+var webhookAllowPrefixes []*url.URL
+
+func webhookDir() string {
+	return fmt.Sprintf("%s/.webhooks", config.storageDir.value)
+}
+
+func callbacksFile(workDir string) string {
+	return fmt.Sprintf("%s/callbacks.jsonl", workDir)
+}
+
+// callbacks must go to an allowed host or url prefix if any are configured, and
+// otherwise to a host with only public addresses, so that callers cannot have the
+// service post to itself, cloud metadata endpoints, or anything else on the intranet
+func isValidCallbackURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return false
+	}
+
+	for _, prefix := range webhookAllowPrefixes {
+		if u.Scheme == prefix.Scheme && strings.EqualFold(u.Host, prefix.Host) == true && strings.HasPrefix(u.Path, prefix.Path) == true {
+			return true
+		}
+	}
+
+	if webhookAllowHosts[strings.ToLower(u.Hostname())] == true {
+		return true
+	}
+
+	if config.webhookAllow.value != "" {
+		return false
+	}
+
+	_, err = publicAddress(context.Background(), u.Hostname())
+
+	return err == nil
+}
+
+// returns true for addresses reachable from the internet at large
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() == true || ip.IsPrivate() == true || ip.IsUnspecified() == true ||
+		ip.IsLinkLocalUnicast() == true || ip.IsLinkLocalMulticast() == true ||
+		ip.IsInterfaceLocalMulticast() == true || ip.IsMulticast() == true {
+		return false
+	}
+
+	for _, n := range nonPublicNets {
+		if n.Contains(ip) == true {
+			return false
+		}
+	}
+
+	return true
+}
+
+// resolves a host, returning one of its addresses if all of them are public
+func publicAddress(ctx context.Context, host string) (net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", host)
+	}
+
+	for _, addr := range addrs {
+		if isPublicIP(addr.IP) == false {
+			return nil, fmt.Errorf("%s resolves to non-public address %s", host, addr.IP.String())
+		}
+	}
+
+	return addrs[0].IP, nil
+}
+
+// returns true if callbacks may connect to a host whatever its addresses: an allowed
+// host, or the host of an allowed prefix
+func isAllowedWebhookHost(host string) bool {
+	if webhookAllowHosts[strings.ToLower(host)] == true {
+		return true
+	}
+
+	for _, prefix := range webhookAllowPrefixes {
+		if strings.EqualFold(prefix.Hostname(), host) == true {
+			return true
+		}
+	}
+
+	return false
+}
+
+// connects to a callback host, refusing non-public addresses unless the host is
+// allowed.  checking here as well as when a callback is registered also covers hosts
+// whose addresses have changed since.
+func webhookDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+
+	if isAllowedWebhookHost(host) == true {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	ip, err := publicAddress(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	return dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+}
+
+func initWebhooks() {
+	for _, entry := range strings.Split(config.webhookAllow.value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		// only callbacks under a prefix are accepted
+		if strings.Contains(entry, "://") == true {
+			u, err := url.Parse(entry)
+			if err != nil || u.Hostname() == "" {
+				log.Fatalf("invalid webhook allow entry: [%s]", entry)
+			}
+			webhookAllowPrefixes = append(webhookAllowPrefixes, u)
+			continue
+		}
+
+		webhookAllowHosts[strings.ToLower(entry)] = true
+	}
+
+	if config.webhookSecret.value == "" {
+		return
+	}
+
+	if err := os.MkdirAll(webhookDir(), 0755); err != nil {
+		log.Fatalf("unable to create webhook directory: %s", err.Error())
+	}
+
+	// pick up deliveries left behind by this or any other instance that has stopped
+	// working on them, now and periodically
+	go func() {
+		for {
+			adoptWebhookDeliveries()
+			time.Sleep(webhookMaxBackoff)
+		}
+	}()
+}
+
+// the absolute url a caller can use to download this pdf
+func (c *clientContext) absoluteDownloadURL() string {
+	scheme := "http"
+	if c.ctx.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.ctx.GetHeader("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+
+	return fmt.Sprintf("%s://%s%s", scheme, c.ctx.Request.Host, c.downloadURL())
+}
+
+// registers a callback for this pdf.  if the pdf already finished (possibly
+// while we were registering), the callback is fired straight away.
+func (c *clientContext) registerCallback(callbackURL string) error {
+	cb := webhookCallback{
+		URL:         callbackURL,
+		Token:       c.req.token,
+		DownloadURL: c.absoluteDownloadURL(),
+	}
+
+	buf, err := json.Marshal(cb)
+	if err != nil {
+		return err
+	}
+
+	callbacksMu.Lock()
+	f, err := os.OpenFile(callbacksFile(c.pdf.workDir), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err == nil {
+		_, err = f.Write(append(buf, '\n'))
+		f.Close()
+	}
+	callbacksMu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	c.info("registered callback: %s", callbackURL)
+
+	if state := c.loadState(); state != nil {
+		switch state.State {
+		case "ready":
+			c.fireCallbacks("ready", "")
+
+		case "failed":
+			c.fireCallbacks("failed", state.Error)
+		}
+	}
+
+	return nil
+}
+
+// takes all registered callbacks for this pdf, and queues a delivery to each one
+func (c *clientContext) fireCallbacks(state, reason string) {
+	if config.webhookSecret.value == "" {
+		return
+	}
+
+	// whoever renames the file gets to fire its callbacks, so each fires only once
+	callbacksMu.Lock()
+	taken := fmt.Sprintf("%s.%s", callbacksFile(c.pdf.workDir), c.reqID)
+	err := os.Rename(callbacksFile(c.pdf.workDir), taken)
+	callbacksMu.Unlock()
+
+	if err != nil {
+		return
+	}
+	defer os.Remove(taken)
+
+	f, err := os.Open(taken)
+	if err != nil {
+		c.err("unable to read callbacks: %s", err.Error())
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var cb webhookCallback
+		if err := json.Unmarshal(scanner.Bytes(), &cb); err != nil {
+			c.warn("skipping unreadable callback: %s", err.Error())
+			continue
+		}
+
+		payload := webhookPayload{
+			Pid:           c.req.pid,
+			Token:         cb.Token,
+			State:         state,
+			FailureReason: strings.TrimSpace(reason),
+			Timestamp:     time.Now(),
+		}
+
+		if state == "ready" {
+			payload.DownloadURL = cb.DownloadURL
+		}
+
+		buf, err := json.Marshal(payload)
+		if err != nil {
+			c.err("unable to serialize callback payload: %s", err.Error())
+			continue
+		}
+
+		d := &webhookDelivery{
+			ID:       fmt.Sprintf("%s-%s", c.reqID, randomHex(4)),
+			URL:      cb.URL,
+			Payload:  buf,
+			Instance: instanceID,
+		}
+
+		d.save()
+
+		c.info("queued %s callback %s to %s", state, d.ID, d.URL)
+
+		go d.deliver()
+	}
+}
+
+func (d *webhookDelivery) fileName() string {
+	return fmt.Sprintf("%s/%s.json", webhookDir(), d.ID)
+}
+
+func (d *webhookDelivery) save() {
+	buf, err := json.Marshal(d)
+	if err != nil {
+		log.Printf("WARNING: unable to serialize webhook delivery %s: %s", d.ID, err.Error())
+		return
+	}
+
+	if err := writeFileAtomic(d.fileName(), buf); err != nil {
+		log.Printf("WARNING: unable to persist webhook delivery %s: %s", d.ID, err.Error())
+	}
+}
+
+// signs a payload with the shared secret, so receivers can verify it came from us
+func signWebhookPayload(payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(config.webhookSecret.value))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// posts the payload, retrying with exponential backoff until it is accepted
+// or the configured number of attempts is used up
+func (d *webhookDelivery) deliver() {
+	backoff := webhookInitialBackoff
+	for i := 1; i < d.Attempts; i++ {
+		backoff = minDuration(backoff*2, webhookMaxBackoff)
+	}
+
+	for d.Attempts < config.webhookAttempts.value {
+		d.Attempts++
+		d.save()
+
+		err := d.post()
+		if err == nil {
+			log.Printf("INFO: webhook %s delivered to %s", d.ID, d.URL)
+			os.Remove(d.fileName())
+			return
+		}
+
+		log.Printf("WARNING: webhook %s to %s failed (attempt %d of %d): %s", d.ID, d.URL, d.Attempts, config.webhookAttempts.value, err.Error())
+
+		if d.Attempts < config.webhookAttempts.value {
+			time.Sleep(backoff)
+			backoff = minDuration(backoff*2, webhookMaxBackoff)
+		}
+	}
+
+	log.Printf("ERROR: giving up on webhook %s to %s", d.ID, d.URL)
+	os.Remove(d.fileName())
+}
+
+func (d *webhookDelivery) post() error {
+	req, err := http.NewRequest("POST", d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-PDFWS-Delivery", d.ID)
+	req.Header.Set("X-PDFWS-Signature", signWebhookPayload(d.Payload))
+
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status: %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+// resumes deliveries whose owner has stopped working on them.  an owner rewrites
+// its delivery before every attempt, so one untouched for longer than the maximum
+// backoff has been abandoned (or was left by an earlier run of this instance).
+func adoptWebhookDeliveries() {
+	files, _ := filepath.Glob(fmt.Sprintf("%s/*.json", webhookDir()))
+
+	for _, fileName := range files {
+		fi, err := os.Stat(fileName)
+		if err != nil || time.Since(fi.ModTime()) < 2*webhookMaxBackoff {
+			continue
+		}
+
+		// renaming first ensures only one instance adopts it
+		adopting := fmt.Sprintf("%s.%s", fileName, instanceID)
+		if err := os.Rename(fileName, adopting); err != nil {
+			continue
+		}
+
+		buf, err := os.ReadFile(adopting)
+		os.Remove(adopting)
+
+		var d webhookDelivery
+		if err != nil || json.Unmarshal(buf, &d) != nil || d.ID == "" {
+			log.Printf("WARNING: discarding unreadable webhook delivery: %s", fileName)
+			continue
+		}
+
+		log.Printf("INFO: resuming webhook %s to %s from instance %s", d.ID, d.URL, d.Instance)
+
+		d.Instance = instanceID
+		d.save()
+
+		go d.deliver()
+	}
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+// applies a PDFWS_WEBHOOK_ALLOW setting, replacing any earlier one
+func setWebhookAllow(t *testing.T, allow string) {
+	config.webhookAllow.value = allow
+	webhookAllowHosts = make(map[string]bool)
+	webhookAllowPrefixes = nil
+
+	initWebhooks()
+
+	t.Cleanup(func() {
+		config.webhookAllow.value = ""
+		webhookAllowHosts = make(map[string]bool)
+		webhookAllowPrefixes = nil
+	})
+}
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"8.8.8.8", true},
+		{"2606:4700::1111", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"0.0.0.0", false},
+		{"100.64.0.1", false},
+		{"100.127.255.254", false},
+		{"100.128.0.1", true},
+		{"198.18.0.1", false},
+		{"255.255.255.255", false},
+		{"::1", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:100.64.0.1", false},
+		{"64:ff9b::a00:1", false},
+		{"64:ff9b:1::1", false},
+		{"2002:a00:1::1", false},
+		{"2001:0:a00:1::1", false},
+	}
+
+	for _, test := range tests {
+		if got := isPublicIP(net.ParseIP(test.ip)); got != test.public {
+			t.Errorf("%s: got %v, want %v", test.ip, got, test.public)
+		}
+	}
+}
+
+func TestIsValidCallbackURL(t *testing.T) {
+	// addresses are used throughout, so that nothing needs resolving
+	tests := []struct {
+		allow string
+		url   string
+		valid bool
+	}{
+		{"", "https://8.8.8.8/hook", true},
+		{"", "http://8.8.8.8:8080/hook?x=1", true},
+		{"", "ftp://8.8.8.8/hook", false},
+		{"", "https:///hook", false},
+		{"", "http://127.0.0.1/hook", false},
+		{"", "http://10.0.0.5/hook", false},
+		{"", "http://169.254.169.254/latest/meta-data", false},
+		{"", "http://100.64.0.1/hook", false},
+		{"", "http://[::1]/hook", false},
+		{"", "http://[64:ff9b::a9fe:a9fe]/hook", false},
+
+		{"10.0.0.5", "http://10.0.0.5/hook", true},
+		{"10.0.0.5", "https://10.0.0.5:8443/any/path", true},
+		{"10.0.0.5", "http://10.0.0.6/hook", false},
+		{"10.0.0.5", "https://8.8.8.8/hook", false},
+
+		{"https://10.0.0.5/callbacks/", "https://10.0.0.5/callbacks/pdf", true},
+		{"https://10.0.0.5/callbacks/", "https://10.0.0.5/other", false},
+		{"https://10.0.0.5/callbacks/", "http://10.0.0.5/callbacks/pdf", false},
+		{"https://10.0.0.5/callbacks/", "https://10.0.0.5:8443/callbacks/pdf", false},
+	}
+
+	for _, test := range tests {
+		setWebhookAllow(t, test.allow)
+
+		if got := isValidCallbackURL(test.url); got != test.valid {
+			t.Errorf("allow [%s], %s: got %v, want %v", test.allow, test.url, got, test.valid)
+		}
+	}
+}
+
+// an allowed host cannot pass a signed callback on to somewhere else
+func TestWebhookRedirectNotFollowed(t *testing.T) {
+	var redirected atomic.Int32
+
+	elsewhere := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirected.Add(1)
+	}))
+	defer elsewhere.Close()
+
+	allowed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, elsewhere.URL+"/stolen", http.StatusTemporaryRedirect)
+	}))
+	defer allowed.Close()
+
+	u, _ := url.Parse(allowed.URL)
+	setWebhookAllow(t, u.Hostname())
+
+	d := webhookDelivery{ID: "test", URL: allowed.URL + "/hook", Payload: json.RawMessage(`{"state":"ready"}`)}
+
+	if err := d.post(); err == nil {
+		t.Errorf("redirected callback reported as delivered")
+	}
+
+	if n := redirected.Load(); n != 0 {
+		t.Errorf("redirect followed %d times", n)
+	}
+}
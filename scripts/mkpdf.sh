@@ -5,6 +5,7 @@
 # general arguments
 outpdf=""
 numimagesperpdf="50"
+metadata=""
 
 # cover page arguments
 header=""
@@ -12,6 +13,7 @@ logo=""
 title=""
 author=""
 footer=""
+position="back"
 
 # internal variables
 pdfs=()
@@ -104,7 +106,9 @@ function create_cover_image ()
 	capmargin="250"
 	capwidth="$(expr "$width" - 2 \* "$capmargin")"
 
-	logowidth="$($IDENTIFY -format "%w" "$logo")"
+	# the logo is optional
+	logowidth="0"
+	[ "$logo" != "" ] && logowidth="$($IDENTIFY -format "%w" "$logo")"
 	logoinset="$(expr \( "$width" - "$logowidth" \) / 2)"
 
 	pointreg="50"
@@ -124,7 +128,7 @@ function create_cover_image ()
 	(( yoffset += 250 + "$ylast" ))
 
 	ylast="$(create_section logo "$logo" logo.miff)"
-	(( yoffset += 250 + "$ylast" ))
+	[ "$ylast" -gt 0 ] && (( yoffset += 250 + "$ylast" ))
 
 	ylast="$(create_section text "$title" title.miff "$pointbig")"
 	(( yoffset += "$ylast" ))
@@ -235,6 +239,10 @@ function merge_partial_pdfs ()
 	basepdf="$(basename "$outpdf")"
 	outtitle="${basepdf/.pdf/}"
 
+	# use supplied document information if given, otherwise just set the title
+	docinfo=(-c "[ /Title (${outtitle}) /DOCINFO pdfmark")
+	[ "$metadata" != "" ] && docinfo=("$metadata")
+
 	gs \
 		-q \
 		-dBATCH \
@@ -243,7 +251,7 @@ function merge_partial_pdfs ()
 		-sDEVICE=pdfwrite \
 		-sOutputFile="$outpdf" \
 		"${pdfs[@]}" \
-		-c "[ /Title (${outtitle}) /DOCINFO pdfmark" \
+		"${docinfo[@]}" \
 		|| die "pdf merge failed"
 }
 
@@ -272,8 +280,10 @@ while [ "$#" -gt "0" ]; do
 		-f ) footer="$val"; shift; shift ;;
 		-h ) header="$val"; shift; shift ;;
 		-l ) logo="$val"; shift; shift ;;
+		-m ) metadata="$val"; shift; shift ;;
 		-n ) numimagesperpdf="$val"; shift; shift ;;
 		-o ) outpdf="$val"; shift; shift ;;
+		-p ) position="$val"; shift; shift ;;
 		-t ) title="$val"; shift; shift ;;
 		-- ) shift; break ;;
 		-* ) die "unknown option: [$arg]" ;;
@@ -289,18 +299,19 @@ cd "$workdir" || die "could not change to directory: [$workdir]"
 
 if [ "$cover" = "y" ]; then
 	# validate arguments
-	[ ! -f "$logo" ] && die "logo file does not exist: [$logo]"
+	[ "$logo" != "" ] && [ ! -f "$logo" ] && die "logo file does not exist: [$logo]"
 
-	for var in header title footer; do
-		val="${!var}"
-		[ "$val" = "" ] && die "missing $var: [$val]"
-	done
+	[ "$title" = "" ] && die "missing title: [$title]"
 
 	determine_output_resolution "$@"
 
 	create_cover_image
 
-	create_partial_pdfs "$@" "cover.png"
+	case $position in
+		front ) create_partial_pdfs "cover.png" "$@" ;;
+		back ) create_partial_pdfs "$@" "cover.png" ;;
+		* ) die "unknown cover position: [$position]" ;;
+	esac
 else
 	# no cover page
 	determine_output_resolution "$@"